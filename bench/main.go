@@ -3,9 +3,11 @@ package main
 /*
 $ sudo launchctl limit maxfiles 1000000 1000000
 $ ulimit -n 100000
+$ GOPATH=$PWD:$PWD/vendor go run bench/main.go
 */
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -13,24 +15,27 @@ import (
 	"time"
 
 	"github.com/dustin/go-humanize"
+	"martd/client"
 )
 
 var (
-	URL = "http://127.0.0.1:54321/sub?ch="
+	URL     = "http://127.0.0.1:54321"
+	Channel = "ch"
 )
 
 func doOnce(ok, nok, oops chan bool, etag *string) {
-	resp, err := http.Get(URL + *etag)
+	s := client.New(URL).Subscribe().Since(Channel, *etag)
+	_, err := s.Poll(context.Background())
+	if e, rejected := err.(*client.Error); rejected {
+		fmt.Println("got non zero code", e)
+		nok <- true
+		return
+	}
 	if err != nil {
 		fmt.Println("Cant load URL", err)
 		oops <- true
 		return
 	}
-	if resp.StatusCode != 200 {
-		fmt.Println("got non zero code", resp)
-		nok <- true
-		return
-	}
 	ok <- true
 }
 
@@ -52,7 +57,7 @@ func main() {
 	}
 	fmt.Println("")
 
-	fmt.Println("go routines started", *N, URL+*etag, humanize.Time(start))
+	fmt.Println("go routines started", *N, Channel, *etag, humanize.Time(start))
 
 	n_ok := 0
 	n_nok := 0
@@ -78,7 +83,7 @@ func main() {
 	fmt.Println("time: ", humanize.Time(start))
 
 	fmt.Println("\nserver status:")
-	resp, err := http.Get("http://localhost:54321/debug/vars")
+	resp, err := http.Get(URL + "/debug/vars")
 	if err != nil {
 		fmt.Println("cant get status")
 		return
@@ -0,0 +1,296 @@
+// Package client publishes to and subscribes from a martd server over its
+// HTTP API.
+//
+//	c := client.New("http://localhost:54321")
+//	etag, err := c.Publish(ctx, "news", []byte("hello"), &client.Options{Size: 100})
+//
+//	s := c.Subscribe("news")
+//	err = s.Run(ctx, func(m *client.Message) {
+//		fmt.Println(m.Channel, string(m.Data))
+//	})
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MinBackoff = 100 * time.Millisecond
+	MaxBackoff = 30 * time.Second
+)
+
+// Client talks to one martd server.
+type Client struct {
+	// URL is the base URL of the server, like http://localhost:54321.
+	URL string
+	// HTTP makes the requests, it must not time out before a long poll
+	// does. http.DefaultClient if nil.
+	HTTP *http.Client
+	// Header is sent with every request, for -auth-url or -admin-key.
+	Header http.Header
+}
+
+func New(url string) *Client {
+	return &Client{URL: strings.TrimSuffix(url, "/"), Header: http.Header{}}
+}
+
+// Options are the attributes a channel is created with, by its first
+// publish, and the key of a channel that has one. Zero values are the
+// server's defaults.
+type Options struct {
+	Size         uint
+	Life         time.Duration
+	One2One      bool
+	Key          string
+	History      uint
+	HistoryBytes int64
+	// Sync waits till the message is stored.
+	Sync bool
+}
+
+// Error is a request martd rejected, with the reason it gave.
+type Error struct {
+	Status  int
+	Message string
+	// Shards is the node of each channel, when a subscription spans nodes.
+	Shards map[string]string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("martd: %s (%d)", e.Message, e.Status)
+}
+
+// Temporary is true for errors a request may not get again, like a server
+// that is restarting.
+func (e *Error) Temporary() bool {
+	return e.Status >= 500 || e.Status == http.StatusTooManyRequests
+}
+
+// Publish publishes data to channel, creating it with opts if it does not
+// exist, and returns the etag of the message.
+func (c *Client) Publish(
+	ctx context.Context, channel string, data []byte, opts *Options,
+) (string, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	q := url.Values{"channel": {channel}}
+	if opts.Size != 0 {
+		q.Set("size", strconv.FormatUint(uint64(opts.Size), 10))
+	}
+	if opts.Life != 0 {
+		q.Set("life", strconv.FormatInt(int64(opts.Life), 10))
+	}
+	if opts.One2One {
+		q.Set("one2one", "true")
+	}
+	if opts.Key != "" {
+		q.Set("key", opts.Key)
+	}
+	if opts.History != 0 {
+		q.Set("history", strconv.FormatUint(uint64(opts.History), 10))
+	}
+	if opts.HistoryBytes != 0 {
+		q.Set("history_bytes", strconv.FormatInt(opts.HistoryBytes, 10))
+	}
+	if opts.Sync {
+		q.Set("sync", "true")
+	}
+
+	resp := struct {
+		Etag string `json:"etag"`
+	}{}
+	err := c.do(ctx, "POST", "/pub?"+q.Encode(), bytes.NewReader(data), &resp)
+	return resp.Etag, err
+}
+
+// do makes a request and decodes its JSON response into v, or returns an
+// *Error if martd rejected it.
+func (c *Client) do(
+	ctx context.Context, method, path string, body io.Reader, v interface{},
+) error {
+	req, err := http.NewRequest(method, c.URL+path, body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	for k, vs := range c.Header {
+		req.Header[k] = vs
+	}
+
+	hc := c.HTTP
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return parseError(resp.StatusCode, data)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// parseError reads the JSON of a rejected request, or takes the body as the
+// message if it is not JSON, as for a missing admin key.
+func parseError(status int, body []byte) *Error {
+	e := &Error{Status: status}
+	j := struct {
+		Error  string            `json:"error"`
+		Shards map[string]string `json:"shards"`
+	}{}
+	if json.Unmarshal(body, &j) == nil && j.Error != "" {
+		e.Message, e.Shards = j.Error, j.Shards
+	} else {
+		e.Message = strings.TrimSpace(string(body))
+	}
+	if e.Message == "" {
+		e.Message = http.StatusText(status)
+	}
+	return e
+}
+
+// Message is a message received on a channel.
+type Message struct {
+	Channel string
+	Data    []byte
+}
+
+// Subscriber long polls a set of channels, tracking the etag of each, so no
+// message is missed between polls.
+type Subscriber struct {
+	client *Client
+	cid    string
+
+	lock  sync.Mutex
+	etags map[string]string
+}
+
+// Subscribe returns a Subscriber for channels, getting all messages they
+// have; see Since.
+func (c *Client) Subscribe(channels ...string) *Subscriber {
+	s := &Subscriber{client: c, cid: newCid(), etags: map[string]string{}}
+	for _, name := range channels {
+		s.etags[name] = "0"
+	}
+	return s
+}
+
+// Since makes the subscriber get the messages of channel after etag, like one
+// saved from an earlier run with Etag. It adds channel if it is not there.
+func (s *Subscriber) Since(channel, etag string) *Subscriber {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.etags[channel] = etag
+	return s
+}
+
+// Now makes the subscriber only get messages published from now on.
+func (s *Subscriber) Now() *Subscriber {
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for name := range s.etags {
+		s.etags[name] = now
+	}
+	return s
+}
+
+// Etag returns the etag of the last message received on channel.
+func (s *Subscriber) Etag(channel string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.etags[channel]
+}
+
+// Poll waits for messages on any of the channels, and returns them, oldest
+// first per channel.
+func (s *Subscriber) Poll(ctx context.Context) ([]*Message, error) {
+	q := url.Values{"cid": {s.cid}}
+	s.lock.Lock()
+	for name, etag := range s.etags {
+		q.Set(name, etag)
+	}
+	s.lock.Unlock()
+
+	resp := struct {
+		Channels map[string]*struct {
+			Etag    string   `json:"etag"`
+			Payload []string `json:"payload"`
+		} `json:"channels"`
+	}{}
+	if err := s.client.do(ctx, "GET", "/sub?"+q.Encode(), nil, &resp); err != nil {
+		return nil, err
+	}
+
+	msgs := []*Message{}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for name, ch := range resp.Channels {
+		s.etags[name] = ch.Etag
+		for _, payload := range ch.Payload {
+			msgs = append(msgs, &Message{name, []byte(payload)})
+		}
+	}
+	return msgs, nil
+}
+
+// Run polls till ctx is done, calling f with each message. Failed polls are
+// retried with backoff, unless martd rejected the subscription, in which
+// case that *Error is returned.
+func (s *Subscriber) Run(ctx context.Context, f func(*Message)) error {
+	backoff := MinBackoff
+	for {
+		msgs, err := s.Poll(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if e, ok := err.(*Error); ok && !e.Temporary() {
+			return err
+		}
+		if err != nil {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			if backoff *= 2; backoff > MaxBackoff {
+				backoff = MaxBackoff
+			}
+			continue
+		}
+
+		backoff = MinBackoff
+		for _, m := range msgs {
+			f(m)
+		}
+	}
+}
+
+// newCid returns a random client id, which -auth-url decisions are cached
+// by.
+func newCid() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
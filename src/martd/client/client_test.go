@@ -0,0 +1,144 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"martd/server"
+)
+
+// newTestClient starts a martd with memory storage, behind wrap if not nil,
+// and returns a client of it.
+func newTestClient(
+	t *testing.T, wrap func(h http.Handler) http.Handler,
+) *Client {
+	opts := server.Defaults
+	opts.Storage = "memory"
+	s, err := server.New(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+
+	var h http.Handler = s
+	if wrap != nil {
+		h = wrap(s)
+	}
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	c := New(srv.URL + "/")
+	c.HTTP = &http.Client{Timeout: 5 * time.Second}
+	return c
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	c := newTestClient(t, nil)
+	ctx := context.Background()
+
+	opts := &Options{Size: 10, Life: time.Hour, Key: "k", Sync: true}
+	etag, err := c.Publish(ctx, "news", []byte("a"), opts)
+	if err != nil || etag == "" {
+		t.Fatalf("publish: %q, %v", etag, err)
+	}
+	_, err = c.Publish(ctx, "news", []byte("x"), nil)
+	if e, ok := err.(*Error); !ok || e.Status != http.StatusBadRequest ||
+		e.Message != "invalid key" || e.Temporary() {
+		t.Fatalf("publish without the key: %#v", err)
+	}
+
+	sub := c.Subscribe("news")
+	msgs, err := sub.Poll(ctx)
+	if err != nil || len(msgs) != 1 || string(msgs[0].Data) != "a" ||
+		msgs[0].Channel != "news" {
+		t.Fatalf("poll: %v, %v", msgs, err)
+	}
+	if sub.Etag("news") != etag {
+		t.Fatalf("etag %q, want %q", sub.Etag("news"), etag)
+	}
+
+	// Run waits for the next message, after the etag it has
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		c.Publish(ctx, "news", []byte("b"), opts)
+	}()
+	got := ""
+	err = sub.Run(ctx, func(m *Message) {
+		got += string(m.Data)
+		cancel()
+	})
+	if err != context.Canceled || got != "b" {
+		t.Fatalf("run: got %q, %v", got, err)
+	}
+}
+
+func TestRunRetries(t *testing.T) {
+	// the first poll fails as a restarting server does
+	failed := int32(0)
+	c := newTestClient(t, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/sub" && atomic.AddInt32(&failed, 1) == 1 {
+				http.Error(w, "", http.StatusServiceUnavailable)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := c.Publish(ctx, "news", []byte("a"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	got := ""
+	err := c.Subscribe("news").Run(ctx, func(m *Message) {
+		got += string(m.Data)
+		cancel()
+	})
+	if err != context.Canceled || got != "a" {
+		t.Fatalf("run: got %q, %v", got, err)
+	}
+}
+
+func TestRunRejected(t *testing.T) {
+	c := newTestClient(t, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(
+				w, `{"error":"not allowed: news"}`, http.StatusForbidden,
+			)
+		})
+	})
+	err := c.Subscribe("news").Run(context.Background(), func(*Message) {})
+	if e, ok := err.(*Error); !ok || e.Status != http.StatusForbidden ||
+		e.Message != "not allowed: news" {
+		t.Fatalf("got %#v", err)
+	}
+}
+
+func TestParseError(t *testing.T) {
+	for body, want := range map[string]string{
+		`{"error":"invalid key"}`: "invalid key",
+		"unauthorized\n":          "unauthorized",
+		"":                        "Unauthorized",
+	} {
+		e := parseError(http.StatusUnauthorized, []byte(body))
+		if e.Message != want {
+			t.Errorf("%q: got %q, want %q", body, e.Message, want)
+		}
+	}
+	e := parseError(http.StatusConflict, []byte(
+		`{"error":"channels on other shards","shards":{"b":"http://b"}}`,
+	))
+	if e.Shards["b"] != "http://b" {
+		t.Fatalf("shards %+v", e.Shards)
+	}
+}
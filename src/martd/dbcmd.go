@@ -0,0 +1,342 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"martd/server"
+)
+
+func init() {
+	Commands["db"] = DBMain
+}
+
+// DBMain implements "martd db <list|show|verify|repair|vacuum>", which work
+// on the SQLite file given by -persist, without starting the server. Only
+// repair and vacuum change it, and they should be run with the server
+// stopped, the others open it read only.
+func DBMain(args []string) error {
+	commands := map[string]func(*sql.DB, []string) error{
+		"list":   dbList,
+		"show":   dbShow,
+		"verify": dbVerify,
+		"repair": dbRepair,
+		"vacuum": dbVacuum,
+	}
+
+	if len(args) == 0 || commands[args[0]] == nil {
+		return fmt.Errorf("usage: martd db list|show|verify|repair|vacuum")
+	}
+
+	if opts.Storage != "sqlite" {
+		return fmt.Errorf(
+			"db works on sqlite storage only, not -storage=%s", opts.Storage,
+		)
+	}
+	if _, err := os.Stat(opts.Persist); err != nil {
+		return err
+	}
+
+	open := server.OpenDBReadOnly
+	if args[0] == "repair" || args[0] == "vacuum" {
+		open = server.GetDB
+	}
+	db, err := open(opts.Persist)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return commands[args[0]](db, args[1:])
+}
+
+// dbList prints the channels with their message counts, never their keys.
+func dbList(db *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("db list", flag.ExitOnError)
+	prefix := fs.String("prefix", "", "Only channels starting with this.")
+	fs.Parse(args)
+	end := prefixEnd(*prefix)
+
+	rows, err := db.Query(
+		`select
+			c.name, c.size, c.life, c.one2one, c.key != '', c.created,
+			count(p.id), coalesce(sum(length(p.payload)), 0),
+			coalesce(min(p.id), 0), coalesce(max(p.id), 0)
+		from channels c left join payloads p on p.channel = c.name
+		where c.name >= ? and (? = '' or c.name < ?)
+		group by c.name order by c.name`,
+		*prefix, end, end,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(
+		w, "NAME\tSIZE\tLIFE\tONE2ONE\tKEY\tCREATED\tMESSAGES\tBYTES\tOLDEST\tNEWEST",
+	)
+	for rows.Next() {
+		var name string
+		var size, nMsgs, nBytes uint
+		var life, created, oldest, newest int64
+		var one2one, hasKey bool
+		err := rows.Scan(
+			&name, &size, &life, &one2one, &hasKey, &created, &nMsgs, &nBytes,
+			&oldest, &newest,
+		)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(
+			w, "%s\t%d\t%s\t%t\t%t\t%s\t%d\t%d\t%d\t%d\n", name, size,
+			time.Duration(life), one2one, hasKey, formatEtag(created), nMsgs,
+			nBytes, oldest, newest,
+		)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// prefixEnd returns the smallest string greater than all those starting with
+// prefix, or "" if there is none. SQLite compares names byte by byte.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] != 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// dbShow prints the messages of a channel, newest last.
+func dbShow(db *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("db show", flag.ExitOnError)
+	limit := fs.Int("limit", 100, "Show at most this many newest messages.")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: martd db show [-limit n] channel")
+	}
+
+	rows, err := db.Query(
+		`select id, expiry, payload from (
+			select id, expiry, payload from payloads where channel = ?
+			order by id desc limit ?
+		) order by id`,
+		fs.Arg(0), *limit,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ETAG\tCREATED\tEXPIRES\tPAYLOAD")
+	for rows.Next() {
+		var id, expiry int64
+		var payload []byte
+		if err := rows.Scan(&id, &expiry, &payload); err != nil {
+			return err
+		}
+		fmt.Fprintf(
+			w, "%d\t%s\t%s\t%q\n", id, formatEtag(id), formatEtag(expiry),
+			payload,
+		)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func formatEtag(etag int64) string {
+	return time.Unix(0, etag).Format(time.RFC3339)
+}
+
+// dbCheck is one verify check, a query returning a count and a description
+// for each problem found, and the fix repair applies for it.
+type dbCheck struct {
+	name, query, fix string
+}
+
+// dbKeep is how many messages channel c keeps, null for no limit.
+const dbKeep = `(case
+	when c.history > 0 then c.history
+	when c.history_bytes > 0 then null
+	else c.size end)`
+
+var dbChecks = []dbCheck{
+	{
+		"duplicate ids",
+		`select count(*), channel || ' id ' || id from payloads not indexed
+		group by channel, id having count(*) > 1`,
+		// only possible with a corrupt primary key index, which is not
+		// used to find them, and rebuilt once they are gone
+		`delete from payloads where rowid not in (
+			select min(rowid) from payloads not indexed group by channel, id
+		);
+		reindex`,
+	},
+	{
+		"messages past expiry",
+		`select count(*), channel from payloads where expiry < ?
+		group by channel`,
+		`delete from payloads where expiry < ?`,
+	},
+	{
+		// history for channels that spill, those with only history_bytes
+		// are not checked
+		"channels over their size",
+		`select count(*) - ` + dbKeep + `, c.name from payloads p
+		join channels c on p.channel = c.name
+		group by c.name having count(*) > ` + dbKeep,
+		`delete from payloads where rowid in (
+			select p.rowid from payloads p join channels c on p.channel = c.name
+			where (
+				select count(*) from payloads n
+				where n.channel = p.channel and n.id > p.id
+			) >= ` + dbKeep + `
+		)`,
+	},
+	{
+		"messages without a channel",
+		`select count(*), channel from payloads
+		where channel not in (select name from channels)
+		group by channel`,
+		`insert or ignore into channels(name, size, life, one2one, key, created)
+		select channel, size, life, one2one, key, min(id)
+		from payloads where channel not in (select name from channels)
+		group by channel`,
+	},
+}
+
+// verify runs SQLite's integrity check and the checks, prints the problems
+// found, and returns the checks that found any. With force a failed
+// integrity check is printed, and the checks run anyway.
+func verify(db *sql.DB, force bool) ([]dbCheck, error) {
+	var result string
+	if err := db.QueryRow("pragma integrity_check").Scan(&result); err != nil {
+		return nil, err
+	}
+	if result != "ok" && !force {
+		return nil, fmt.Errorf("integrity check failed: %s", result)
+	}
+	if result != "ok" {
+		fmt.Println("integrity check failed:", result)
+	}
+
+	now := time.Now().UnixNano()
+	failed := []dbCheck{}
+	for _, check := range dbChecks {
+		qargs := []interface{}{}
+		if strings.Contains(check.query, "?") {
+			qargs = append(qargs, now)
+		}
+
+		rows, err := db.Query(check.query, qargs...)
+		if err != nil {
+			return nil, err
+		}
+
+		found := false
+		for rows.Next() {
+			var n int
+			var what string
+			if err := rows.Scan(&n, &what); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			fmt.Printf("%s: %d in %s\n", check.name, n, what)
+			found = true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+
+		if found {
+			failed = append(failed, check)
+		}
+	}
+	return failed, nil
+}
+
+func dbVerify(db *sql.DB, args []string) error {
+	failed, err := verify(db, false)
+	if err != nil {
+		return err
+	}
+	if len(failed) != 0 {
+		return fmt.Errorf("%d checks found problems", len(failed))
+	}
+	fmt.Println("ok")
+	return nil
+}
+
+// dbRepair fixes what verify finds, in one transaction. Indexes are rebuilt
+// first, as a corrupt index fails the integrity check. With -force the
+// checks run and fix what they can even if it still fails.
+func dbRepair(db *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("db repair", flag.ExitOnError)
+	force := fs.Bool(
+		"force", false, "Repair even if the integrity check fails.",
+	)
+	fs.Parse(args)
+
+	if _, err := db.Exec("reindex"); err != nil {
+		fmt.Println("reindex failed:", err)
+	}
+
+	failed, err := verify(db, *force)
+	if err != nil {
+		return err
+	}
+	if len(failed) == 0 {
+		fmt.Println("nothing to repair")
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UnixNano()
+	for _, check := range failed {
+		qargs := []interface{}{}
+		if strings.Contains(check.fix, "?") {
+			qargs = append(qargs, now)
+		}
+
+		res, err := tx.Exec(check.fix, qargs...)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("%s: %s", check.name, err)
+		}
+		n, _ := res.RowsAffected()
+		fmt.Printf("%s: fixed %d rows\n", check.name, n)
+	}
+
+	return tx.Commit()
+}
+
+func dbVacuum(db *sql.DB, args []string) error {
+	if _, err := db.Exec("vacuum"); err != nil {
+		return err
+	}
+	fmt.Println("ok")
+	return nil
+}
@@ -0,0 +1,57 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"martd/server"
+)
+
+func TestPrefixEnd(t *testing.T) {
+	for prefix, want := range map[string]string{
+		"":         "",
+		"a":        "b",
+		"ä":        "\xc3\xa5",
+		"a\xff":    "b",
+		"\xff\xff": "",
+	} {
+		if got := prefixEnd(prefix); got != want {
+			t.Errorf("prefixEnd(%q) = %q, want %q", prefix, got, want)
+		}
+	}
+}
+
+func TestDBRepair(t *testing.T) {
+	db, err := server.GetDB(filepath.Join(t.TempDir(), "p.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	now := time.Now().UnixNano()
+	_, err = db.Exec(
+		`insert into channels(name, size, life, one2one, key, created)
+		values ('a', 10, 1, 0, '', ?);
+		insert into payloads(id, channel, expiry, payload)
+		values (?, 'a', ?, 'old'), (?, 'a', ?, 'new')`,
+		now, now-2, now-1, now, now+int64(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failed, err := verify(db, false)
+	if err != nil || len(failed) != 1 {
+		t.Fatalf("verify found %v: %v", failed, err)
+	}
+	if err := dbRepair(db, []string{"-force"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbVerify(db, nil); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+
+	"martd/server"
+)
+
+func init() {
+	Commands["export"] = ExportMain
+	Commands["import"] = ImportMain
+}
+
+// ExportMain implements "martd export [file]", file defaults to stdout.
+func ExportMain(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	fs.Parse(args)
+
+	out := os.Stdout
+	if fs.NArg() > 0 && fs.Arg(0) != "-" {
+		f, err := os.Create(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	store, err := server.OpenStorage(&opts)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	w := bufio.NewWriter(out)
+	nChans, nMsgs, err := server.Export(store, w)
+	if err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d channels, %d messages.\n", nChans, nMsgs)
+	return nil
+}
+
+// ImportMain implements "martd import [-replace] [file]", file defaults to
+// stdin. It should be run while the server is stopped.
+func ImportMain(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	replace := fs.Bool(
+		"replace", false,
+		"Delete everything in storage first, instead of merging.",
+	)
+	fs.Parse(args)
+
+	in := os.Stdin
+	if fs.NArg() > 0 && fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	store, err := server.OpenStorage(&opts)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	nChans, nMsgs, err := server.Import(store, in, *replace, opts.PersistBatch)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Imported %d channels, %d messages.\n", nChans, nMsgs)
+	return nil
+}
@@ -1,14 +1,23 @@
 package main
 
 import (
+	"context"
+	"expvar"
 	"flag"
 	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
 	"runtime"
+	"strings"
+	"syscall"
 	"time"
-)
 
-//go:generate esc -o static.go index.html client.js
-//esc: http://godoc.org/github.com/mjibson/esc
+	"github.com/amitu/gutils"
+
+	"martd/server"
+)
 
 func DebugRoutine() {
 	for {
@@ -17,13 +26,272 @@ func DebugRoutine() {
 	}
 }
 
+var (
+	opts        = server.Defaults
+	HostPort    string
+	MigrateOnly bool
+
+	// Commands are run instead of the server, as "martd [flags] name args".
+	Commands = map[string]func(args []string) error{}
+)
+
+type prefixList []string
+
+func (p *prefixList) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *prefixList) Set(v string) error {
+	for _, prefix := range strings.Split(v, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			*p = append(*p, prefix)
+		}
+	}
+	return nil
+}
+
+func init() {
+	flag.StringVar(&HostPort, "http", ":54321", "HTTP Host:Port")
+	flag.StringVar(
+		&opts.Origin, "origin", "",
+		"Access-Control-Allow-Origin (use * for debugging).",
+	)
+	flag.BoolVar(&opts.Debug, "debug", false, "Debug.")
+	flag.BoolVar(
+		&MigrateOnly, "migrate-only", false,
+		"Upgrade the storage schema and exit.",
+	)
+
+	flag.StringVar(
+		&opts.Persist, "persist", opts.Persist,
+		"Persist file, or directory for the log storage.",
+	)
+	flag.IntVar(
+		&opts.PersistRetries, "persist-retries", opts.PersistRetries,
+		"Times to retry opening storage on start.",
+	)
+	flag.IntVar(
+		&opts.PersistBacklog, "persist-backlog", opts.PersistBacklog,
+		"Max storage operations kept for retry while storage is failing.",
+	)
+	flag.IntVar(
+		&opts.PersistBatch, "persist-batch", opts.PersistBatch,
+		"Max storage operations committed together.",
+	)
+	flag.DurationVar(
+		&opts.PersistInterval, "persist-interval", opts.PersistInterval,
+		"Time to wait for more operations before committing a batch.",
+	)
+	flag.StringVar(
+		&opts.Storage, "storage", opts.Storage,
+		"Storage backend: sqlite, log or memory.",
+	)
+	flag.Int64Var(
+		&opts.LogSegmentSize, "log-segment-size", opts.LogSegmentSize,
+		"Bytes after which the log storage starts a new segment file.",
+	)
+	flag.DurationVar(
+		&opts.LogCompactInterval, "log-compact-interval",
+		opts.LogCompactInterval,
+		"How often the log storage compacts its segments.",
+	)
+	flag.DurationVar(
+		&opts.UnloadAfter, "unload-after", opts.UnloadAfter,
+		"Drop messages of channels unused this long from memory (0: never).",
+	)
+
+	flag.StringVar(
+		&opts.AdminKey, "admin-key", "",
+		"Bearer token for /admin/ endpoints, admin API is off if empty.",
+	)
+	flag.Var(
+		(*prefixList)(&opts.MetricsChannels), "metrics-channels",
+		"Comma separated channel prefixes to export per channel metrics "+
+			"and expvar stats for.",
+	)
+
+	flag.Var(
+		(*prefixList)(&opts.Peers), "peers",
+		"Comma separated base URLs of the other cluster nodes, "+
+			"like http://10.0.0.2:54321, publishes, new channels, "+
+			"deletes and purges are forwarded to them.",
+	)
+	flag.StringVar(
+		&opts.ClusterKey, "cluster-key", "",
+		"Bearer token the cluster nodes use with each other, required "+
+			"with -peers.",
+	)
+	flag.DurationVar(
+		&opts.PeerHeartbeat, "peer-heartbeat", opts.PeerHeartbeat,
+		"How often idle peers are checked.",
+	)
+	flag.StringVar(
+		&opts.Follow, "follow", "",
+		"Base URL of a leader to replicate, needs -cluster-key.",
+	)
+	flag.IntVar(
+		&opts.ReplBacklog, "repl-backlog", opts.ReplBacklog,
+		"Operations kept for followers that fall behind, older ones need "+
+			"a snapshot.",
+	)
+	flag.Var(
+		(*prefixList)(&opts.Shards), "shards",
+		"Comma separated base URLs of all nodes channels are sharded "+
+			"between, this one included.",
+	)
+	flag.StringVar(
+		&opts.ShardSelf, "shard-self", "",
+		"Base URL of this node, as it is in -shards.",
+	)
+	flag.IntVar(
+		&opts.ShardVNodes, "shard-vnodes", opts.ShardVNodes,
+		"Points per node on the hash ring, all nodes must agree.",
+	)
+	flag.BoolVar(
+		&opts.ShardRedirect, "shard-redirect", false,
+		"Redirect requests for channels of other nodes, instead of proxying.",
+	)
+
+	flag.StringVar(
+		&opts.RedisAddr, "redis", "",
+		"Host:Port for a Redis protocol PUBLISH/SUBSCRIBE listener, like :6379.",
+	)
+	flag.StringVar(
+		&opts.RedisPassword, "redis-password", "",
+		"Password Redis clients must AUTH with.",
+	)
+	flag.StringVar(
+		&opts.MQTTAddr, "mqtt", "",
+		"Host:Port for an MQTT 3.1.1 listener, like :1883.",
+	)
+	flag.StringVar(
+		&opts.MQTTWSAddr, "mqtt-ws", "",
+		"Host:Port for MQTT over WebSocket, at path /mqtt, like :8083.",
+	)
+	flag.StringVar(
+		&opts.GRPCAddr, "grpc", "",
+		"Host:Port for the gRPC API, plain text HTTP/2, like :54322.",
+	)
+
+	flag.Var(
+		(*prefixList)(&opts.Webhooks), "webhook",
+		"Comma separated URLs to POST channel events to.",
+	)
+	flag.StringVar(
+		&opts.WebhookSecret, "webhook-secret", "",
+		"Key to sign webhook bodies with, HMAC-SHA256 in "+
+			"X-Martd-Signature.",
+	)
+	flag.BoolVar(
+		&opts.WebhookPublish, "webhook-publish", false,
+		"Also send an event for every message published.",
+	)
+	flag.DurationVar(
+		&opts.WebhookIdle, "webhook-idle", opts.WebhookIdle,
+		"How long a channel must be without subscribers to be vacated, "+
+			"long poll clients reconnect between messages.",
+	)
+	flag.IntVar(
+		&opts.WebhookRetries, "webhook-retries", opts.WebhookRetries,
+		"Times a failed webhook delivery is retried before it is dropped.",
+	)
+
+	flag.StringVar(
+		&opts.AuthURL, "auth-url", "",
+		"URL of a backend that allows or denies subscriptions.",
+	)
+	flag.Var(
+		(*prefixList)(&opts.AuthHeaders), "auth-headers",
+		"Comma separated request headers to pass on to -auth-url, cookies "+
+			"are always passed.",
+	)
+	flag.DurationVar(
+		&opts.AuthTTL, "auth-ttl", opts.AuthTTL,
+		"How long a decision of -auth-url is kept for a cid, its cookies "+
+			"and headers, and channel.",
+	)
+	flag.DurationVar(
+		&opts.AuthTimeout, "auth-timeout", opts.AuthTimeout,
+		"How long to wait for -auth-url.",
+	)
+}
+
 func main() {
 	flag.Parse()
-	ReadChannels()
 
-	go Persister()
-	if Debug {
+	if _, ok := server.Storages[opts.Storage]; !ok {
+		log.Fatalln("Unknown storage:", opts.Storage)
+	}
+
+	if flag.NArg() != 0 {
+		command, ok := Commands[flag.Arg(0)]
+		if !ok {
+			log.Fatalln("Unknown command:", flag.Arg(0))
+		}
+		if err := command(flag.Args()[1:]); err != nil {
+			log.Fatalln(flag.Arg(0), "failed:", err)
+		}
+		return
+	}
+
+	if MigrateOnly {
+		store, err := server.OpenStorage(&opts)
+		if err != nil {
+			log.Fatalln("Migration failed:", err)
+		}
+		store.Close()
+		log.Println("Storage is up to date.")
+		return
+	}
+
+	srv, err := server.New(&opts)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := srv.Start(); err != nil {
+		log.Fatalln(err)
+	}
+	if opts.Debug {
 		go DebugRoutine()
 	}
-	ServeHTTP()
+
+	srv.Vars().Do(func(kv expvar.KeyValue) {
+		expvar.Publish(kv.Key, kv.Value)
+	})
+	expvar.Publish("stats", expvar.Func(srv.Stats))
+
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.Handle("/", srv)
+
+	log.Printf("Started HTTP Server on %s.", HostPort)
+	httpServer := &http.Server{
+		Addr:    HostPort,
+		Handler: gutils.NewApacheLoggingHandler(mux, os.Stderr),
+	}
+	httpServer.RegisterOnShutdown(srv.Drain)
+	go shutdownOnSignal(srv, httpServer)
+	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	select {}
+}
+
+// shutdownOnSignal stops the server on SIGINT or SIGTERM, first taking no
+// more requests, then waiting for subscribers to be told and for storage to
+// take what was published, then exits.
+func shutdownOnSignal(srv *server.Server, httpServer *http.Server) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	log.Println("Got", <-sigs, "shutting down.")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Println("HTTP shutdown failed:", err)
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("Shutdown failed:", err)
+	}
+	os.Exit(0)
 }
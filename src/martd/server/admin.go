@@ -0,0 +1,90 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// AdminHandler wraps h so it only runs for POST requests carrying the admin
+// key as "Authorization: Bearer <key>".
+func (s *Server) AdminHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.opts.AdminKey == "" {
+			http.Error(w, "admin API is disabled", http.StatusForbidden)
+			return
+		}
+
+		if !authorized(r, s.opts.AdminKey) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if r.Method != "POST" {
+			s.reject(w, "admin endpoints only accept POST")
+			return
+		}
+
+		leader := s.Leader()
+		if leader != "" && r.URL.Path != "/admin/promote" {
+			s.reject(w, "read only follower of "+leader)
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+// authorized is true if r carries key as "Authorization: Bearer <key>", and
+// key is not empty.
+func authorized(r *http.Request, key string) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return key != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(key)) == 1
+}
+
+// AdminDeleteHandler deletes a channel, its messages and its clients.
+func (s *Server) AdminDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	channel := r.FormValue("channel")
+	if channel == "" {
+		s.reject(w, "channel is required")
+		return
+	}
+
+	if !s.DeleteChannel(channel) {
+		s.reject(w, "no such channel: "+channel)
+		return
+	}
+
+	s.respondJSON(w, map[string]string{"deleted": channel})
+}
+
+// AdminPurgeHandler drops the messages of a channel, all of them or, if
+// before (an etag) is given, the ones older than that.
+func (s *Server) AdminPurgeHandler(w http.ResponseWriter, r *http.Request) {
+	channel := r.FormValue("channel")
+	if channel == "" {
+		s.reject(w, "channel is required")
+		return
+	}
+
+	before := int64(0)
+	if v := r.FormValue("before"); v != "" {
+		_, err := fmt.Sscan(v, &before)
+		if err != nil || before <= 0 {
+			s.reject(w, "invalid before")
+			return
+		}
+	}
+
+	ch := s.LookupChannel(channel)
+	if ch == nil {
+		s.reject(w, "no such channel: "+channel)
+		return
+	}
+
+	s.respondJSON(w, map[string]interface{}{
+		"channel": channel, "purged": ch.PurgeBefore(before),
+	})
+}
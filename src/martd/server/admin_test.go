@@ -0,0 +1,123 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// adminPost has s serve an admin POST of form to path with key, and returns
+// the recorded response.
+func adminPost(
+	s *Server, path, key string, form url.Values,
+) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if key != "" {
+		r.Header.Set("Authorization", "Bearer "+key)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestAdminAuth(t *testing.T) {
+	form := url.Values{"channel": {"c"}}
+	off := newTestServer(t, nil)
+	w := adminPost(off, "/admin/purge", "", form)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("without an admin key: %d", w.Code)
+	}
+
+	s := newTestServer(t, func(o *Options) { o.AdminKey = "adm" })
+	w = adminPost(s, "/admin/purge", "bad", form)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong key: %d", w.Code)
+	}
+	r := httptest.NewRequest("GET", "/admin/purge?channel=c", nil)
+	r.Header.Set("Authorization", "Bearer adm")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("GET: %d", w.Code)
+	}
+}
+
+func TestAdminPurge(t *testing.T) {
+	s := newTestServer(t, func(o *Options) { o.AdminKey = "adm" })
+	def := &ChannelDef{Name: "c", Size: 10, Life: time.Hour}
+	ch := testChannel(t, s, def, 4)
+	msgs, _, _ := ch.History(0, 0, 10)
+
+	before := fmt.Sprint(msgs[2].Created)
+	w := adminPost(s, "/admin/purge", "adm", url.Values{
+		"channel": {"c"}, "before": {before},
+	})
+	resp := map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusOK || resp["purged"] != 2.0 {
+		t.Fatalf("purge before: %d %s", w.Code, w.Body)
+	}
+	if got := historyData(t, ch); got != "34" {
+		t.Fatalf("left %q", got)
+	}
+
+	adminPost(s, "/admin/purge", "adm", url.Values{"channel": {"c"}})
+	if got := historyData(t, ch); got != "" {
+		t.Fatalf("left %q after purging all", got)
+	}
+	eventually(t, "the purge in storage", func() bool {
+		stored, err := s.storage().LoadMessages("c", 10)
+		return err == nil && len(stored) == 0
+	})
+
+	w = adminPost(s, "/admin/purge", "adm", url.Values{"channel": {"none"}})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("unknown channel: %d", w.Code)
+	}
+}
+
+func TestAdminDelete(t *testing.T) {
+	s := newTestServer(t, func(o *Options) { o.AdminKey = "adm" })
+	def := &ChannelDef{Name: "c", Size: 10, Life: time.Hour, Key: "k"}
+	ch := testChannel(t, s, def, 2)
+	evch := make(chan *ChannelEvent, 1)
+	ch.Sub(evch)
+
+	w := adminPost(s, "/admin/delete", "adm", url.Values{"channel": {"c"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("delete: %d %s", w.Code, w.Body)
+	}
+	if s.LookupChannel("c") != nil {
+		t.Fatal("channel not deleted")
+	}
+	select {
+	case ev := <-evch:
+		if ev.Mesg != nil {
+			t.Fatalf("client got %s", ev.Mesg.Data)
+		}
+	default:
+		t.Fatal("client not dropped")
+	}
+	eventually(t, "the delete in storage", func() bool {
+		stored, err := s.storage().LoadMessages("c", 10)
+		return err == nil && len(stored) == 0
+	})
+
+	// the key went with it
+	if _, err := s.Publish(
+		&ChannelDef{Name: "c", Size: 10, Life: time.Hour}, []byte("x"), true,
+	); err != nil {
+		t.Fatal("channel recreated without its old key:", err)
+	}
+
+	w = adminPost(s, "/admin/delete", "adm", url.Values{"channel": {"none"}})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("unknown channel: %d", w.Code)
+	}
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// authKey is what a decision is cached for. credentials is a hash of the
+// cookies and AuthHeaders sent to the backend, so a cid with other cookies
+// is asked about again.
+type authKey struct {
+	protocol, session, credentials, channel string
+}
+
+type authDecision struct {
+	allowed bool
+	expires time.Time
+}
+
+// Subscriber is a client asking to subscribe, as the AuthURL backend is
+// told about it.
+type Subscriber struct {
+	// Protocol is how the client is connected: http, grpc, redis or mqtt.
+	Protocol string
+	// Cid is the cid of HTTP and gRPC clients, the client id of MQTT ones.
+	Cid    string
+	Remote string
+	// Header has the cookies and AuthHeaders passed on to the backend, of
+	// the request, or of the WebSocket upgrade for MQTT over WebSocket.
+	Header http.Header
+	// Session is what decisions are cached for: the cid over HTTP and gRPC,
+	// the connection over Redis and MQTT. Without one the backend is asked
+	// every time.
+	Session string
+}
+
+// httpSubscriber is the Subscriber of a /sub, /history or gRPC request, the
+// cid of gRPC requests is sent as cid metadata.
+func httpSubscriber(protocol string, r *http.Request) *Subscriber {
+	cid := r.FormValue("cid")
+	if protocol == "grpc" {
+		cid = r.Header.Get("cid")
+	}
+	return &Subscriber{
+		Protocol: protocol, Cid: cid, Remote: r.RemoteAddr, Header: r.Header,
+		Session: cid,
+	}
+}
+
+// connSubscriber is the Subscriber of a Redis or MQTT connection, whose
+// decisions are cached for the connection alone.
+func (s *Server) connSubscriber(protocol, remote string) *Subscriber {
+	n := atomic.AddInt64(&s.connSeq, 1)
+	return &Subscriber{
+		Protocol: protocol, Remote: remote,
+		Session: "conn-" + strconv.FormatInt(n, 10),
+	}
+}
+
+// AuthRequest is what the AuthURL backend is POSTed, along with the
+// cookies and -auth-headers of the subscriber.
+type AuthRequest struct {
+	Cid      string   `json:"cid"`
+	Channels []string `json:"channels"`
+	Remote   string   `json:"remote"`
+	Protocol string   `json:"protocol"`
+}
+
+// AuthResponse is the optional body of a 2xx response from the backend,
+// deciding channel by channel. Channels not in it, or all of them without
+// it, are allowed. A 401 or 403 response denies all of them.
+type AuthResponse struct {
+	Channels map[string]bool `json:"channels"`
+}
+
+// startAuth starts dropping expired decisions, if AuthURL is set.
+func (s *Server) startAuth() error {
+	if s.opts.AuthURL == "" {
+		return nil
+	}
+
+	s.authClient = &http.Client{Timeout: s.opts.AuthTimeout}
+	s.goRun(func() {
+		for s.sleep(s.opts.AuthTTL) {
+			now := time.Now()
+			s.authLock.Lock()
+			for k, d := range s.authCache {
+				if now.After(d.expires) {
+					delete(s.authCache, k)
+				}
+			}
+			s.authLock.Unlock()
+		}
+	})
+	log.Println("Asking", s.opts.AuthURL, "about subscriptions")
+	return nil
+}
+
+// Authorize returns the channels sub may not subscribe to, asking the
+// backend about those without a cached decision. Every protocol subscribers
+// use asks it. Decisions are only cached for subscribers with a Session, as
+// without one they can not be told apart.
+func (s *Server) Authorize(
+	sub *Subscriber, channels []string,
+) ([]string, error) {
+	if s.opts.AuthURL == "" {
+		return nil, nil
+	}
+
+	session, credentials := sub.Session, s.credentials(sub)
+	denied, ask := []string{}, []string{}
+	now := time.Now()
+	s.authLock.Lock()
+	for _, name := range channels {
+		key := authKey{sub.Protocol, session, credentials, name}
+		d, ok := s.authCache[key]
+		switch {
+		case session == "" || !ok || now.After(d.expires):
+			ask = append(ask, name)
+		case !d.allowed:
+			denied = append(denied, name)
+		}
+	}
+	s.authLock.Unlock()
+
+	if len(ask) == 0 {
+		return denied, nil
+	}
+
+	decisions, err := s.askBackend(sub, ask)
+	if err != nil {
+		return nil, err
+	}
+
+	expires := time.Now().Add(s.opts.AuthTTL)
+	s.authLock.Lock()
+	for _, name := range ask {
+		if !decisions[name] {
+			denied = append(denied, name)
+		}
+		if session != "" {
+			key := authKey{sub.Protocol, session, credentials, name}
+			s.authCache[key] = &authDecision{decisions[name], expires}
+		}
+	}
+	s.authLock.Unlock()
+
+	sort.Strings(denied)
+	return denied, nil
+}
+
+// credentials returns a hash of what askBackend passes on of sub's headers.
+func (s *Server) credentials(sub *Subscriber) string {
+	h := sha256.New()
+	for _, v := range sub.Header["Cookie"] {
+		fmt.Fprintf(h, "cookie %q\n", v)
+	}
+	for _, name := range s.opts.AuthHeaders {
+		for _, v := range sub.Header[http.CanonicalHeaderKey(name)] {
+			fmt.Fprintf(h, "%q %q\n", name, v)
+		}
+	}
+	return string(h.Sum(nil))
+}
+
+// allowed is true if sub may get messages of the named channel, for checking
+// the channels matched by patterns as messages arrive. A failing backend
+// denies.
+func (s *Server) allowed(sub *Subscriber, name string) bool {
+	denied, err := s.Authorize(sub, []string{name})
+	if err != nil {
+		log.Println("Auth backend failed:", err)
+		return false
+	}
+	return len(denied) == 0
+}
+
+func (s *Server) askBackend(
+	sub *Subscriber, channels []string,
+) (map[string]bool, error) {
+	body, err := json.Marshal(&AuthRequest{
+		sub.Cid, channels, sub.Remote, sub.Protocol,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", s.opts.AuthURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for _, v := range sub.Header["Cookie"] {
+		req.Header.Add("Cookie", v)
+	}
+	for _, name := range s.opts.AuthHeaders {
+		for _, v := range sub.Header[http.CanonicalHeaderKey(name)] {
+			req.Header.Add(name, v)
+		}
+	}
+
+	resp, err := s.authClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	msg, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	decisions := make(map[string]bool, len(channels))
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized,
+		resp.StatusCode == http.StatusForbidden:
+		for _, name := range channels {
+			decisions[name] = false
+		}
+	case resp.StatusCode/100 == 2:
+		ar := &AuthResponse{}
+		if len(bytes.TrimSpace(msg)) != 0 {
+			if err := json.Unmarshal(msg, ar); err != nil {
+				return nil, fmt.Errorf("invalid response: %s", err)
+			}
+		}
+		for _, name := range channels {
+			allowed, ok := ar.Channels[name]
+			decisions[name] = allowed || !ok
+		}
+	default:
+		return nil, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return decisions, nil
+}
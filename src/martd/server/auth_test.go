@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// authBackend allows subscribers with the cookie session=good, and counts
+// the requests it gets.
+func authBackend(t *testing.T) (*httptest.Server, *int32) {
+	asked := new(int32)
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(asked, 1)
+			if c, err := r.Cookie("session"); err != nil || c.Value != "good" {
+				w.WriteHeader(http.StatusForbidden)
+			}
+		},
+	))
+	t.Cleanup(backend.Close)
+	return backend, asked
+}
+
+func TestAuthCache(t *testing.T) {
+	backend, asked := authBackend(t)
+	s := newTestServer(t, func(o *Options) {
+		o.AuthURL = backend.URL
+		o.AuthHeaders = []string{"X-Token"}
+	})
+
+	sub := func(cookie, token string) *Subscriber {
+		return &Subscriber{
+			Protocol: "http", Cid: "c1", Session: "c1",
+			Header: http.Header{
+				"Cookie": {"session=" + cookie}, "X-Token": {token},
+			},
+		}
+	}
+	check := func(sub *Subscriber, allowed bool, wantAsked int32) {
+		t.Helper()
+		denied, err := s.Authorize(sub, []string{"a"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (len(denied) == 0) != allowed {
+			t.Fatalf("denied %v, want allowed %v", denied, allowed)
+		}
+		if n := atomic.LoadInt32(asked); n != wantAsked {
+			t.Fatalf("backend asked %d times, want %d", n, wantAsked)
+		}
+	}
+
+	check(sub("good", "1"), true, 1)
+	check(sub("good", "1"), true, 1) // cached
+	// the same cid with other cookies or headers is not let in by the cache
+	check(sub("bad", "1"), false, 2)
+	check(sub("good", "2"), true, 3)
+	check(sub("bad", "1"), false, 3)
+}
@@ -0,0 +1,1028 @@
+package server
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"log"
+	"math"
+	"fmt"
+	"github.com/amitu/gutils"
+)
+
+type Message struct {
+	Data    []byte
+	Created int64 // created time acts as the etag
+}
+
+type Channel struct {
+	s        *Server
+	Name     string                      `json:"name"`
+	Size     uint                        `json:"size"`
+	Life     time.Duration               `json:"life"`
+	Key      string                      `json:"key,omitempty"`
+	Clients  map[chan *ChannelEvent]bool `json:"-"`
+	Messages *CircularMessageArray       `json:"-"`
+	One2One  bool                        `json:"one2one"`
+	Created  int64                       `json:"created"`
+	lock     sync.RWMutex                `json:"-"`
+
+	// with either set, the channel spills: only Size messages are kept in
+	// memory, and up to HistoryCount messages or HistoryBytes in storage
+	HistoryCount uint  `json:"history,omitempty"`
+	HistoryBytes int64 `json:"history_bytes,omitempty"`
+
+	inited bool
+
+	// loaded is false till Messages are fetched from storage, see load
+	loaded   bool
+	lastUsed time.Time
+	// counted is what storage has while not loaded, nil till counted, see
+	// storedCount; countedGen changes when it is dropped
+	counted    *storedCount
+	countedGen int
+	// newest is the newest message in storage while not loaded, if
+	// newestRead, see Newest
+	newest     *Message
+	newestRead bool
+	pending    int32 // storage operations queued, accessed atomically
+
+	// counters, guarded by lock
+	nPublished, nDelivered, nExpired, nDropped int64
+	nBytesIn                                   int64
+	peakClients                                int
+	lastPub                                    time.Time
+
+	// occupancy, for webhooks, guarded by lock
+	occupied       bool
+	vacating       bool // a check for vacated is due, see occupancy
+	lastSubscribed time.Time
+}
+
+// ChannelDef holds the attributes of a channel, as stored.
+type ChannelDef struct {
+	Name    string        `json:"name"`
+	Size    uint          `json:"size"`
+	Life    time.Duration `json:"life"`
+	One2One bool          `json:"one2one"`
+	Key     string        `json:"key,omitempty"`
+	Created int64         `json:"created"`
+
+	History      uint  `json:"history,omitempty"`
+	HistoryBytes int64 `json:"history_bytes,omitempty"`
+}
+
+// Spills is true if older messages are kept in storage only, see Channel.
+func (def *ChannelDef) Spills() bool {
+	return def.History != 0 || def.HistoryBytes != 0
+}
+
+// ChannelInfo is the public view of a channel, it never includes the key.
+type ChannelInfo struct {
+	Name        string        `json:"name"`
+	Size        uint          `json:"size"`
+	Life        time.Duration `json:"life"`
+	One2One     bool          `json:"one2one"`
+	HasKey      bool          `json:"has_key"`
+	Created     int64         `json:"created,omitempty"`
+	Messages    uint          `json:"messages"`
+	Bytes       int           `json:"bytes"`
+	Oldest      string        `json:"oldest,omitempty"`
+	Newest      string        `json:"newest,omitempty"`
+	Subscribers int           `json:"subscribers"`
+	Loaded      bool          `json:"loaded"` // else Oldest, Newest are empty
+
+	History      uint  `json:"history,omitempty"`
+	HistoryBytes int64 `json:"history_bytes,omitempty"`
+}
+
+// ChannelStats are the counters kept for a channel since it was created.
+type ChannelStats struct {
+	Published       int64      `json:"published"`
+	Delivered       int64      `json:"delivered"`
+	BytesIn         int64      `json:"bytes_in"`
+	Expired         int64      `json:"expired"`
+	Dropped         int64      `json:"dropped"` // evicted from full buffer
+	PeakSubscribers int        `json:"peak_subscribers"`
+	LastPublish     *time.Time `json:"last_publish,omitempty"`
+}
+
+type ChannelEvent struct {
+	Chan *Channel
+	Mesg *Message
+}
+
+type watcher struct {
+	match  func(name string) bool
+	events chan *ChannelEvent
+}
+
+// Watch sends every message published on this node to a channel for which
+// match returns true to events, till the returned function is called. Unlike
+// Clients, a watcher stays after a message. match is called with the channel
+// locked, and a message is dropped if events is full.
+func (s *Server) Watch(
+	match func(name string) bool, events chan *ChannelEvent,
+) func() {
+	w := &watcher{match, events}
+
+	s.watchLock.Lock()
+	s.watchers[w] = true
+	s.watchLock.Unlock()
+
+	return func() {
+		s.watchLock.Lock()
+		delete(s.watchers, w)
+		s.watchLock.Unlock()
+	}
+}
+
+// Watching returns how many watchers match the named channel.
+func (s *Server) Watching(name string) int {
+	s.watchLock.RLock()
+	defer s.watchLock.RUnlock()
+
+	n := 0
+	for w := range s.watchers {
+		if w.match(name) {
+			n++
+		}
+	}
+	return n
+}
+
+// notifyWatchers sends m to the watchers of c, the caller holds c.lock.
+func (s *Server) notifyWatchers(c *Channel, m *Message) int {
+	s.watchLock.RLock()
+	defer s.watchLock.RUnlock()
+
+	n := 0
+	for w := range s.watchers {
+		if !w.match(c.Name) {
+			continue
+		}
+		select {
+		case w.events <- &ChannelEvent{c, m}:
+			n++
+		default:
+			s.nWatchDropped.Add(1)
+		}
+	}
+	return n
+}
+
+var ETag0 = []byte("{\"etag\": \"0\"}")
+
+// SpillPage is the most messages of a spilling channel a subscriber gets
+// from storage in one response.
+const SpillPage = 100
+
+// periodicUnload unloads idle channels, started if UnloadAfter is set.
+func (s *Server) periodicUnload() {
+	for s.sleep(s.opts.UnloadAfter / 10) {
+		cutoff := time.Now().Add(-s.opts.UnloadAfter)
+		for _, ch := range s.ListChannels("") {
+			ch.Unload(cutoff)
+		}
+	}
+}
+
+// periodicExpireMessages expires messages in memory, of the channels the
+// persister found expired messages of, and has it look for more.
+func (s *Server) periodicExpireMessages() {
+	for s.sleep(time.Second) {
+		s.expireInMemory()
+		s.expireMessages()
+	}
+}
+
+// GetOrCreateChannel returns the named channel, creating it with the
+// attributes in def if it does not exist yet, and as created now unless
+// def.Created is set. A channel created is defined on the peers too.
+func (s *Server) GetOrCreateChannel(def *ChannelDef) (*Channel, error) {
+	ch, created := s.getOrCreate(def)
+	if created {
+		s.forwardOp("define", ch.Def(), 0)
+	}
+	return ch, nil
+}
+
+// getOrCreate is GetOrCreateChannel without forwarding, for operations from
+// peers and the leader. It returns true if the channel was created.
+func (s *Server) getOrCreate(def *ChannelDef) (*Channel, bool) {
+	s.chanLock.Lock()
+
+	ch := s.getChannel(def.Name)
+
+	created := !ch.inited
+	if created {
+		if def.Created == 0 {
+			def.Created = time.Now().UnixNano()
+		}
+		ch.init(def)
+	}
+
+	s.chanLock.Unlock()
+
+	// outside chanLock, the persister may need it to make progress
+	if created {
+		s.defineChannel(ch)
+		s.notify(ch, "created", nil)
+		s.watchNames([]string{def.Name}, false)
+	}
+
+	return ch, created
+}
+
+// LoadChannel creates a channel from its stored definition, without
+// persisting it again. Its messages are only loaded when it is used.
+func (s *Server) LoadChannel(def *ChannelDef) *Channel {
+	s.chanLock.Lock()
+	defer s.chanLock.Unlock()
+
+	ch := s.getChannel(def.Name)
+	if !ch.inited {
+		ch.init(def)
+		ch.loaded = false
+	}
+	return ch
+}
+
+// load fetches the messages of the channel from storage, if that has not been
+// done yet. The caller holds lock. If storage fails, the error is returned
+// and the channel carries on with what it has in memory, it is loaded on its
+// next use, keeping what was published meanwhile.
+func (c *Channel) load() error {
+	c.lastUsed = time.Now()
+	if c.loaded || !c.inited {
+		return nil
+	}
+
+	store := c.s.storage()
+	if store == nil {
+		log.Println("Storage unavailable, not loading", c.Name)
+		return ErrPersistDegraded
+	}
+
+	msgs, err := store.LoadMessages(c.Name, int(c.Size))
+	if err != nil {
+		log.Println("Could not load", c.Name, err)
+		return err
+	}
+	for _, m := range msgs {
+		c.push(m)
+	}
+	c.loaded, c.counted = true, nil
+	c.newest, c.newestRead = nil, false
+	c.s.nLoads.Add(1)
+	return nil
+}
+
+// storedCount is what storage has of an unloaded channel.
+type storedCount struct {
+	messages, bytes int
+}
+
+// storedCount returns what storage has of the channel, or nil if it is
+// loaded or storage fails. It is counted once, and again after messages
+// expire.
+func (c *Channel) storedCount() *storedCount {
+	c.lock.RLock()
+	loaded, stored, gen := c.loaded || !c.inited, c.counted, c.countedGen
+	c.lock.RUnlock()
+	if loaded || stored != nil {
+		return stored
+	}
+
+	store := c.s.storage()
+	if store == nil {
+		return nil
+	}
+	n, bytes, err := store.Count(c.Name, int(c.Size))
+	if err != nil {
+		log.Println("Could not count", c.Name, err)
+		return nil
+	}
+
+	stored = &storedCount{n, bytes}
+	c.lock.Lock()
+	if !c.loaded && c.countedGen == gen {
+		c.counted = stored
+	}
+	c.lock.Unlock()
+	return stored
+}
+
+// Unload drops the messages of the channel from memory, if it has not been
+// used since cutoff, has no clients, and all its writes are in storage.
+func (c *Channel) Unload(cutoff time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.loaded || !c.inited || c.lastUsed.After(cutoff) ||
+		len(c.Clients) != 0 || atomic.LoadInt32(&c.pending) != 0 {
+		return false
+	}
+
+	c.counted = &storedCount{int(c.Messages.Length()), c.Messages.Bytes}
+	c.newest, _ = c.Messages.PeekNewest()
+	c.newestRead = true
+	c.Messages.Empty()
+	c.loaded = false
+	c.s.nUnloads.Add(1)
+	return true
+}
+
+// init sets the attributes of a new channel, the caller holds chanLock.
+func (ch *Channel) init(def *ChannelDef) {
+	ch.inited = true
+	ch.Size = def.Size
+	ch.Life = def.Life
+	ch.One2One = def.One2One
+	ch.Key = def.Key
+	ch.Created = def.Created
+	ch.HistoryCount = def.History
+	ch.HistoryBytes = def.HistoryBytes
+	ch.Messages = ch.s.newMessages(def.Size)
+	ch.loaded = true
+}
+
+// newMessages returns an array for the messages of a channel, which counts
+// them in the nMessages and nMessageBytes gauges.
+func (s *Server) newMessages(size uint) *CircularMessageArray {
+	circ := NewCircularMessageArray(size)
+	circ.nMessages, circ.nBytes = s.nMessages, s.nMessageBytes
+	return circ
+}
+
+func (s *Server) GetChannel(name string) *Channel {
+	s.chanLock.Lock()
+	defer s.chanLock.Unlock()
+	return s.getChannel(name)
+}
+
+// LookupChannel returns the named channel, or nil if it does not exist. Unlike
+// GetChannel it never creates one.
+func (s *Server) LookupChannel(name string) *Channel {
+	s.chanLock.RLock()
+	defer s.chanLock.RUnlock()
+	return s.channels[name]
+}
+
+// ListChannels returns all channels whose name starts with prefix, sorted by
+// name.
+func (s *Server) ListChannels(prefix string) []*Channel {
+	s.chanLock.RLock()
+	defer s.chanLock.RUnlock()
+
+	chans := []*Channel{}
+	for name, ch := range s.channels {
+		if strings.HasPrefix(name, prefix) {
+			chans = append(chans, ch)
+		}
+	}
+	sort.Slice(chans, func(i, j int) bool {
+		return chans[i].Name < chans[j].Name
+	})
+	return chans
+}
+
+// DeleteChannel removes the channel, its definition and messages, from memory
+// and storage, here and on the peers. Clients waiting on it are woken up with
+// a nil message. It returns false if there was no such channel.
+func (s *Server) DeleteChannel(name string) bool {
+	ch := s.deleteChannel(name)
+	if ch == nil {
+		return false
+	}
+	s.forwardOp("delete", ch.Def(), 0)
+	return true
+}
+
+// deleteChannel is DeleteChannel without forwarding, it returns the channel
+// deleted, or nil.
+func (s *Server) deleteChannel(name string) *Channel {
+	s.chanLock.Lock()
+	ch, ok := s.channels[name]
+	if ok {
+		delete(s.channels, name)
+	}
+	s.chanLock.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	s.notify(ch, "deleted", nil)
+
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+
+	for evch := range ch.Clients {
+		// clients may be busy with another channel, don't wait for them
+		select {
+		case evch <- &ChannelEvent{ch, nil}:
+		default:
+		}
+	}
+	ch.Clients = make(map[chan *ChannelEvent]bool)
+	ch.occupied = false // no vacated after deleted
+
+	if ch.Messages != nil {
+		ch.Messages.Empty()
+	}
+	s.forgetChannel(ch)
+
+	return ch
+}
+
+// getChannel is GetChannel, the caller holds chanLock.
+func (s *Server) getChannel(name string) *Channel {
+	ch, ok := s.channels[name]
+	if !ok {
+		ch = &Channel{
+			s: s, Name: name, Clients: make(map[chan *ChannelEvent]bool),
+		}
+		s.channels[name] = ch
+
+		// TODO spawn a goroutine to delete this channel?
+	}
+	return ch
+}
+
+func (c *Channel) ExpireOldMessages(now int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.Messages == nil {
+		log.Println("Expired Called on Empty Channel:", c.Name)
+		return
+	}
+	if !c.loaded {
+		// storage dropped them, count again
+		c.counted = nil
+		c.newest, c.newestRead = nil, false
+		c.countedGen++
+		return
+	}
+
+
+	for {
+		m, err := c.Messages.PeekOldest()
+		if err != nil {
+			break
+		}
+
+		if m.Created + int64(c.Life) > now {
+			break
+		}
+
+		c.Messages.Pop()
+		c.nExpired++
+		c.s.nExpired.Add(1)
+		if c.Messages.Length() == 0 {
+			c.s.notify(c, "emptied", nil)
+		}
+	}
+}
+
+// PurgeBefore drops all messages older than the given etag, or all of them if
+// before is 0, here and on the peers, and returns the number of messages
+// dropped.
+func (c *Channel) PurgeBefore(before int64) uint {
+	n := c.purgeBefore(before)
+	c.s.forwardOp("purge", c.Def(), before)
+	return n
+}
+
+// purgeBefore is PurgeBefore without forwarding.
+func (c *Channel) purgeBefore(before int64) uint {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.load()
+
+	if c.Messages == nil {
+		return 0
+	}
+
+	if before == 0 {
+		n := c.Messages.Length()
+		c.Empty()
+		return n
+	}
+
+	n := uint(0)
+	for {
+		m, err := c.Messages.PeekOldest()
+		if err != nil || m.Created >= before {
+			break
+		}
+		c.Messages.Pop()
+		n++
+	}
+	c.s.purgeMessages(c, before)
+	if n > 0 && c.Messages.Length() == 0 {
+		c.s.notify(c, "emptied", nil)
+	}
+	return n
+}
+
+func (c *Channel) Pub(data []byte) int64 {
+	m := &Message{Data: data, Created: time.Now().UnixNano()}
+	c.pub(m, nil)
+	c.s.forward(c, m)
+	return m.Created
+}
+
+// PubSync is Pub, but waits for the message to be committed to storage.
+// If storage fails, the message is still published, and retried later.
+func (c *Channel) PubSync(data []byte) (int64, error) {
+	done := make(chan error, 1)
+	m := &Message{Data: data, Created: time.Now().UnixNano()}
+	c.pub(m, done)
+	c.s.forward(c, m)
+	return m.Created, <-done
+}
+
+// PubRemote publishes a message forwarded by a peer, keeping the etag it got
+// on the node it was published on. It returns false if the channel already
+// has the message, or it is older than all of a full channel's.
+func (c *Channel) PubRemote(data []byte, etag int64) bool {
+	return c.pub(&Message{Data: data, Created: etag}, nil)
+}
+
+// push adds m to Messages in etag order, and returns the messages that fell
+// off, and false if m was not added, the caller holds lock. Messages from
+// peers can arrive after newer local ones, one older than all of a full
+// buffer would fall off at once, so it is not added.
+func (c *Channel) push(m *Message) ([]*Message, bool) {
+	oldest, err := c.Messages.PeekOldest()
+	if err == nil && m.Created < oldest.Created &&
+		c.Messages.Length() >= c.Messages.Size {
+		return nil, false
+	}
+
+	newer := []*Message{}
+	for {
+		newest, err := c.Messages.PeekNewest()
+		if err != nil || newest.Created < m.Created {
+			break
+		}
+		if newest.Created == m.Created {
+			for i := len(newer) - 1; i >= 0; i-- {
+				c.Messages.Push(newer[i])
+			}
+			return nil, false
+		}
+		c.Messages.PopNewest()
+		newer = append(newer, newest)
+	}
+
+	evicted := []*Message{}
+	for _, next := range append([]*Message{m}, reversed(newer)...) {
+		if old, dropped := c.Messages.Push(next); dropped {
+			evicted = append(evicted, old)
+		}
+	}
+	return evicted, true
+}
+
+// reversed returns msgs in reverse order.
+func reversed(msgs []*Message) []*Message {
+	out := make([]*Message, len(msgs))
+	for i, m := range msgs {
+		out[len(msgs)-1-i] = m
+	}
+	return out
+}
+
+func (c *Channel) pub(m *Message, done chan error) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.load()
+
+	evicted, added := c.push(m)
+	if !added {
+		if done != nil {
+			done <- nil
+		}
+		return false
+	}
+	data := m.Data
+
+	c.nPublished++
+	c.nBytesIn += int64(len(data))
+	c.lastPub = time.Unix(0, m.Created)
+	c.s.nPublished.Add(1)
+	c.s.nBytesIn.Add(int64(len(data)))
+	c.nDropped += int64(len(evicted))
+	c.s.nDropped.Add(int64(len(evicted)))
+
+	c.s.persist(c, m, evicted, done)
+	if c.s.opts.WebhookPublish {
+		c.s.notify(c, "published", m)
+	}
+
+	sentToSome := false
+
+	for evch, _ := range c.Clients {
+		evch <- &ChannelEvent{c, m}
+		sentToSome = true
+		c.nDelivered++
+		c.s.nDelivered.Add(1)
+	}
+
+	// we drop this because all clients are supposed to be gone when this
+	// succeeds, not sure if this is race free: TODO
+	c.Clients = make(map[chan *ChannelEvent]bool)
+	if sentToSome {
+		c.lastSubscribed = time.Now() // they will be back
+		c.occupancy(c.lastSubscribed)
+	}
+
+	watched := c.s.notifyWatchers(c, m)
+	c.nDelivered += int64(watched)
+	c.s.nDelivered.Add(int64(watched))
+
+	if sentToSome && c.One2One {
+		c.Empty()
+	}
+
+	return true
+}
+
+func (c *Channel) HasNew(etag int64) (bool, uint, error) {
+	/*
+		etag semantics: if someone has passed etag != 0, means they have some
+		old data, and want everything since then. we may have lost some data
+		by then, but we should not lose anything more.
+	*/
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.load(); err != nil {
+		return false, 0, err
+	}
+	if c.Messages != nil && c.Messages.Length() > 0 {
+		oldest, _ := c.Messages.PeekOldest() // TODO, handle error?
+		if oldest.Created > etag {
+			return true, 0, nil // oldest
+		}
+
+		ml := c.Messages.Length()
+
+		// find the first message in the channel with .Created == etag.
+		for i := uint(0); i < ml-1; i++ {
+			ith, _ := c.Messages.Ith(i)
+			if etag == ith.Created {
+				return true, i + 1, nil
+			}
+		}
+	}
+	return false, 0, nil
+}
+
+// History returns up to limit of the newest retained messages with
+// since < etag < until, oldest first. until == 0 means no upper bound. The
+// second return value is true if older messages in the range were left out,
+// in which case the caller can page backwards by passing the etag of the
+// first returned message as until. A spilling channel reads what is older
+// than the messages in memory from storage, newest first, without holding
+// lock.
+func (c *Channel) History(
+	since, until int64, limit uint,
+) ([]*Message, bool, error) {
+	c.lock.Lock()
+
+	if err := c.load(); err != nil {
+		c.lock.Unlock()
+		return nil, false, err
+	}
+
+	msgs := []*Message{}
+	if c.Messages == nil {
+		c.lock.Unlock()
+		return msgs, false, nil
+	}
+
+	more, done := false, false
+	before := until
+	for i := c.Messages.Length(); i > 0; i-- {
+		ith, _ := c.Messages.Ith(i - 1)
+		if until != 0 && ith.Created >= until {
+			continue
+		}
+		if ith.Created <= since {
+			done = true
+			break
+		}
+		if uint(len(msgs)) == limit {
+			more = true
+			break
+		}
+		msgs = append(msgs, ith)
+		before = ith.Created
+	}
+
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+
+	spills := c.HistoryCount != 0 || c.HistoryBytes != 0
+	if oldest, err := c.Messages.PeekOldest(); err == nil &&
+		(before == 0 || oldest.Created < before) {
+		before = oldest.Created
+	}
+	c.lock.Unlock()
+
+	// what is evicted meanwhile is newer than before, so not read twice
+	if spills && !done && !more && uint(len(msgs)) < limit {
+		var stored []*Message
+		stored, more = c.stored(since, before, int(limit)-len(msgs))
+		msgs = append(stored, msgs...)
+	}
+	return msgs, more, nil
+}
+
+// stored returns up to limit of the newest stored messages of a spilling
+// channel with since < etag < before (before == 0 means no upper bound),
+// oldest first, and whether older ones were left out.
+func (c *Channel) stored(since, before int64, limit int) ([]*Message, bool) {
+	store := c.s.storage()
+	if store == nil {
+		return nil, false
+	}
+	if before == 0 {
+		before = math.MaxInt64
+	}
+
+	msgs, err := store.LoadBefore(c.Name, since, before, limit+1)
+	if err != nil {
+		log.Println("Could not page in", c.Name, err)
+		return nil, false
+	}
+	c.s.nPageIns.Add(1)
+
+	if len(msgs) > limit {
+		return msgs[len(msgs)-limit:], true
+	}
+	return msgs, false
+}
+
+// Newest returns the newest message of the channel, or nil. An unloaded
+// channel is not loaded for it, the message is kept from when it was
+// unloaded, or read from storage once.
+func (c *Channel) Newest() *Message {
+	c.lock.RLock()
+	if !c.inited {
+		c.lock.RUnlock()
+		return nil
+	}
+	if c.loaded && c.Messages != nil {
+		m, _ := c.Messages.PeekNewest()
+		c.lock.RUnlock()
+		return m
+	}
+	newest, read, gen := c.newest, c.newestRead, c.countedGen
+	c.lock.RUnlock()
+	if read {
+		return newest
+	}
+
+	store := c.s.storage()
+	if store == nil {
+		return nil
+	}
+	msgs, err := store.LoadMessages(c.Name, 1)
+	if err != nil {
+		log.Println("Could not read", c.Name, err)
+		return nil
+	}
+	if len(msgs) != 0 {
+		newest = msgs[0]
+	}
+
+	c.lock.Lock()
+	if !c.loaded && c.countedGen == gen {
+		c.newest, c.newestRead = newest, true
+	}
+	c.lock.Unlock()
+	return newest
+}
+
+func (c *Channel) Sub(evch chan *ChannelEvent) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.Clients[evch] = true
+	c.subscribed(time.Now())
+	if len(c.Clients) > c.peakClients {
+		c.peakClients = len(c.Clients)
+	}
+}
+
+func (c *Channel) UnSub(evch chan *ChannelEvent) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.Clients, evch)
+	c.lastSubscribed = time.Now()
+	c.occupancy(c.lastSubscribed)
+}
+
+// Def returns the attributes of the channel. They never change once the
+// channel is inited, so this does not lock.
+func (c *Channel) Def() *ChannelDef {
+	return &ChannelDef{
+		Name: c.Name, Size: c.Size, Life: c.Life, One2One: c.One2One, Key: c.Key,
+		Created: c.Created, History: c.HistoryCount, HistoryBytes: c.HistoryBytes,
+	}
+}
+
+func (c *Channel) Info() *ChannelInfo {
+	stored := c.storedCount()
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	info := &ChannelInfo{
+		Name:        c.Name,
+		Size:        c.Size,
+		Life:        c.Life,
+		One2One:     c.One2One,
+		HasKey:      c.Key != "",
+		Created:     c.Created,
+		Subscribers: len(c.Clients),
+		Loaded:      c.loaded,
+
+		History:      c.HistoryCount,
+		HistoryBytes: c.HistoryBytes,
+	}
+
+	if c.Messages == nil {
+		return info
+	}
+	if !c.loaded {
+		if stored != nil {
+			info.Messages, info.Bytes = uint(stored.messages), stored.bytes
+		}
+		return info
+	}
+
+	info.Messages = c.Messages.Length()
+	info.Bytes = c.Messages.Bytes
+	if m, err := c.Messages.PeekOldest(); err == nil {
+		info.Oldest = fmt.Sprintf("%d", m.Created)
+	}
+	if m, err := c.Messages.PeekNewest(); err == nil {
+		info.Newest = fmt.Sprintf("%d", m.Created)
+	}
+	return info
+}
+
+func (c *Channel) Stats() *ChannelStats {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	stats := &ChannelStats{
+		Published:       c.nPublished,
+		Delivered:       c.nDelivered,
+		BytesIn:         c.nBytesIn,
+		Expired:         c.nExpired,
+		Dropped:         c.nDropped,
+		PeakSubscribers: c.peakClients,
+	}
+	if !c.lastPub.IsZero() {
+		last := c.lastPub
+		stats.LastPublish = &last
+	}
+	return stats
+}
+
+// pageIn returns the stored messages after since and before the oldest one
+// in memory, if any, the caller holds lock.
+func (c *Channel) pageIn(since int64, ith uint) []*Message {
+	if since == 0 || ith != 0 || c.HistoryCount == 0 && c.HistoryBytes == 0 {
+		return nil
+	}
+	store := c.s.storage()
+	oldest, err := c.Messages.PeekOldest()
+	if err != nil || oldest.Created <= since || store == nil {
+		return nil
+	}
+
+	msgs, err := store.LoadRange(c.Name, since, oldest.Created, SpillPage)
+	if err != nil {
+		log.Println("Could not page in", c.Name, err)
+		return nil
+	}
+	c.s.nPageIns.Add(1)
+	return msgs
+}
+
+func (c *Channel) Json() ([]byte, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.load()
+	m, err := c.Messages.PeekNewest() // TODO handle error
+	if err == nil {
+		return json.MarshalIndent(
+			map[string]string{"etag": fmt.Sprintf("%d", m.Created)}, " ", "    ",
+		)
+	} else {
+		return ETag0, nil
+	}
+}
+
+// Empty drops all messages, the caller holds lock. If there were any,
+// webhooks are told the channel was emptied.
+func (c *Channel) Empty() {
+	n := c.Messages.Length()
+	c.Messages.Empty()
+	c.s.emptyChannel(c)
+	if n > 0 {
+		c.s.notify(c, "emptied", nil)
+	}
+}
+
+// Append adds the messages from the ith on to resp, see after.
+func (ch *Channel) Append(resp *SubResponse, since int64, ith uint) {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+
+	ch.load()
+
+	payload := []string{}
+	etag := int64(0)
+	for _, m := range ch.after(since, ith) {
+		payload = append(payload, string(m.Data))
+		etag = m.Created
+	}
+	ch.nDelivered += int64(len(payload))
+	ch.s.nDelivered.Add(int64(len(payload)))
+	resp.Channels[ch.Name] = &ChanResponse{fmt.Sprintf("%d", etag), payload}
+	if ch.One2One {
+		ch.Empty()
+	}
+}
+
+// After returns the messages after since, which HasNew found before the
+// ith message in memory, see after.
+func (ch *Channel) After(since int64, ith uint) []*Message {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+
+	ch.load()
+	return ch.after(since, ith)
+}
+
+// after returns the messages from the ith on. A spilling channel first pages
+// in up to SpillPage messages newer than since from storage, if the client
+// is behind the messages in memory, and if there are more in storage returns
+// only those, the client comes back with the last etag for the rest. The
+// caller holds lock.
+func (ch *Channel) after(since int64, ith uint) []*Message {
+	msgs := ch.pageIn(since, ith)
+	if len(msgs) == SpillPage {
+		return msgs
+	}
+
+	for i := ith; i < ch.Messages.Length(); i++ {
+		m, _ := ch.Messages.Ith(i)
+		msgs = append(msgs, m)
+	}
+	return msgs
+}
+
+// Stats returns the state of the server, as the martd command publishes it
+// with expvar. Only the channels of MetricsChannels have their counters in
+// it, so its size is bounded, the totals are in Vars.
+func (s *Server) Stats() interface{} {
+	// ListChannels, not chanLock: Stats() takes the channel locks
+	chans := s.ListChannels("")
+	perChannel := map[string]*ChannelStats{}
+	if len(s.opts.MetricsChannels) != 0 {
+		for _, ch := range chans {
+			if s.metricsChannel(ch.Name) {
+				perChannel[ch.Name] = ch.Stats()
+			}
+		}
+	}
+
+	return map[string]interface{}{
+		"nChans":      len(chans),
+		"channels":    perChannel,
+		"uptime":      gutils.TimeSinceHuman(s.start),
+		"ServerStart": s.start,
+		"peers":       s.PeerStatuses(),
+		"replication": s.GetReplicationStatus(),
+		"shards":      s.opts.Shards,
+		"webhooks":    s.WebhookStatuses(),
+	}
+}
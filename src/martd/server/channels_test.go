@@ -0,0 +1,167 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// failingStorage fails LoadMessages while fail is set.
+type failingStorage struct {
+	Storage
+	fail bool
+}
+
+func (s *failingStorage) LoadMessages(name string, limit int) (
+	[]*Message, error,
+) {
+	if s.fail {
+		return nil, errors.New("load failed")
+	}
+	return s.Storage.LoadMessages(name, limit)
+}
+
+// testChannel creates a channel on s and publishes n messages to it,
+// waiting for them to be stored.
+func testChannel(t *testing.T, s *Server, def *ChannelDef, n int) *Channel {
+	t.Helper()
+
+	ch, err := s.GetOrCreateChannel(def)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= n; i++ {
+		if _, err := ch.PubSync([]byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ch
+}
+
+// historyData returns the payloads of the whole history of ch.
+func historyData(t *testing.T, ch *Channel) string {
+	t.Helper()
+
+	msgs, _, err := ch.History(0, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payloads(msgs)
+}
+
+// payloads joins the payloads of msgs.
+func payloads(msgs []*Message) string {
+	out := ""
+	for _, m := range msgs {
+		out += string(m.Data)
+	}
+	return out
+}
+
+func TestUnloadLoad(t *testing.T) {
+	s := newTestServer(t, nil)
+	def := &ChannelDef{Name: "lazy", Size: 10, Life: time.Hour}
+	ch := testChannel(t, s, def, 3)
+
+	if !ch.Unload(time.Now()) {
+		t.Fatal("channel not unloaded")
+	}
+	info := ch.Info()
+	if info.Loaded || info.Messages != 3 || info.Bytes != 3 {
+		t.Fatalf("unloaded info %+v", info)
+	}
+
+	if got := historyData(t, ch); got != "123" {
+		t.Fatalf("loaded %q", got)
+	}
+	if info := ch.Info(); !info.Loaded || info.Messages != 3 {
+		t.Fatalf("loaded info %+v", info)
+	}
+}
+
+func TestLoadFailure(t *testing.T) {
+	s := newTestServer(t, nil)
+	def := &ChannelDef{Name: "lazy", Size: 10, Life: time.Hour}
+	ch := testChannel(t, s, def, 2)
+
+	store := &failingStorage{Storage: s.storage(), fail: true}
+	s.setStorage(store)
+	if !ch.Unload(time.Now()) {
+		t.Fatal("channel not unloaded")
+	}
+
+	if _, _, err := ch.History(0, 0, 100); err == nil {
+		t.Fatal("history of a channel that failed to load")
+	}
+	if _, _, err := ch.HasNew(0); err == nil {
+		t.Fatal("HasNew on a channel that failed to load")
+	}
+	ch.Pub([]byte("3"))
+	if ch.Info().Loaded {
+		t.Fatal("channel loaded after a failed load")
+	}
+
+	// the next use loads what is stored, keeping what was published
+	store.fail = false
+	if got := historyData(t, ch); got != "123" {
+		t.Fatalf("loaded %q", got)
+	}
+}
+
+func TestCount(t *testing.T) {
+	for name, store := range testStores(t) {
+		fillStore(t, store)
+		n, bytes, err := store.Count("a", 10)
+		if err != nil || n != 2 || bytes != 4 {
+			t.Fatalf("%s: counted %d, %d: %v", name, n, bytes, err)
+		}
+		n, bytes, err = store.Count("a", 1)
+		if err != nil || n != 1 || bytes != 2 {
+			t.Fatalf("%s: counted %d, %d: %v", name, n, bytes, err)
+		}
+		n, _, err = store.Count("none", 10)
+		if err != nil || n != 0 {
+			t.Fatalf("%s: counted %d of none: %v", name, n, err)
+		}
+	}
+}
+
+func TestHistoryLimit(t *testing.T) {
+	s := newTestServer(t, nil)
+	def := &ChannelDef{Name: "spill", Size: 2, Life: time.Hour, History: 10}
+	ch := testChannel(t, s, def, 6)
+
+	msgs, more, err := ch.History(0, 0, 3)
+	if err != nil || payloads(msgs) != "456" || !more {
+		t.Fatalf("newest 3: %q, %v, %v", payloads(msgs), more, err)
+	}
+	msgs, more, err = ch.History(0, msgs[0].Created, 3)
+	if err != nil || payloads(msgs) != "123" || more {
+		t.Fatalf("page before: %q, %v, %v", payloads(msgs), more, err)
+	}
+	msgs, more, err = ch.History(msgs[0].Created, 0, 100)
+	if err != nil || payloads(msgs) != "23456" || more {
+		t.Fatalf("since the first: %q, %v, %v", payloads(msgs), more, err)
+	}
+}
+
+func TestLoadBefore(t *testing.T) {
+	for name, store := range testStores(t) {
+		fillStore(t, store)
+		all, _ := store.LoadMessages("a", 0)
+
+		msgs, err := store.LoadBefore("a", 0, all[1].Created+1, 1)
+		if err != nil || len(msgs) != 1 || string(msgs[0].Data) != "a2" {
+			t.Fatalf("%s: newest before: %v, %v", name, msgs, err)
+		}
+		msgs, err = store.LoadBefore("a", all[0].Created, all[1].Created, 10)
+		if err != nil || len(msgs) != 0 {
+			t.Fatalf("%s: empty range: %v, %v", name, msgs, err)
+		}
+		msgs, err = store.LoadBefore("a", 0, all[1].Created+1, 10)
+		if err != nil || len(msgs) != 2 || string(msgs[0].Data) != "a1" {
+			t.Fatalf("%s: whole range: %v, %v", name, msgs, err)
+		}
+	}
+}
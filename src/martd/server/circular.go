@@ -0,0 +1,84 @@
+package server
+
+import (
+	"expvar"
+
+	. "github.com/amitu/gutils"
+)
+
+func conv(v interface{}, err error) (*Message, error) {
+	if v == nil {
+		return nil, err
+	}
+	return v.(*Message), err
+}
+
+// CircularMessageArray is a CircularArray of messages. It keeps count of the
+// payload bytes it holds, and adds what it holds to nMessages and nBytes if
+// they are set, so totals need no walk over all channels.
+type CircularMessageArray struct {
+	CircularArray
+	Bytes int
+
+	nMessages, nBytes *expvar.Int
+}
+
+func NewCircularMessageArray(size uint) *CircularMessageArray {
+	return &CircularMessageArray{CircularArray: CircularArray{Size: size}}
+}
+
+// count adds n of m to the totals, n is 1 or -1.
+func (circ *CircularMessageArray) count(m *Message, n int) {
+	circ.Bytes += n * len(m.Data)
+	if circ.nMessages != nil {
+		circ.nMessages.Add(int64(n))
+		circ.nBytes.Add(int64(n * len(m.Data)))
+	}
+}
+
+func (circ *CircularMessageArray) Push(buf *Message) (*Message, bool){
+	circ.count(buf, 1)
+	v, dropped := circ.CircularArray.Push(buf)
+	if dropped {
+		circ.count(v.(*Message), -1)
+		return v.(*Message), true
+	}
+	return nil, false
+}
+
+func (circ *CircularMessageArray) Pop() (*Message, error) {
+	m, err := conv(circ.CircularArray.Pop())
+	if err == nil {
+		circ.count(m, -1)
+	}
+	return m, err
+}
+
+func (circ *CircularMessageArray) PopNewest() (*Message, error) {
+	m, err := conv(circ.CircularArray.PopNewest())
+	if err == nil {
+		circ.count(m, -1)
+	}
+	return m, err
+}
+
+func (circ *CircularMessageArray) Empty() {
+	if circ.nMessages != nil {
+		circ.nMessages.Add(-int64(circ.Length()))
+		circ.nBytes.Add(-int64(circ.Bytes))
+	}
+	circ.CircularArray.Empty()
+	circ.Bytes = 0
+}
+
+func (circ *CircularMessageArray) PeekOldest() (*Message, error) {
+	return conv(circ.CircularArray.PeekOldest())
+}
+
+func (circ *CircularMessageArray) PeekNewest() (*Message, error) {
+	return conv(circ.CircularArray.PeekNewest())
+}
+
+func (circ *CircularMessageArray) Ith(i uint) (*Message, error) {
+	return conv(circ.CircularArray.Ith(i))
+}
@@ -0,0 +1,340 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// PeerQueue is how many messages are held for a peer that is down,
+	// later ones are dropped.
+	PeerQueue = 10000
+	// PeerBatch is the most messages sent to a peer in one request.
+	PeerBatch       = 100
+	PeerMaxBackoff  = 10 * time.Second
+	peerMinBackoff  = 100 * time.Millisecond
+	peerSendTimeout = 10 * time.Second
+)
+
+// clusterMessage is a message forwarded to a peer, with the attributes to
+// create its channel with if the peer does not have it yet, or if Op is set
+// an operation on the channel: define, purge or delete.
+type clusterMessage struct {
+	Op     string      `json:"op,omitempty"`
+	Def    *ChannelDef `json:"def"`
+	Etag   int64       `json:"etag,string"`
+	Before int64       `json:"before,string,omitempty"` // for purge
+	Data   []byte      `json:"data"`                    // base64
+}
+
+// clusterResponse is the response to a batch forwarded to a peer, with how
+// many of its messages were applied before one was rejected, if any was.
+type clusterResponse struct {
+	Received int    `json:"received"`
+	Error    string `json:"error,omitempty"`
+}
+
+// rejectedError is a batch a peer refused with a 4xx status. Retrying it
+// would fail the same way, so the rejected message is dropped, or the
+// whole batch if the peer did not say which one it was.
+type rejectedError struct {
+	applied int // -1 if unknown
+	msg     string
+}
+
+func (e *rejectedError) Error() string {
+	return e.msg
+}
+
+// Peer is another node of the cluster. Messages are sent to it in order, by
+// one goroutine, and retried with backoff while it is down.
+type Peer struct {
+	s     *Server
+	URL   string
+	queue chan *clusterMessage
+
+	lock      sync.Mutex
+	up        bool
+	lastError string
+	lastSeen  time.Time
+	forwarded int64
+	dropped   int64
+}
+
+// PeerStatus is the state of a Peer, as shown in stats and metrics.
+type PeerStatus struct {
+	URL       string     `json:"url"`
+	Up        bool       `json:"up"`
+	LastError string     `json:"last_error,omitempty"`
+	LastSeen  *time.Time `json:"last_seen,omitempty"`
+	Queued    int        `json:"queued"`
+	Forwarded int64      `json:"forwarded"`
+	Dropped   int64      `json:"dropped"`
+}
+
+// startCluster starts a sender for each of the Peers.
+func (s *Server) startCluster() error {
+	if len(s.opts.Peers) == 0 {
+		return nil
+	}
+	if s.opts.ClusterKey == "" {
+		return errors.New("peers need a cluster key")
+	}
+
+	for _, url := range s.opts.Peers {
+		p := &Peer{
+			s:     s,
+			URL:   strings.TrimSuffix(url, "/"),
+			queue: make(chan *clusterMessage, PeerQueue),
+		}
+		s.peers = append(s.peers, p)
+		s.goRun(p.sender)
+	}
+	log.Println("Forwarding to", len(s.peers), "peers")
+	return nil
+}
+
+// forward queues a message published on this node for all peers, without
+// blocking: if a peer's queue is full the message is dropped for it.
+func (s *Server) forward(c *Channel, m *Message) {
+	if len(s.peers) == 0 {
+		return
+	}
+	s.toPeers(&clusterMessage{Def: c.Def(), Etag: m.Created, Data: m.Data})
+}
+
+// forwardOp queues an operation on a channel for all peers, as forward does.
+func (s *Server) forwardOp(op string, def *ChannelDef, before int64) {
+	if len(s.peers) == 0 {
+		return
+	}
+	s.toPeers(&clusterMessage{Op: op, Def: def, Before: before})
+}
+
+func (s *Server) toPeers(cm *clusterMessage) {
+	for _, p := range s.peers {
+		select {
+		case p.queue <- cm:
+		default:
+			p.lock.Lock()
+			p.dropped++
+			p.lock.Unlock()
+		}
+	}
+}
+
+// PeerStatuses returns the state of all peers, in Peers order.
+func (s *Server) PeerStatuses() []*PeerStatus {
+	statuses := make([]*PeerStatus, 0, len(s.peers))
+	for _, p := range s.peers {
+		statuses = append(statuses, p.Status())
+	}
+	return statuses
+}
+
+func (p *Peer) Status() *PeerStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	status := &PeerStatus{
+		URL: p.URL, Up: p.up, LastError: p.lastError, Queued: len(p.queue),
+		Forwarded: p.forwarded, Dropped: p.dropped,
+	}
+	if !p.lastSeen.IsZero() {
+		seen := p.lastSeen
+		status.LastSeen = &seen
+	}
+	return status
+}
+
+// sender sends queued messages in batches of up to PeerBatch, or an empty
+// batch as a heartbeat when idle. A failed batch is retried until the peer
+// takes it, so messages reach a peer in the order they were published, or
+// the server is shut down. A message the peer rejects is dropped, and the
+// rest of its batch sent on.
+func (p *Peer) sender() {
+	client := &http.Client{Timeout: peerSendTimeout}
+	backoff := peerMinBackoff
+
+	for {
+		batch := []*clusterMessage{}
+		select {
+		case cm := <-p.queue:
+			batch = append(batch, cm)
+		case <-time.After(p.s.opts.PeerHeartbeat):
+		case <-p.s.done:
+			return
+		}
+	more:
+		for len(batch) < PeerBatch {
+			select {
+			case cm := <-p.queue:
+				batch = append(batch, cm)
+			default:
+				break more
+			}
+		}
+
+		for {
+			err := p.send(client, batch)
+			rejected, ok := err.(*rejectedError)
+			if ok && len(batch) != 0 {
+				batch = p.drop(batch, rejected)
+				if len(batch) == 0 {
+					break
+				}
+				continue
+			}
+
+			p.lock.Lock()
+			if err == nil {
+				if !p.up {
+					log.Println("Peer", p.URL, "is up")
+				}
+				p.up, p.lastError, p.lastSeen = true, "", time.Now()
+				p.forwarded += int64(len(batch))
+			} else {
+				if p.up || p.lastError == "" {
+					log.Println("Peer", p.URL, "is down:", err)
+				}
+				p.up, p.lastError = false, err.Error()
+			}
+			p.lock.Unlock()
+
+			if err == nil {
+				p.s.nForwarded.Add(int64(len(batch)))
+				backoff = peerMinBackoff
+				break
+			}
+
+			if !p.s.sleep(backoff) {
+				return
+			}
+			if backoff *= 2; backoff > PeerMaxBackoff {
+				backoff = PeerMaxBackoff
+			}
+		}
+	}
+}
+
+// drop counts what of batch the peer applied as forwarded, and the message
+// it rejected as dropped, and returns the rest of batch.
+func (p *Peer) drop(
+	batch []*clusterMessage, rejected *rejectedError,
+) []*clusterMessage {
+	applied, dropped := rejected.applied, 1
+	if applied < 0 || applied >= len(batch) {
+		applied, dropped = 0, len(batch)
+	}
+	log.Println(
+		"Peer", p.URL, "rejected", dropped, "messages, dropping them:",
+		rejected,
+	)
+
+	p.lock.Lock()
+	p.up, p.lastError, p.lastSeen = true, rejected.Error(), time.Now()
+	p.forwarded += int64(applied)
+	p.dropped += int64(dropped)
+	p.lock.Unlock()
+	p.s.nForwarded.Add(int64(applied))
+	return batch[applied+dropped:]
+}
+
+func (p *Peer) send(client *http.Client, batch []*clusterMessage) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", p.URL+"/cluster/pub", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.s.opts.ClusterKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		err := fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+		if resp.StatusCode/100 != 4 {
+			return err
+		}
+		cr := &clusterResponse{Received: -1}
+		json.Unmarshal(msg, cr)
+		return &rejectedError{cr.Received, err.Error()}
+	}
+	return nil
+}
+
+// ClusterPubHandler takes messages and operations forwarded by a peer,
+// publishing messages locally with their original etags, and without
+// forwarding any of them again. If one is invalid, the response is a 400
+// with how many before it were applied.
+func (s *Server) ClusterPubHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, s.opts.ClusterKey) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != "POST" {
+		s.reject(w, "cluster endpoints only accept POST")
+		return
+	}
+
+	batch := []*clusterMessage{}
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		s.reject(w, "invalid batch: "+err.Error())
+		return
+	}
+
+	for i, cm := range batch {
+		if err := s.receive(cm); err != nil {
+			j, _ := json.Marshal(&clusterResponse{i, err.Error()})
+			http.Error(w, string(j), http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.respondJSON(w, &clusterResponse{Received: len(batch)})
+}
+
+func (s *Server) receive(cm *clusterMessage) error {
+	if cm.Def == nil || cm.Def.Name == "" || cm.Op == "" && cm.Etag == 0 {
+		return errors.New("message without channel or etag")
+	}
+
+	switch cm.Op {
+	case "", "define", "purge":
+	case "delete":
+		s.deleteChannel(cm.Def.Name)
+		return nil
+	default:
+		log.Println("Unknown operation from peer:", cm.Op)
+		return nil
+	}
+
+	def := *cm.Def
+	ch, _ := s.getOrCreate(&def)
+	switch cm.Op {
+	case "":
+		if ch.PubRemote(cm.Data, cm.Etag) {
+			s.nReceived.Add(1)
+		}
+	case "purge":
+		ch.purgeBefore(cm.Before) // 0 empties
+	}
+	return nil
+}
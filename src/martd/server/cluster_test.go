@@ -0,0 +1,137 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// eventually fails the test if ok is not true within a few seconds.
+func eventually(t *testing.T, what string, ok func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); !ok(); {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPeerForwarding(t *testing.T) {
+	b := newTestServer(t, func(o *Options) { o.ClusterKey = "k" })
+	peer := httptest.NewServer(http.HandlerFunc(b.ClusterPubHandler))
+	defer peer.Close()
+	a := newTestServer(t, func(o *Options) {
+		o.ClusterKey = "k"
+		o.Peers = []string{peer.URL}
+	})
+
+	def := &ChannelDef{Name: "c", Size: 10, Life: time.Hour}
+	ch := testChannel(t, a, def, 2)
+	etag := ch.Pub([]byte("3"))
+
+	eventually(t, "forwarded messages", func() bool {
+		ch := b.LookupChannel("c")
+		return ch != nil && historyData(t, ch) == "123"
+	})
+	if newest := b.LookupChannel("c").Newest(); newest.Created != etag {
+		t.Fatalf("forwarded etag %d, want %d", newest.Created, etag)
+	}
+}
+
+func TestClusterPubPartial(t *testing.T) {
+	s := newTestServer(t, func(o *Options) { o.ClusterKey = "k" })
+
+	def := &ChannelDef{Name: "c", Size: 10, Life: time.Hour}
+	body, _ := json.Marshal([]*clusterMessage{
+		{Def: def, Etag: 1, Data: []byte("1")},
+		{Def: def}, // no etag
+		{Def: def, Etag: 3, Data: []byte("3")},
+	})
+	r := httptest.NewRequest("POST", "/cluster/pub", bytes.NewReader(body))
+	r.Header.Set("Authorization", "Bearer k")
+	w := httptest.NewRecorder()
+	s.ClusterPubHandler(w, r)
+
+	cr := &clusterResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), cr); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusBadRequest || cr.Received != 1 {
+		t.Fatalf("got %d, %+v", w.Code, cr)
+	}
+	if got := historyData(t, s.LookupChannel("c")); got != "1" {
+		t.Fatalf("applied %q", got)
+	}
+}
+
+func TestPeerRejects(t *testing.T) {
+	// the peer rejects messages "bad", applying those before them
+	lock, got := sync.Mutex{}, ""
+	peer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			batch := []*clusterMessage{}
+			json.NewDecoder(r.Body).Decode(&batch)
+			lock.Lock()
+			defer lock.Unlock()
+			for i, cm := range batch {
+				if string(cm.Data) == "bad" {
+					j, _ := json.Marshal(&clusterResponse{i, "bad"})
+					http.Error(w, string(j), http.StatusBadRequest)
+					return
+				}
+				got += string(cm.Data)
+			}
+		},
+	))
+	defer peer.Close()
+	s := newTestServer(t, func(o *Options) {
+		o.ClusterKey = "k"
+		o.Peers = []string{peer.URL}
+	})
+
+	ch, _ := s.GetOrCreateChannel(
+		&ChannelDef{Name: "c", Size: 10, Life: time.Hour},
+	)
+	for _, data := range []string{"1", "bad", "2", "bad", "3"} {
+		ch.Pub([]byte(data))
+	}
+
+	eventually(t, "the good messages", func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return got == "123"
+	})
+	// the channel's definition is forwarded too
+	eventually(t, "the counts", func() bool {
+		status := s.PeerStatuses()[0]
+		return status.Forwarded == 4 && status.Dropped == 2
+	})
+}
+
+func TestPushOutOfOrder(t *testing.T) {
+	s := newTestServer(t, nil)
+	def := &ChannelDef{Name: "c", Size: 3, Life: time.Hour}
+	ch, _ := s.GetOrCreateChannel(def)
+	for _, etag := range []int64{10, 20, 30} {
+		ch.PubRemote([]byte{byte('0' + etag/10)}, etag)
+	}
+
+	if ch.PubRemote([]byte("0"), 5) {
+		t.Fatal("added a message older than all of a full channel")
+	}
+	if !ch.PubRemote([]byte("x"), 15) {
+		t.Fatal("message from a peer not added")
+	}
+	if got := historyData(t, ch); got != "x23" {
+		t.Fatalf("got %q", got)
+	}
+	if stats := ch.Stats(); stats.Dropped != 1 {
+		t.Fatalf("dropped %d", stats.Dropped)
+	}
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// exportRecord is one line of an export, either a channel or a message.
+// Channels come before their messages, messages are oldest first.
+type exportRecord struct {
+	Channel *ChannelDef    `json:"channel,omitempty"`
+	Message *exportMessage `json:"message,omitempty"`
+}
+
+type exportMessage struct {
+	Channel string `json:"channel"`
+	Etag    int64  `json:"etag,string"`
+	Expiry  int64  `json:"expiry,string"`
+	Data    []byte `json:"data"` // base64
+}
+
+// Export writes all channels and messages in store as NDJSON.
+func Export(store Storage, w io.Writer) (int, int, error) {
+	enc := json.NewEncoder(w)
+	nChans, nMsgs := 0, 0
+	var err error
+
+	lerr := LoadAll(store, func(def *ChannelDef, m *Message) {
+		if err != nil {
+			return
+		}
+		if m == nil {
+			nChans++
+			err = enc.Encode(&exportRecord{Channel: def})
+			return
+		}
+		nMsgs++
+		err = enc.Encode(&exportRecord{Message: &exportMessage{
+			def.Name, m.Created, m.Created + int64(def.Life), m.Data,
+		}})
+	})
+	if lerr != nil {
+		return nChans, nMsgs, lerr
+	}
+	return nChans, nMsgs, err
+}
+
+// Import reads an export into store. The whole export is read and checked
+// before anything is written, then each channel is written in one commit,
+// with others up to batch operations. With replace, everything already in
+// store is deleted. Otherwise the export is merged: existing channels keep
+// their attributes, and get the messages they do not have yet, keeping at
+// most size messages per channel. Expired messages are skipped.
+func Import(
+	store Storage, r io.Reader, replace bool, batch int,
+) (int, int, error) {
+	existing := map[string]*ChannelDef{}
+	ids := map[string][]int64{}
+	err := LoadAll(store, func(def *ChannelDef, m *Message) {
+		existing[def.Name] = def
+		if m != nil {
+			ids[def.Name] = append(ids[def.Name], m.Created)
+		}
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	defs := map[string]*ChannelDef{}
+	msgs := map[string][]*exportMessage{}
+	order := []string{}
+	now := time.Now().UnixNano()
+
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for line := 1; ; line++ {
+		rec := &exportRecord{}
+		err := dec.Decode(rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("record %d: %s", line, err)
+		}
+
+		switch {
+		case rec.Channel != nil:
+			if _, ok := defs[rec.Channel.Name]; !ok {
+				order = append(order, rec.Channel.Name)
+			}
+			defs[rec.Channel.Name] = rec.Channel
+		case rec.Message != nil:
+			if _, ok := defs[rec.Message.Channel]; !ok {
+				return 0, 0, fmt.Errorf(
+					"record %d: message before its channel %q", line,
+					rec.Message.Channel,
+				)
+			}
+			if rec.Message.Expiry >= now {
+				msgs[rec.Message.Channel] = append(
+					msgs[rec.Message.Channel], rec.Message,
+				)
+			}
+		default:
+			return 0, 0, fmt.Errorf("record %d: neither channel nor message", line)
+		}
+	}
+
+	w := &batchWriter{store: store, size: batch}
+	if replace {
+		for name, def := range existing {
+			if _, ok := defs[name]; !ok {
+				w.do(func(b Batch) error { return b.Delete(def) })
+				w.flush()
+			}
+		}
+	}
+
+	nMsgs := 0
+	for _, name := range order {
+		def, ok := existing[name]
+		have := ids[name]
+		if ok && replace {
+			// in the same commit as what replaces it
+			old := def
+			w.do(func(b Batch) error { return b.Delete(old) })
+			ok, have = false, nil
+		}
+		if !ok {
+			def = defs[name]
+			w.do(func(b Batch) error { return b.Define(def) })
+		}
+		nMsgs += importMessages(w, def, have, msgs[name])
+		w.flush()
+	}
+
+	return len(order), nMsgs, w.commit()
+}
+
+// importMessages appends msgs the channel does not have, evicting or
+// skipping the oldest ones beyond its size, or its history if it spills.
+func importMessages(
+	w *batchWriter, def *ChannelDef, have []int64, msgs []*exportMessage,
+) int {
+	type entry struct {
+		id  int64
+		msg *exportMessage // nil for a message already stored
+	}
+
+	seen := map[int64]bool{}
+	all := []entry{}
+	for _, id := range have {
+		seen[id] = true
+		all = append(all, entry{id, nil})
+	}
+	for _, m := range msgs {
+		if !seen[m.Etag] {
+			seen[m.Etag] = true
+			all = append(all, entry{m.Etag, m})
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].id < all[j].id })
+
+	keep := int(def.Size)
+	if def.Spills() {
+		keep = int(def.History)
+		if keep == 0 {
+			keep = len(all) // only history_bytes, left to Trim
+		}
+	}
+
+	n := 0
+	over := len(all) - keep
+	for i, e := range all {
+		e := e
+		switch {
+		case i < over && e.msg == nil:
+			w.do(func(b Batch) error {
+				return b.Evict(def, &Message{Created: e.id})
+			})
+		case i >= over && e.msg != nil:
+			n++
+			w.do(func(b Batch) error {
+				return b.Append(def, &Message{Data: e.msg.Data, Created: e.id})
+			})
+		}
+	}
+	if def.Spills() {
+		w.do(func(b Batch) error { return b.Trim(def) })
+	}
+	return n
+}
+
+// batchWriter applies writes to store, committing on flush once there are
+// size of them.
+type batchWriter struct {
+	store Storage
+	size  int
+
+	b   Batch
+	n   int
+	err error
+}
+
+func (w *batchWriter) do(op func(Batch) error) {
+	if w.err != nil {
+		return
+	}
+	if w.b == nil {
+		if w.b, w.err = w.store.Begin(); w.err != nil {
+			return
+		}
+	}
+	if w.err = op(w.b); w.err != nil {
+		w.b.Rollback()
+		w.b = nil
+		return
+	}
+	w.n++
+}
+
+// flush commits if there are size writes or more.
+func (w *batchWriter) flush() {
+	if w.err == nil && w.n >= w.size {
+		w.err = w.commit()
+	}
+}
+
+func (w *batchWriter) commit() error {
+	if w.err != nil || w.b == nil {
+		return w.err
+	}
+	err := w.b.Commit()
+	w.b, w.n = nil, 0
+	return err
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// testStores returns an empty memory and log storage.
+func testStores(t *testing.T) map[string]Storage {
+	return map[string]Storage{
+		"memory": NewMemoryStorage(),
+		"log":    openTestLog(t, t.TempDir(), 1<<20),
+	}
+}
+
+// fillStore stores channels a and b, with two messages each.
+func fillStore(t *testing.T, store Storage) {
+	t.Helper()
+
+	now := time.Now().UnixNano()
+	b, err := store.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		def := &ChannelDef{
+			Name: name, Size: 10, Life: time.Hour, Created: now,
+		}
+		b.Define(def)
+		for i := int64(1); i <= 2; i++ {
+			b.Append(def, &Message{
+				Data: []byte(fmt.Sprint(name, i)), Created: now + i,
+			})
+		}
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// dump returns the channels and payloads of store, in order.
+func dump(t *testing.T, store Storage) string {
+	t.Helper()
+
+	out := ""
+	err := LoadAll(store, func(def *ChannelDef, m *Message) {
+		if m == nil {
+			out += fmt.Sprintf("%s/%d:", def.Name, def.Size)
+		} else {
+			out += fmt.Sprintf(" %s", m.Data)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestExportImport(t *testing.T) {
+	for name, store := range testStores(t) {
+		fillStore(t, store)
+		export := &bytes.Buffer{}
+		nChans, nMsgs, err := Export(store, export)
+		if err != nil || nChans != 2 || nMsgs != 4 {
+			t.Fatalf("%s: exported %d, %d: %v", name, nChans, nMsgs, err)
+		}
+
+		into := NewMemoryStorage()
+		r := bytes.NewReader(export.Bytes())
+		nChans, nMsgs, err = Import(into, r, false, 3)
+		if err != nil || nChans != 2 || nMsgs != 4 {
+			t.Fatalf("%s: imported %d, %d: %v", name, nChans, nMsgs, err)
+		}
+		if got, want := dump(t, into), dump(t, store); got != want {
+			t.Fatalf("%s: imported %q, want %q", name, got, want)
+		}
+
+		// merging the same again adds nothing
+		r = bytes.NewReader(export.Bytes())
+		_, nMsgs, err = Import(into, r, false, 3)
+		if err != nil || nMsgs != 0 {
+			t.Fatalf("%s: merged %d messages again: %v", name, nMsgs, err)
+		}
+	}
+}
+
+func TestImportReplace(t *testing.T) {
+	for name, store := range testStores(t) {
+		fillStore(t, store)
+
+		export := fmt.Sprintf(
+			"%s\n%s\n",
+			`{"channel":{"name":"b","size":5,"life":3600000000000}}`,
+			`{"message":{"channel":"b","etag":"1","expiry":"`+
+				fmt.Sprint(time.Now().Add(time.Hour).UnixNano())+
+				`","data":"Yg=="}}`,
+		)
+		_, _, err := Import(store, bytes.NewReader([]byte(export)), true, 1)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := dump(t, store); got != "b/5: b" {
+			t.Fatalf("%s: after replace %q", name, got)
+		}
+	}
+}
+
+func TestImportTruncated(t *testing.T) {
+	for name, store := range testStores(t) {
+		fillStore(t, store)
+		before := dump(t, store)
+
+		export := &bytes.Buffer{}
+		if _, _, err := Export(store, export); err != nil {
+			t.Fatal(err)
+		}
+		truncated := export.Bytes()[:export.Len()-10]
+
+		for _, replace := range []bool{false, true} {
+			_, _, err := Import(store, bytes.NewReader(truncated), replace, 1)
+			if err == nil {
+				t.Fatalf("%s: imported a truncated export", name)
+			}
+			if got := dump(t, store); got != before {
+				t.Fatalf("%s: failed import left %q, was %q", name, got, before)
+			}
+		}
+	}
+}
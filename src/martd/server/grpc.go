@@ -0,0 +1,481 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// GRPCQueue is how many messages wait for a slow Subscribe stream, later
+	// ones are dropped.
+	GRPCQueue      = 1000
+	grpcMaxMessage = 64 << 20
+
+	grpcOK                 = 0
+	grpcInvalidArgument    = 3
+	grpcNotFound           = 5
+	grpcPermissionDenied   = 7
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+	grpcUnauthenticated    = 16
+)
+
+// grpcError is a failed call, with its gRPC status code.
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string {
+	return e.msg
+}
+
+func grpcErrorf(code int, format string, args ...interface{}) error {
+	return &grpcError{code, fmt.Sprintf(format, args...)}
+}
+
+// serveGRPC starts the gRPC listener, if GRPCAddr is set. gRPC is HTTP/2,
+// which net/http serves without TLS when asked to.
+func (s *Server) serveGRPC() error {
+	if s.opts.GRPCAddr == "" {
+		return nil
+	}
+
+	protocols := &http.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+	err := s.serve(&http.Server{
+		Addr:      s.opts.GRPCAddr,
+		Handler:   s.guard(s.GRPCHandler),
+		Protocols: protocols,
+	})
+	if err != nil {
+		return fmt.Errorf("gRPC listener: %s", err)
+	}
+	log.Printf("Started gRPC listener on %s.", s.opts.GRPCAddr)
+	return nil
+}
+
+// GRPCHandler serves the calls of the Martd service of martd.proto.
+func (s *Server) GRPCHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" ||
+		!strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC only", http.StatusUnsupportedMediaType)
+		return
+	}
+	s.nGRPCCalls.Add(1)
+	w.Header().Set("Content-Type", "application/grpc")
+
+	var err error
+	switch r.URL.Path {
+	case "/martd.Martd/Publish":
+		err = grpcUnary(w, r, s.grpcPublish)
+	case "/martd.Martd/PublishBatch":
+		err = grpcUnary(w, r, s.grpcPublishBatch)
+	case "/martd.Martd/Subscribe":
+		err = s.grpcSubscribe(w, r)
+	case "/martd.Martd/ListChannels":
+		err = grpcUnary(w, r, s.grpcListChannels)
+	case "/martd.Martd/DeleteChannel":
+		err = grpcUnary(w, r, s.grpcDeleteChannel)
+	default:
+		err = grpcErrorf(grpcUnimplemented, "unknown method %s", r.URL.Path)
+	}
+
+	code, msg := grpcOK, ""
+	if err != nil {
+		code, msg = grpcInternal, err.Error()
+		if ge, ok := err.(*grpcError); ok {
+			code = ge.code
+		}
+	}
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set(
+			http.TrailerPrefix+"Grpc-Message",
+			strings.Replace(url.QueryEscape(msg), "+", "%20", -1),
+		)
+	}
+}
+
+// grpcUnary reads the one request message of a call, and writes what h
+// returns for it.
+func grpcUnary(
+	w http.ResponseWriter, r *http.Request,
+	h func(r *http.Request, req []byte) ([]byte, error),
+) error {
+	req, err := grpcRead(r.Body)
+	if err != nil {
+		return err
+	}
+	resp, err := h(r, req)
+	if err != nil {
+		return err
+	}
+	return grpcWrite(w, resp)
+}
+
+// grpcRead reads a length prefixed message. Compression is not supported,
+// clients only compress if told they may.
+func grpcRead(r io.Reader) ([]byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "no request message")
+	}
+	if header[0] != 0 {
+		return nil, grpcErrorf(grpcUnimplemented, "compression is not supported")
+	}
+	n := binary.BigEndian.Uint32(header[1:])
+	if n > grpcMaxMessage {
+		return nil, grpcErrorf(grpcResourceExhausted, "message of %d bytes", n)
+	}
+
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "truncated request message")
+	}
+	return msg, nil
+}
+
+func grpcWrite(w http.ResponseWriter, msg []byte) error {
+	header := make([]byte, 5)
+	binary.BigEndian.PutUint32(header[1:], uint32(len(msg)))
+	if _, err := w.Write(append(header, msg...)); err != nil {
+		return err
+	}
+	w.(http.Flusher).Flush()
+	return nil
+}
+
+func (s *Server) grpcPublish(r *http.Request, req []byte) ([]byte, error) {
+	def, data, sync, err := decodePublish(req)
+	if err != nil {
+		return nil, err
+	}
+	etag, err := s.grpcPub(def, data, sync)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &pbWriter{}
+	resp.Int(1, etag)
+	return resp.b, nil
+}
+
+// grpcPublishBatch checks all messages before publishing any of them.
+func (s *Server) grpcPublishBatch(r *http.Request, req []byte) ([]byte, error) {
+	type pub struct {
+		def  *ChannelDef
+		data []byte
+		sync bool
+	}
+	pubs := []*pub{}
+	err := pbFields(req, func(field, wire int, v uint64, data []byte) error {
+		if field != 1 || wire != pbBytes {
+			return nil
+		}
+		def, data, sync, err := decodePublish(data)
+		if err != nil {
+			return err
+		}
+		pubs = append(pubs, &pub{def, data, sync})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	etags := []int64{}
+	for i, p := range pubs {
+		etag, err := s.grpcPub(p.def, p.data, p.sync)
+		if err != nil {
+			ge, ok := err.(*grpcError)
+			if !ok {
+				ge = &grpcError{grpcInternal, err.Error()}
+			}
+			return nil, grpcErrorf(
+				ge.code, "published %d of %d, then: %s", i, len(pubs), ge.msg,
+			)
+		}
+		etags = append(etags, etag)
+	}
+
+	resp := &pbWriter{}
+	resp.Ints(1, etags)
+	return resp.b, nil
+}
+
+// decodePublish decodes a PublishRequest, with the attributes /pub defaults
+// to for those not given.
+func decodePublish(b []byte) (*ChannelDef, []byte, bool, error) {
+	def := &ChannelDef{Size: DefaultSize, Life: DefaultLife}
+	body, sync := []byte(nil), false
+
+	err := pbFields(b, func(field, wire int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			def.Name = string(data)
+		case 2:
+			body = append([]byte(nil), data...)
+		case 3:
+			def.Size = uint(v)
+		case 4:
+			def.Life = time.Duration(v)
+		case 5:
+			def.One2One = v != 0
+		case 6:
+			def.Key = string(data)
+		case 7:
+			sync = v != 0
+		case 8:
+			def.History = uint(v)
+		case 9:
+			def.HistoryBytes = int64(v)
+		}
+		return nil
+	})
+	switch {
+	case err != nil:
+		err = grpcErrorf(grpcInvalidArgument, "%s", err)
+	case def.Name == "":
+		err = grpcErrorf(grpcInvalidArgument, "channel is required")
+	case def.Life < 0 || def.HistoryBytes < 0:
+		err = grpcErrorf(grpcInvalidArgument, "life and history_bytes must be >= 0")
+	}
+	return def, body, sync, err
+}
+
+func (s *Server) grpcPub(def *ChannelDef, data []byte, sync bool) (int64, error) {
+	if err := s.canPublish(def.Name); err != nil {
+		return 0, grpcErrorf(grpcFailedPrecondition, "%s", err)
+	}
+
+	etag, err := s.Publish(def, data, sync)
+	switch err {
+	case nil:
+		return etag, nil
+	case ErrInvalidKey:
+		return 0, grpcErrorf(grpcPermissionDenied, "%s", err)
+	case ErrHistoryTooSmall:
+		return 0, grpcErrorf(grpcInvalidArgument, "%s", err)
+	}
+	return 0, err
+}
+
+// grpcSubscribe sends the messages newer than the given etags, paging in
+// stored ones as long polling does, then all messages published to the
+// channels. It watches before reading what is retained, so nothing
+// published in between is missed, and skips what was already sent.
+func (s *Server) grpcSubscribe(w http.ResponseWriter, r *http.Request) error {
+	req, err := grpcRead(r.Body)
+	if err != nil {
+		return err
+	}
+
+	since := map[string]int64{}
+	err = pbFields(req, func(field, wire int, v uint64, data []byte) error {
+		if field != 1 || wire != pbBytes {
+			return nil
+		}
+		name, etag := "", int64(0)
+		err := pbFields(data, func(field, wire int, v uint64, data []byte) error {
+			switch field {
+			case 1:
+				name = string(data)
+			case 2:
+				etag = int64(v)
+			}
+			return nil
+		})
+		since[name] = etag
+		return err
+	})
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%s", err)
+	}
+	if len(since) == 0 {
+		return grpcErrorf(grpcInvalidArgument, "no channels")
+	}
+
+	names := []string{}
+	for name := range since {
+		if s.ring != nil && s.ring.Owner(name) != s.opts.ShardSelf {
+			return grpcErrorf(
+				grpcFailedPrecondition, "%s is on %s", name, s.ring.Owner(name),
+			)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	denied, err := s.Authorize(httpSubscriber("grpc", r), names)
+	if err != nil {
+		log.Println("Auth backend failed:", err)
+		return grpcErrorf(grpcUnavailable, "could not authorize")
+	}
+	if len(denied) != 0 {
+		return grpcErrorf(
+			grpcPermissionDenied, "not allowed: %s", strings.Join(denied, ", "),
+		)
+	}
+
+	s.nGRPCStreams.Add(1)
+	defer s.nGRPCStreams.Add(-1)
+
+	events := make(chan *ChannelEvent, GRPCQueue)
+	unwatch := s.Watch(func(name string) bool {
+		_, ok := since[name]
+		return ok
+	}, events)
+	s.watchNames(names, false)
+	defer func() {
+		unwatch()
+		s.watchNames(names, true)
+	}()
+
+	// the headers, so the client knows it is subscribed
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+
+	last := map[string]int64{}
+	send := func(name string, m *Message) error {
+		if m.Created <= last[name] {
+			return nil
+		}
+		last[name] = m.Created
+
+		msg := &pbWriter{}
+		msg.String(1, name)
+		msg.Int(2, m.Created)
+		msg.Bytes(3, m.Data)
+		return grpcWrite(w, msg.b)
+	}
+
+	for _, name := range names {
+		last[name] = since[name]
+		ch := s.LookupChannel(name)
+		if ch == nil {
+			continue
+		}
+		// as long polling does, in pages when behind the messages in memory
+		for {
+			etag := last[name]
+			more, ith, err := ch.HasNew(etag)
+			if err != nil {
+				return grpcErrorf(grpcUnavailable, "%s", err)
+			}
+			if !more {
+				break
+			}
+			for _, m := range ch.After(etag, ith) {
+				if err := send(name, m); err != nil {
+					return err
+				}
+			}
+			if last[name] == etag {
+				break // only older messages, from peers, were left
+			}
+		}
+	}
+
+	for {
+		select {
+		case ev := <-events:
+			if err := send(ev.Chan.Name, ev.Mesg); err != nil {
+				return err
+			}
+		case <-r.Context().Done():
+			return nil
+		case <-s.draining:
+			return grpcErrorf(grpcUnavailable, "server is shutting down")
+		}
+	}
+}
+
+func (s *Server) grpcListChannels(r *http.Request, req []byte) ([]byte, error) {
+	prefix := ""
+	err := pbFields(req, func(field, wire int, v uint64, data []byte) error {
+		if field == 1 {
+			prefix = string(data)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "%s", err)
+	}
+
+	resp := &pbWriter{}
+	for _, ch := range s.ListChannels(prefix) {
+		info := ch.Info()
+		oldest, _ := strconv.ParseInt(info.Oldest, 10, 64)
+		newest, _ := strconv.ParseInt(info.Newest, 10, 64)
+
+		msg := &pbWriter{}
+		msg.String(1, info.Name)
+		msg.Uint(2, uint64(info.Size))
+		msg.Int(3, int64(info.Life))
+		msg.Bool(4, info.One2One)
+		msg.Bool(5, info.HasKey)
+		msg.Int(6, info.Created)
+		msg.Uint(7, uint64(info.Messages))
+		msg.Int(8, int64(info.Bytes))
+		msg.Int(9, oldest)
+		msg.Int(10, newest)
+		msg.Uint(11, uint64(info.Subscribers))
+		msg.Uint(12, uint64(info.History))
+		msg.Int(13, info.HistoryBytes)
+		resp.Message(1, msg.b)
+	}
+	return resp.b, nil
+}
+
+// grpcDeleteChannel is /admin/delete, with the admin key as metadata.
+func (s *Server) grpcDeleteChannel(r *http.Request, req []byte) ([]byte, error) {
+	if s.opts.AdminKey == "" {
+		return nil, grpcErrorf(grpcPermissionDenied, "admin API is disabled")
+	}
+	if !authorized(r, s.opts.AdminKey) {
+		return nil, grpcErrorf(grpcUnauthenticated, "unauthorized")
+	}
+	if leader := s.Leader(); leader != "" {
+		return nil, grpcErrorf(
+			grpcFailedPrecondition, "read only follower of %s", leader,
+		)
+	}
+
+	name := ""
+	err := pbFields(req, func(field, wire int, v uint64, data []byte) error {
+		if field == 1 {
+			name = string(data)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "%s", err)
+	}
+	if name == "" {
+		return nil, grpcErrorf(grpcInvalidArgument, "channel is required")
+	}
+	if s.ring != nil && s.ring.Owner(name) != s.opts.ShardSelf {
+		return nil, grpcErrorf(
+			grpcFailedPrecondition, "%s is on %s", name, s.ring.Owner(name),
+		)
+	}
+	if !s.DeleteChannel(name) {
+		return nil, grpcErrorf(grpcNotFound, "no such channel: %s", name)
+	}
+
+	resp := &pbWriter{}
+	resp.Bool(1, true)
+	return resp.b, nil
+}
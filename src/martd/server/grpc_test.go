@@ -0,0 +1,196 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// The gRPC tests speak the wire protocol over plain text HTTP/2 (h2c) with
+// net/http, as a client generated from martd.proto does: length prefixed
+// messages, and the status in the trailers.
+
+func newGRPCTest(t *testing.T) (*Server, *httptest.Server, *http.Client) {
+	t.Helper()
+
+	s := newTestServer(t, nil)
+	protocols := &http.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(s.GRPCHandler))
+	ts.Config.Protocols = protocols
+	ts.Start()
+	t.Cleanup(ts.Close)
+
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+	return s, ts, client
+}
+
+func grpcFrame(msg []byte) []byte {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// grpcCall makes a call and returns the messages of the response, and the
+// status from the trailers.
+func grpcCall(
+	t *testing.T, ts *httptest.Server, client *http.Client, method string,
+	req []byte,
+) ([][]byte, int, string) {
+	t.Helper()
+
+	resp := grpcStart(t, context.Background(), ts, client, method, req)
+	defer resp.Body.Close()
+
+	msgs := [][]byte{}
+	for {
+		msg, err := grpcRead(resp.Body)
+		if err != nil {
+			break
+		}
+		msgs = append(msgs, msg)
+	}
+	io.Copy(io.Discard, resp.Body)
+
+	code, err := strconv.Atoi(resp.Trailer.Get("Grpc-Status"))
+	if err != nil {
+		t.Fatalf("%s: no grpc-status in %v", method, resp.Trailer)
+	}
+	return msgs, code, resp.Trailer.Get("Grpc-Message")
+}
+
+func grpcStart(
+	t *testing.T, ctx context.Context, ts *httptest.Server,
+	client *http.Client, method string, req []byte,
+) *http.Response {
+	t.Helper()
+
+	r, err := http.NewRequestWithContext(
+		ctx, "POST", ts.URL+"/martd.Martd/"+method,
+		bytes.NewReader(grpcFrame(req)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "application/grpc")
+	r.Header.Set("TE", "trailers")
+
+	resp, err := client.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("%s over %s, not HTTP/2", method, resp.Proto)
+	}
+	return resp
+}
+
+func grpcPublishTest(
+	t *testing.T, ts *httptest.Server, client *http.Client, channel,
+	data string,
+) int64 {
+	t.Helper()
+
+	req := &pbWriter{}
+	req.String(1, channel)
+	req.String(2, data)
+	msgs, code, msg := grpcCall(t, ts, client, "Publish", req.b)
+	if code != grpcOK || len(msgs) != 1 {
+		t.Fatalf("Publish: status %d %q, %d messages", code, msg, len(msgs))
+	}
+
+	etag := int64(0)
+	pbFields(msgs[0], func(field, wire int, v uint64, data []byte) error {
+		if field == 1 {
+			etag = int64(v)
+		}
+		return nil
+	})
+	return etag
+}
+
+func TestGRPCPublish(t *testing.T) {
+	s, ts, client := newGRPCTest(t)
+
+	etag := grpcPublishTest(t, ts, client, "news", "hello")
+	ch := s.LookupChannel("news")
+	if ch == nil {
+		t.Fatal("Publish did not create the channel")
+	}
+	msgs, _, _ := ch.History(0, 0, 10)
+	if len(msgs) != 1 || msgs[0].Created != etag ||
+		string(msgs[0].Data) != "hello" {
+		t.Fatalf("channel has %v, published %d", msgs, etag)
+	}
+
+	_, code, _ := grpcCall(t, ts, client, "Publish", []byte{0x12, 1, 'x'})
+	if code != grpcInvalidArgument {
+		t.Fatalf("Publish without channel: status %d", code)
+	}
+	_, code, _ = grpcCall(t, ts, client, "Nope", nil)
+	if code != grpcUnimplemented {
+		t.Fatalf("unknown method: status %d", code)
+	}
+}
+
+func TestGRPCSubscribe(t *testing.T) {
+	_, ts, client := newGRPCTest(t)
+
+	first := grpcPublishTest(t, ts, client, "news", "one")
+	grpcPublishTest(t, ts, client, "news", "two")
+
+	// SubscribeRequest{channels: {"news": first}}, a map is a repeated
+	// message of key and value
+	entry := &pbWriter{}
+	entry.String(1, "news")
+	entry.Int(2, first)
+	req := &pbWriter{}
+	req.Message(1, entry.b)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp := grpcStart(t, ctx, ts, client, "Subscribe", req.b)
+	defer resp.Body.Close()
+
+	next := func() (string, int64, string) {
+		t.Helper()
+
+		msg, err := grpcRead(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		channel, etag, data := "", int64(0), ""
+		pbFields(msg, func(field, wire int, v uint64, b []byte) error {
+			switch field {
+			case 1:
+				channel = string(b)
+			case 2:
+				etag = int64(v)
+			case 3:
+				data = string(b)
+			}
+			return nil
+		})
+		return channel, etag, data
+	}
+
+	// resumes after the etag it was given
+	if channel, etag, data := next(); channel != "news" || data != "two" ||
+		etag <= first {
+		t.Fatalf("got %s %d %q", channel, etag, data)
+	}
+
+	// then streams what is published
+	third := grpcPublishTest(t, ts, client, "news", "three")
+	if channel, etag, data := next(); channel != "news" || data != "three" ||
+		etag != third {
+		t.Fatalf("got %s %d %q, published %d", channel, etag, data, third)
+	}
+}
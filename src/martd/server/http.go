@@ -0,0 +1,499 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidKey      = errors.New("invalid key")
+	ErrHistoryTooSmall = errors.New("history must not be smaller than size")
+)
+
+type ChanResponse struct {
+	Etag    string   `json:"etag"`
+	Payload []string `json:"payload"`
+}
+
+type SubResponse struct {
+	Channels map[string]*ChanResponse `json:"channels,omitempty"`
+	Error    string                   `json:"error,omitempty"`
+	Shards   map[string]string        `json:"shards,omitempty"` // channel: node
+}
+
+type HistoryMessage struct {
+	Etag    string    `json:"etag"`
+	Time    time.Time `json:"time"`
+	Payload string    `json:"payload"`
+}
+
+type HistoryResponse struct {
+	Channel  string            `json:"channel"`
+	Messages []*HistoryMessage `json:"messages"`
+	More     bool              `json:"more"`
+}
+
+type StatsResponse struct {
+	Channel *ChannelInfo  `json:"channel"`
+	Stats   *ChannelStats `json:"stats"`
+}
+
+type ListResponse struct {
+	Channels []*ChannelInfo `json:"channels"`
+	Total    int            `json:"total"`
+	Offset   int            `json:"offset"`
+	Limit    int            `json:"limit"`
+}
+
+const (
+	// attributes of channels created without them
+	DefaultSize = 10
+	DefaultLife = time.Hour
+
+	DefaultHistoryLimit = 100
+	MaxHistoryLimit     = 1000
+	DefaultListLimit    = 100
+	MaxListLimit        = 1000
+)
+
+func (s *Server) reject(w http.ResponseWriter, reason string) {
+	s.rejectWith(w, reason, http.StatusBadRequest)
+}
+
+func (s *Server) rejectWith(w http.ResponseWriter, reason string, status int) {
+	if s.opts.Origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", s.opts.Origin)
+	}
+	j, err := json.Marshal(SubResponse{Error: reason})
+	if err != nil {
+		log.Println("Error during json.Marshal", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Error(w, string(j), status)
+}
+
+// authorize checks with AuthURL that r may subscribe to channels, and
+// rejects it if not.
+func (s *Server) authorize(
+	w http.ResponseWriter, r *http.Request, channels []string,
+) bool {
+	denied, err := s.Authorize(httpSubscriber("http", r), channels)
+	if err != nil {
+		log.Println("Auth backend failed:", err)
+		s.rejectWith(w, "could not authorize", http.StatusServiceUnavailable)
+		return false
+	}
+	if len(denied) != 0 {
+		s.rejectWith(
+			w, "not allowed: "+strings.Join(denied, ", "), http.StatusForbidden,
+		)
+		return false
+	}
+	return true
+}
+
+func (s *Server) respond(w http.ResponseWriter, resp *SubResponse) {
+	s.respondJSON(w, resp)
+}
+
+func (s *Server) respondJSON(w http.ResponseWriter, v interface{}) {
+	if s.opts.Origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", s.opts.Origin)
+	}
+	j, err := json.Marshal(v)
+	if err != nil {
+		log.Println("Error during json.Marshal", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+// Publish creates the channel of def if it does not exist and publishes data
+// to it, if not empty, with PubSync if sync is set, and returns its etag.
+// def.Key must be the key of the channel, if it has one. Like the
+// protocols other than HTTP, it fails on a follower, or for a channel of
+// another shard.
+func (s *Server) Publish(def *ChannelDef, data []byte, sync bool) (int64, error) {
+	if err := s.canPublish(def.Name); err != nil {
+		return 0, err
+	}
+	if def.History != 0 && def.History < def.Size {
+		return 0, ErrHistoryTooSmall
+	}
+
+	ch, err := s.GetOrCreateChannel(def)
+	if err != nil {
+		return 0, err
+	}
+	if ch.Key != "" && ch.Key != def.Key {
+		return 0, ErrInvalidKey
+	}
+
+	if len(data) == 0 {
+		return 0, nil
+	}
+	if !sync {
+		return ch.Pub(data), nil
+	}
+	etag, err := ch.PubSync(data)
+	if err != nil {
+		return etag, fmt.Errorf("published as %d, not persisted: %s", etag, err)
+	}
+	return etag, nil
+}
+
+func (s *Server) PubHandler(w http.ResponseWriter, r *http.Request) {
+	if s.opts.Origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", s.opts.Origin)
+	}
+	s.nPubAll.Add(1)
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.reject(w, err.Error())
+		return
+	}
+
+	if leader := s.Leader(); leader != "" {
+		s.reject(w, "read only follower of "+leader)
+		return
+	}
+
+	channel := r.FormValue("channel") // TODO: support multiple channels
+	size_s := r.FormValue("size")
+	life_s := r.FormValue("life")
+	one2one := r.FormValue("one2one") == "true"
+	key := r.FormValue("key")
+
+	if channel == "" {
+		s.reject(w, "channel is required")
+		return
+	}
+
+	size := uint(DefaultSize)
+	if size_s != "" {
+		_, err := fmt.Sscan(size_s, &size)
+		if err != nil {
+			s.reject(w, "invalid size: "+err.Error())
+			return
+		}
+	}
+
+	life := DefaultLife
+	if life_s != "" {
+		_, err := fmt.Sscan(life_s, &life)
+		if err != nil {
+			s.reject(w, "invalid life: "+err.Error())
+			return
+		}
+	}
+
+	history := uint(0)
+	if history_s := r.FormValue("history"); history_s != "" {
+		_, err := fmt.Sscan(history_s, &history)
+		if err != nil {
+			s.reject(w, "invalid history: "+err.Error())
+			return
+		}
+	}
+
+	historyBytes := int64(0)
+	if bytes_s := r.FormValue("history_bytes"); bytes_s != "" {
+		_, err := fmt.Sscan(bytes_s, &historyBytes)
+		if err != nil || historyBytes < 0 {
+			s.reject(w, "invalid history_bytes: "+bytes_s)
+			return
+		}
+	}
+
+	etag, err := s.Publish(&ChannelDef{
+		Name: channel, Size: size, Life: life, One2One: one2one, Key: key,
+		History: history, HistoryBytes: historyBytes,
+	}, body, r.FormValue("sync") == "true")
+	if err != nil {
+		s.reject(w, err.Error())
+		return
+	}
+
+	j, err := json.MarshalIndent(
+		map[string]string{"etag": fmt.Sprintf("%d", etag)}, " ", "    ",
+	)
+
+	if err != nil {
+		s.reject(w, err.Error())
+		return
+	}
+
+	fmt.Fprintf(w, "%s", j)
+}
+
+func (s *Server) SubHandler(w http.ResponseWriter, r *http.Request) {
+	s.nSub.Add(1)
+	s.nSubAll.Add(1)
+	defer s.nSub.Add(-1)
+
+	r.ParseForm()
+	if !s.authorize(w, r, subChannels(r.Form)) {
+		return
+	}
+	evch := make(chan *ChannelEvent)
+
+	subs := make([]*Channel, 0)
+	resp := &SubResponse{Channels: make(map[string]*ChanResponse)}
+
+	for k := range r.Form {
+		if k == "cid" {
+			continue
+		}
+		v := r.FormValue(k)
+		if v == "" {
+			s.reject(w, k+" has no etag")
+			return
+		}
+
+		etag := int64(0)
+		_, err := fmt.Sscan(v, &etag)
+		if err != nil {
+			s.reject(w, "invalid etag: "+err.Error())
+			return
+		}
+
+		ch := s.GetChannel(k)
+		has, ith, err := ch.HasNew(etag)
+		if err != nil {
+			s.rejectWith(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if has {
+			ch.Append(resp, etag, ith)
+		} else {
+			subs = append(subs, ch)
+		}
+	}
+
+	if len(resp.Channels) != 0 {
+		s.respond(w, resp)
+		return
+	}
+
+	// sub everything
+	for _, ch := range subs {
+		ch.Sub(evch)
+	}
+
+	cner, ok := w.(http.CloseNotifier)
+	if !ok {
+		s.reject(w, "server issue, handler does not support CloseNotifier")
+		return
+	}
+
+	select {
+	case cm := <-evch:
+		if cm.Mesg == nil {
+			s.reject(w, cm.Chan.Name+" was deleted")
+			break
+		}
+		resp.Channels[cm.Chan.Name] = &ChanResponse{
+			fmt.Sprintf("%d", cm.Mesg.Created), []string{string(cm.Mesg.Data)},
+		}
+		s.respond(w, resp)
+	case <-cner.CloseNotify():
+	case <-s.draining:
+		s.rejectWith(w, "server is shutting down", http.StatusServiceUnavailable)
+	}
+
+	for _, ch := range subs {
+		ch.UnSub(evch)
+	}
+}
+
+func (s *Server) HistoryHandler(w http.ResponseWriter, r *http.Request) {
+	s.nHistory.Add(1)
+
+	channel := r.FormValue("channel")
+	if channel == "" {
+		s.reject(w, "channel is required")
+		return
+	}
+	if !s.authorize(w, r, []string{channel}) {
+		return
+	}
+
+	since := int64(0)
+	if v := r.FormValue("since"); v != "" {
+		_, err := fmt.Sscan(v, &since)
+		if err != nil {
+			s.reject(w, "invalid since: "+err.Error())
+			return
+		}
+	}
+
+	until := int64(0)
+	if v := r.FormValue("until"); v != "" {
+		_, err := fmt.Sscan(v, &until)
+		if err != nil {
+			s.reject(w, "invalid until: "+err.Error())
+			return
+		}
+	}
+
+	limit := uint(DefaultHistoryLimit)
+	if v := r.FormValue("limit"); v != "" {
+		_, err := fmt.Sscan(v, &limit)
+		if err != nil {
+			s.reject(w, "invalid limit: "+err.Error())
+			return
+		}
+	}
+	if limit == 0 || limit > MaxHistoryLimit {
+		limit = MaxHistoryLimit
+	}
+
+	resp := &HistoryResponse{Channel: channel, Messages: []*HistoryMessage{}}
+
+	// LookupChannel, not GetChannel: reading history must not create channels
+	if ch := s.LookupChannel(channel); ch != nil {
+		msgs, more, err := ch.History(since, until, limit)
+		if err != nil {
+			s.rejectWith(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		for _, m := range msgs {
+			resp.Messages = append(resp.Messages, &HistoryMessage{
+				fmt.Sprintf("%d", m.Created), time.Unix(0, m.Created),
+				string(m.Data),
+			})
+		}
+		resp.More = more
+	}
+
+	s.respondJSON(w, resp)
+}
+
+func (s *Server) ListHandler(w http.ResponseWriter, r *http.Request) {
+	s.nList.Add(1)
+
+	offset := 0
+	if v := r.FormValue("offset"); v != "" {
+		_, err := fmt.Sscan(v, &offset)
+		if err != nil || offset < 0 {
+			s.reject(w, "invalid offset")
+			return
+		}
+	}
+
+	limit := DefaultListLimit
+	if v := r.FormValue("limit"); v != "" {
+		_, err := fmt.Sscan(v, &limit)
+		if err != nil {
+			s.reject(w, "invalid limit: "+err.Error())
+			return
+		}
+	}
+	if limit <= 0 || limit > MaxListLimit {
+		limit = MaxListLimit
+	}
+
+	one2one := r.FormValue("one2one")
+	if one2one != "" && one2one != "true" && one2one != "false" {
+		s.reject(w, "invalid one2one: must be true or false")
+		return
+	}
+	nonempty := r.FormValue("nonempty") == "true"
+
+	infos := []*ChannelInfo{}
+	for _, ch := range s.ListChannels(r.FormValue("prefix")) {
+		info := ch.Info()
+		if one2one != "" && info.One2One != (one2one == "true") {
+			continue
+		}
+		if nonempty && info.Messages == 0 {
+			continue
+		}
+		infos = append(infos, info)
+	}
+
+	resp := &ListResponse{
+		Channels: []*ChannelInfo{},
+		Total:    len(infos),
+		Offset:   offset,
+		Limit:    limit,
+	}
+	if offset < len(infos) {
+		end := offset + limit
+		if end > len(infos) {
+			end = len(infos)
+		}
+		resp.Channels = infos[offset:end]
+	}
+
+	s.respondJSON(w, resp)
+}
+
+func (s *Server) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	channel := r.FormValue("channel")
+	if channel == "" {
+		s.reject(w, "channel is required")
+		return
+	}
+
+	ch := s.LookupChannel(channel)
+	if ch == nil {
+		s.reject(w, "no such channel: "+channel)
+		return
+	}
+
+	s.respondJSON(w, &StatsResponse{ch.Info(), ch.Stats()})
+}
+
+// HealthHandler responds 200 if persistence is healthy, 503 otherwise.
+func (s *Server) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	health := s.health.Get()
+	j, err := json.Marshal(map[string]interface{}{"persist": health})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !health.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(j)
+}
+
+// routes sets up mux, for ServeHTTP.
+func (s *Server) routes() {
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("/list", s.ListHandler)
+	s.mux.HandleFunc(
+		"/history", s.Sharded(s.HistoryHandler, channelParam, true),
+	)
+	s.mux.HandleFunc("/metrics", s.MetricsHandler)
+	s.mux.HandleFunc("/stats", s.Sharded(s.StatsHandler, channelParam, true))
+	s.mux.HandleFunc("/shards", s.ShardsHandler)
+	s.mux.HandleFunc("/health", s.HealthHandler)
+	s.mux.HandleFunc(
+		"/admin/delete",
+		s.Sharded(s.AdminHandler(s.AdminDeleteHandler), channelParam, true),
+	)
+	s.mux.HandleFunc(
+		"/admin/purge",
+		s.Sharded(s.AdminHandler(s.AdminPurgeHandler), channelParam, true),
+	)
+	s.mux.HandleFunc("/admin/promote", s.AdminHandler(s.AdminPromoteHandler))
+	s.mux.HandleFunc("/cluster/pub", s.ClusterPubHandler)
+	s.mux.HandleFunc("/cluster/replicate", s.ReplicateHandler)
+	s.mux.HandleFunc("/pub", s.Sharded(s.PubHandler, channelParam, false))
+	s.mux.HandleFunc("/sub", s.Sharded(s.SubHandler, subChannels, true))
+	s.mux.Handle("/", http.FileServer(FS(s.opts.Debug)))
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// getJSON has s serve a GET of target, decodes the body into v, and returns
+// the status.
+func getJSON(t *testing.T, s *Server, target string, v interface{}) int {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("GET %s: %s: %s", target, err, w.Body)
+	}
+	return w.Code
+}
+
+func TestHistoryHandler(t *testing.T) {
+	s := newTestServer(t, nil)
+	def := &ChannelDef{Name: "c", Size: 10, Life: time.Hour, One2One: true}
+	testChannel(t, s, def, 5)
+
+	hr := &HistoryResponse{}
+	code := getJSON(t, s, "/history?channel=c&limit=2", hr)
+	if code != http.StatusOK {
+		t.Fatalf("got %d", code)
+	}
+	if len(hr.Messages) != 2 || hr.Messages[0].Payload != "4" ||
+		hr.Messages[1].Payload != "5" || !hr.More {
+		t.Fatalf("newest 2: %+v", hr)
+	}
+
+	// paging backwards, from the etag of the first message
+	until := hr.Messages[0].Etag
+	hr = &HistoryResponse{}
+	getJSON(t, s, "/history?channel=c&limit=2&until="+until, hr)
+	if len(hr.Messages) != 2 || hr.Messages[0].Payload != "2" || !hr.More {
+		t.Fatalf("page before %s: %+v", until, hr)
+	}
+
+	// reading history does not empty a one2one channel
+	hr = &HistoryResponse{}
+	getJSON(t, s, "/history?channel=c&since=0", hr)
+	if len(hr.Messages) != 5 || hr.More {
+		t.Fatalf("all: %+v", hr)
+	}
+
+	// nor does it create channels
+	hr = &HistoryResponse{}
+	getJSON(t, s, "/history?channel=none", hr)
+	if len(hr.Messages) != 0 || s.LookupChannel("none") != nil {
+		t.Fatalf("unknown channel: %+v", hr)
+	}
+
+	sr := &SubResponse{}
+	code = getJSON(t, s, "/history?channel=c&since=x", sr)
+	if code != http.StatusBadRequest || sr.Error == "" {
+		t.Fatalf("bad since: %d %+v", code, sr)
+	}
+	if code = getJSON(t, s, "/history", sr); code != http.StatusBadRequest {
+		t.Fatalf("no channel: %d", code)
+	}
+}
+
+func TestListHandler(t *testing.T) {
+	s := newTestServer(t, nil)
+	a1 := testChannel(t, s, &ChannelDef{
+		Name: "a1", Size: 10, Life: time.Hour, Key: "s3cret",
+	}, 2)
+	testChannel(t, s, &ChannelDef{
+		Name: "a2", Size: 10, Life: time.Hour, One2One: true,
+	}, 0)
+	testChannel(t, s, &ChannelDef{Name: "b", Size: 10, Life: time.Hour}, 1)
+	evch := make(chan *ChannelEvent, 1)
+	a1.Sub(evch)
+	defer a1.UnSub(evch)
+
+	lr := &ListResponse{}
+	if code := getJSON(t, s, "/list?prefix=a", lr); code != http.StatusOK {
+		t.Fatalf("got %d", code)
+	}
+	if lr.Total != 2 || len(lr.Channels) != 2 {
+		t.Fatalf("prefix a: %+v", lr)
+	}
+	info := lr.Channels[0]
+	newest := a1.Newest()
+	if info.Name != "a1" || !info.HasKey || info.Messages != 2 ||
+		info.Bytes != 2 || info.Subscribers != 1 || info.Oldest == "" ||
+		info.Newest != fmt.Sprint(newest.Created) {
+		t.Fatalf("a1: %+v", info)
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/list", nil))
+	if strings.Contains(w.Body.String(), "s3cret") {
+		t.Fatalf("key listed: %s", w.Body)
+	}
+
+	for target, want := range map[string]string{
+		"/list?nonempty=true":          "a1 b",
+		"/list?one2one=true":           "a2",
+		"/list?offset=1&limit=1":       "a2",
+		"/list?prefix=a&nonempty=true": "a1",
+	} {
+		lr := &ListResponse{}
+		getJSON(t, s, target, lr)
+		names := []string{}
+		for _, info := range lr.Channels {
+			names = append(names, info.Name)
+		}
+		if got := strings.Join(names, " "); got != want {
+			t.Errorf("%s: got %q, want %q", target, got, want)
+		}
+	}
+
+	sr := &SubResponse{}
+	code := getJSON(t, s, "/list?one2one=yes", sr)
+	if code != http.StatusBadRequest || sr.Error == "" {
+		t.Fatalf("bad one2one: %d %+v", code, sr)
+	}
+}
+
+func TestStatsHandler(t *testing.T) {
+	s := newTestServer(t, func(o *Options) {
+		o.MetricsChannels = []string{"c"}
+	})
+	ch, _ := s.GetOrCreateChannel(
+		&ChannelDef{Name: "c", Size: 2, Life: time.Hour},
+	)
+	s.GetOrCreateChannel(&ChannelDef{Name: "d", Size: 2, Life: time.Hour})
+	for i := 0; i < 2; i++ {
+		ch.Sub(make(chan *ChannelEvent, 1))
+	}
+	for _, data := range []string{"ab", "c", "d"} {
+		ch.Pub([]byte(data))
+	}
+	ch.ExpireOldMessages(time.Now().Add(2 * time.Hour).UnixNano())
+
+	sr := &StatsResponse{}
+	if code := getJSON(t, s, "/stats?channel=c", sr); code != http.StatusOK {
+		t.Fatalf("got %d", code)
+	}
+	stats := sr.Stats
+	if stats.Published != 3 || stats.BytesIn != 4 || stats.Delivered != 2 ||
+		stats.Dropped != 1 || stats.Expired != 2 ||
+		stats.PeakSubscribers != 2 || stats.LastPublish == nil {
+		t.Fatalf("stats %+v", stats)
+	}
+	if sr.Channel.Name != "c" || sr.Channel.Messages != 0 {
+		t.Fatalf("channel %+v", sr.Channel)
+	}
+
+	// expvar has the channels of MetricsChannels only
+	vars := s.Stats().(map[string]interface{})
+	channels := vars["channels"].(map[string]*ChannelStats)
+	if len(channels) != 1 || channels["c"].Published != 3 {
+		t.Fatalf("expvar channels %+v", channels)
+	}
+
+	code := getJSON(t, s, "/stats?channel=none", &SubResponse{})
+	if code != http.StatusBadRequest {
+		t.Fatalf("unknown channel: %d", code)
+	}
+}
@@ -0,0 +1,386 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Histogram is a prometheus style histogram, partitioned by a label value.
+type Histogram struct {
+	lock    sync.Mutex
+	buckets []float64
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func NewHistogram(buckets ...float64) *Histogram {
+	return &Histogram{buckets: buckets, series: map[string]*histogramSeries{}}
+}
+
+func (h *Histogram) Observe(label string, d time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	s, ok := h.series[label]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[label] = s
+	}
+
+	v := d.Seconds()
+	for i, le := range h.buckets {
+		if v <= le {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *Histogram) write(b *bytes.Buffer, name, label string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	values := make([]string, 0, len(h.series))
+	for v := range h.series {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+
+	for _, v := range values {
+		s := h.series[v]
+		for i, le := range h.buckets {
+			fmt.Fprintf(
+				b, "%s_bucket{%s=\"%s\",le=\"%g\"} %d\n",
+				name, label, escapeLabel(v), le, s.counts[i],
+			)
+		}
+		fmt.Fprintf(
+			b, "%s_bucket{%s=\"%s\",le=\"+Inf\"} %d\n",
+			name, label, escapeLabel(v), s.count,
+		)
+		fmt.Fprintf(b, "%s_sum{%s=\"%s\"} %g\n", name, label, escapeLabel(v), s.sum)
+		fmt.Fprintf(b, "%s_count{%s=\"%s\"} %d\n", name, label, escapeLabel(v), s.count)
+	}
+}
+
+func escapeLabel(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, `"`, `\"`, -1)
+	return strings.Replace(v, "\n", `\n`, -1)
+}
+
+func metric(b *bytes.Buffer, name, kind, help string, v interface{}) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, v)
+}
+
+func (s *Server) metricsChannel(name string) bool {
+	for _, prefix := range s.opts.MetricsChannels {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// MetricsHandler serves the server metrics in prometheus text format.
+func (s *Server) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	b := &bytes.Buffer{}
+
+	s.chanLock.RLock()
+	chans := len(s.channels)
+	s.chanLock.RUnlock()
+
+	// totals are kept as messages come and go, only the channels asked for
+	// are looked at
+	rows := []*channelRow{}
+	if len(s.opts.MetricsChannels) != 0 {
+		for _, ch := range s.ListChannels("") {
+			if s.metricsChannel(ch.Name) {
+				rows = append(rows, &channelRow{ch.Info(), ch.Stats()})
+			}
+		}
+	}
+
+	metric(b, "martd_channels", "gauge", "Channels in memory.", chans)
+	metric(
+		b, "martd_messages", "gauge", "Messages retained.",
+		s.nMessages.Value(),
+	)
+	metric(
+		b, "martd_message_bytes", "gauge", "Payload bytes retained.",
+		s.nMessageBytes.Value(),
+	)
+	metric(
+		b, "martd_publish_requests_total", "counter", "Requests to /pub.",
+		s.nPubAll.Value(),
+	)
+	metric(
+		b, "martd_published_total", "counter", "Messages published.",
+		s.nPublished.Value(),
+	)
+	metric(
+		b, "martd_published_bytes_total", "counter",
+		"Payload bytes published.", s.nBytesIn.Value(),
+	)
+	metric(
+		b, "martd_delivered_total", "counter",
+		"Messages delivered to subscribers.", s.nDelivered.Value(),
+	)
+	metric(
+		b, "martd_expired_total", "counter", "Messages dropped for age.",
+		s.nExpired.Value(),
+	)
+	metric(
+		b, "martd_dropped_total", "counter",
+		"Messages dropped from full channel buffers.", s.nDropped.Value(),
+	)
+	metric(
+		b, "martd_subscribe_requests_total", "counter", "Requests to /sub.",
+		s.nSubAll.Value(),
+	)
+	metric(
+		b, "martd_active_subscribers", "gauge",
+		"Requests to /sub currently in progress.", s.nSub.Value(),
+	)
+	if s.opts.RedisAddr != "" {
+		metric(
+			b, "martd_redis_connections", "gauge",
+			"Redis protocol clients connected.", s.nRedisConns.Value(),
+		)
+	}
+	if s.opts.MQTTAddr != "" || s.opts.MQTTWSAddr != "" {
+		metric(
+			b, "martd_mqtt_connections", "gauge",
+			"MQTT clients connected.", s.nMQTTConns.Value(),
+		)
+	}
+	if s.opts.GRPCAddr != "" {
+		metric(
+			b, "martd_grpc_calls_total", "counter", "gRPC calls made.",
+			s.nGRPCCalls.Value(),
+		)
+		metric(
+			b, "martd_grpc_subscribers", "gauge",
+			"gRPC Subscribe calls in progress.", s.nGRPCStreams.Value(),
+		)
+	}
+	metric(
+		b, "martd_watch_dropped_total", "counter",
+		"Messages dropped for subscribers too slow to take them.",
+		s.nWatchDropped.Value(),
+	)
+	metric(
+		b, "martd_persist_queue_depth", "gauge",
+		"Operations waiting for the persister.", len(s.persistChan),
+	)
+	health := s.health.Get()
+	healthy := 0
+	if health.Healthy {
+		healthy = 1
+	}
+	metric(
+		b, "martd_persist_healthy", "gauge",
+		"1 if storage is working, 0 while operations are being retried.",
+		healthy,
+	)
+	metric(
+		b, "martd_persist_backlog", "gauge",
+		"Operations waiting to be retried.", health.Backlog,
+	)
+	metric(
+		b, "martd_persist_batches_total", "counter",
+		"Batches committed to storage.", s.nPersistBatches.Value(),
+	)
+	metric(
+		b, "martd_persist_errors_total", "counter", "Failed storage operations.",
+		s.nPersistErrors.Value(),
+	)
+	metric(
+		b, "martd_persist_dropped_total", "counter",
+		"Operations dropped from a full backlog, never persisted.",
+		s.nPersistDropped.Value(),
+	)
+	metric(
+		b, "martd_uptime_seconds", "gauge", "Seconds since start.",
+		int64(time.Since(s.start).Seconds()),
+	)
+
+	b.WriteString("# HELP martd_persist_seconds Time spent on storage operations.\n")
+	b.WriteString("# TYPE martd_persist_seconds histogram\n")
+	s.latency.write(b, "martd_persist_seconds", "op")
+
+	if len(rows) != 0 {
+		channelMetrics(b, rows)
+	}
+	if s.opts.ClusterKey != "" {
+		repl := s.GetReplicationStatus()
+		metric(
+			b, "martd_replication_seq", "gauge",
+			"Last operation in this node's replication log.", repl.Seq,
+		)
+		metric(
+			b, "martd_followers", "gauge", "Followers streaming from this node.",
+			repl.Followers,
+		)
+		if repl.Role == "follower" {
+			connected := 0
+			if repl.Connected {
+				connected = 1
+			}
+			metric(
+				b, "martd_follower_connected", "gauge",
+				"1 while replicating the leader.", connected,
+			)
+			metric(
+				b, "martd_follower_leader_seq", "gauge",
+				"Last leader operation applied.", repl.LeaderSeq,
+			)
+		}
+	}
+	if len(s.peers) != 0 {
+		metric(
+			b, "martd_received_total", "counter",
+			"Messages received from peers.", s.nReceived.Value(),
+		)
+		peerMetrics(b, s.PeerStatuses())
+	}
+	if len(s.hooks) != 0 {
+		webhookMetrics(b, s.WebhookStatuses())
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(b.Bytes())
+}
+
+type channelRow struct {
+	info  *ChannelInfo
+	stats *ChannelStats
+}
+
+func channelMetrics(b *bytes.Buffer, rows []*channelRow) {
+	series := func(name, kind, help string, value func(*channelRow) interface{}) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, row := range rows {
+			fmt.Fprintf(
+				b, "%s{channel=\"%s\"} %v\n", name, escapeLabel(row.info.Name),
+				value(row),
+			)
+		}
+	}
+
+	series(
+		"martd_channel_messages", "gauge", "Messages retained in channel.",
+		func(r *channelRow) interface{} { return r.info.Messages },
+	)
+	series(
+		"martd_channel_message_bytes", "gauge",
+		"Payload bytes retained in channel.",
+		func(r *channelRow) interface{} { return r.info.Bytes },
+	)
+	series(
+		"martd_channel_subscribers", "gauge", "Clients waiting on channel.",
+		func(r *channelRow) interface{} { return r.info.Subscribers },
+	)
+	series(
+		"martd_channel_published_total", "counter",
+		"Messages published to channel.",
+		func(r *channelRow) interface{} { return r.stats.Published },
+	)
+	series(
+		"martd_channel_published_bytes_total", "counter",
+		"Payload bytes published to channel.",
+		func(r *channelRow) interface{} { return r.stats.BytesIn },
+	)
+	series(
+		"martd_channel_delivered_total", "counter",
+		"Messages delivered to channel subscribers.",
+		func(r *channelRow) interface{} { return r.stats.Delivered },
+	)
+	series(
+		"martd_channel_expired_total", "counter",
+		"Messages dropped from channel for age.",
+		func(r *channelRow) interface{} { return r.stats.Expired },
+	)
+	series(
+		"martd_channel_dropped_total", "counter",
+		"Messages dropped from full channel buffer.",
+		func(r *channelRow) interface{} { return r.stats.Dropped },
+	)
+}
+
+func peerMetrics(b *bytes.Buffer, statuses []*PeerStatus) {
+	series := func(name, kind, help string, value func(*PeerStatus) interface{}) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, status := range statuses {
+			fmt.Fprintf(
+				b, "%s{peer=\"%s\"} %v\n", name, escapeLabel(status.URL),
+				value(status),
+			)
+		}
+	}
+
+	series(
+		"martd_peer_up", "gauge", "1 if the last request to the peer worked.",
+		func(s *PeerStatus) interface{} {
+			if s.Up {
+				return 1
+			}
+			return 0
+		},
+	)
+	series(
+		"martd_peer_queued", "gauge", "Messages waiting to be sent to the peer.",
+		func(s *PeerStatus) interface{} { return s.Queued },
+	)
+	series(
+		"martd_peer_forwarded_total", "counter", "Messages sent to the peer.",
+		func(s *PeerStatus) interface{} { return s.Forwarded },
+	)
+	series(
+		"martd_peer_dropped_total", "counter",
+		"Messages dropped from the peer's full queue, never sent.",
+		func(s *PeerStatus) interface{} { return s.Dropped },
+	)
+}
+
+func webhookMetrics(b *bytes.Buffer, statuses []*WebhookStatus) {
+	series := func(name, kind, help string, value func(*WebhookStatus) interface{}) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, status := range statuses {
+			fmt.Fprintf(
+				b, "%s{webhook=\"%d\",host=\"%s\"} %v\n", name,
+				status.Webhook, escapeLabel(status.Host), value(status),
+			)
+		}
+	}
+
+	series(
+		"martd_webhook_queued", "gauge", "Events waiting to be sent.",
+		func(s *WebhookStatus) interface{} { return s.Queued },
+	)
+	series(
+		"martd_webhook_sent_total", "counter", "Events the webhook took.",
+		func(s *WebhookStatus) interface{} { return s.Sent },
+	)
+	series(
+		"martd_webhook_failed_total", "counter",
+		"Events dropped after all retries failed.",
+		func(s *WebhookStatus) interface{} { return s.Failed },
+	)
+	series(
+		"martd_webhook_dropped_total", "counter",
+		"Events dropped because the queue was full.",
+		func(s *WebhookStatus) interface{} { return s.Dropped },
+	)
+}
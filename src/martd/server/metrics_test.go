@@ -0,0 +1,61 @@
+package server
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram(0.01, 0.1)
+	h.Observe("insert", 5*time.Millisecond)
+	h.Observe("insert", 50*time.Millisecond)
+	h.Observe("insert", time.Second)
+
+	b := &bytes.Buffer{}
+	h.write(b, "t_seconds", "op")
+	want := `t_seconds_bucket{op="insert",le="0.01"} 1
+t_seconds_bucket{op="insert",le="0.1"} 2
+t_seconds_bucket{op="insert",le="+Inf"} 3
+t_seconds_sum{op="insert"} 1.055
+t_seconds_count{op="insert"} 3
+`
+	if b.String() != want {
+		t.Fatalf("got\n%s", b)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	s := newTestServer(t, func(o *Options) {
+		o.MetricsChannels = []string{"a"}
+	})
+	testChannel(t, s, &ChannelDef{Name: "a1", Size: 2, Life: time.Hour}, 3)
+	testChannel(t, s, &ChannelDef{Name: "b", Size: 10, Life: time.Hour}, 1)
+
+	w := httptest.NewRecorder()
+	s.MetricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, series := range []string{
+		"martd_channels 2",
+		"martd_messages 3",
+		"martd_message_bytes 3",
+		"martd_published_total 4",
+		"martd_dropped_total 1",
+		"martd_persist_healthy 1",
+		`martd_channel_messages{channel="a1"} 2`,
+		`martd_channel_published_total{channel="a1"} 3`,
+	} {
+		if !strings.Contains(body, "\n"+series+"\n") {
+			t.Errorf("no %s", series)
+		}
+	}
+	// per channel series only for the prefixes asked for
+	if strings.Contains(body, `channel="b`) {
+		t.Errorf("series for b: %s", body)
+	}
+	if t.Failed() {
+		t.Log(body)
+	}
+}
@@ -0,0 +1,623 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errMQTTMalformed = errors.New("malformed packet")
+
+const (
+	// MQTTQueue is how many messages wait for a slow MQTT subscriber, later
+	// ones are dropped.
+	MQTTQueue = 1000
+	// MQTTMaxRetained is how many retained messages a SUBSCRIBE sends at
+	// most.
+	MQTTMaxRetained = 100
+	mqttMaxPacket   = 64 << 20
+
+	mqttConnect     = 1
+	mqttConnack     = 2
+	mqttPublish     = 3
+	mqttPuback      = 4
+	mqttSubscribe   = 8
+	mqttSuback      = 9
+	mqttUnsubscribe = 10
+	mqttUnsuback    = 11
+	mqttPingreq     = 12
+	mqttPingresp    = 13
+	mqttDisconnect  = 14
+)
+
+// mqttTransport is a TCP connection, or a WebSocket.
+type mqttTransport interface {
+	io.ReadWriteCloser
+	SetReadDeadline(t time.Time) error
+}
+
+// serveMQTT starts the MQTT listeners that are configured, MQTTAddr over TCP
+// and MQTTWSAddr over WebSocket.
+func (s *Server) serveMQTT() error {
+	if s.opts.MQTTAddr != "" {
+		l, err := s.listen(s.opts.MQTTAddr)
+		if err != nil {
+			return fmt.Errorf("MQTT listener: %s", err)
+		}
+		log.Printf("Started MQTT listener on %s.", l.Addr())
+
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if s.stopping() {
+					return
+				}
+				if err != nil {
+					log.Println("MQTT accept failed:", err)
+					continue
+				}
+				sub := s.connSubscriber("mqtt", conn.RemoteAddr().String())
+				go s.newMQTTConn(conn, sub).serve()
+			}
+		}()
+	}
+
+	if s.opts.MQTTWSAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/mqtt", func(w http.ResponseWriter, r *http.Request) {
+			ws, err := wsUpgrade(w, r, "mqtt")
+			if err != nil {
+				return
+			}
+			sub := s.connSubscriber("mqtt", r.RemoteAddr)
+			sub.Header = r.Header
+			s.newMQTTConn(ws, sub).serve()
+		})
+		err := s.serve(&http.Server{Addr: s.opts.MQTTWSAddr, Handler: mux})
+		if err != nil {
+			return fmt.Errorf("MQTT WebSocket listener: %s", err)
+		}
+		log.Printf("Started MQTT WebSocket listener on %s.", s.opts.MQTTWSAddr)
+	}
+	return nil
+}
+
+type mqttPacket struct {
+	kind, flags byte
+	body        []byte
+}
+
+// mqttConn is one MQTT client. Like redisConn, packets are read by a
+// goroutine of their own and everything is written by serve.
+type mqttConn struct {
+	s    *Server
+	conn mqttTransport
+	r    *bufio.Reader
+	w    *bufio.Writer
+
+	id        string
+	password  string // the key for publishing to channels with one
+	sub       *Subscriber
+	keepAlive time.Duration
+	will      *mqttPacket // a publish, sent if the client goes away
+
+	events chan *ChannelEvent
+
+	lock    sync.RWMutex // filters are matched from publishers
+	filters map[string]bool
+}
+
+func (s *Server) newMQTTConn(conn mqttTransport, sub *Subscriber) *mqttConn {
+	return &mqttConn{
+		s:       s,
+		conn:    conn,
+		sub:     sub,
+		r:       bufio.NewReader(conn),
+		w:       bufio.NewWriter(conn),
+		events:  make(chan *ChannelEvent, MQTTQueue),
+		filters: map[string]bool{},
+	}
+}
+
+func (mc *mqttConn) serve() {
+	mc.s.nMQTTConns.Add(1)
+	defer mc.s.nMQTTConns.Add(-1)
+	defer mc.conn.Close()
+
+	if err := mc.connect(); err != nil {
+		log.Println("MQTT connect failed:", err)
+		return
+	}
+	defer mc.disconnect()
+
+	unwatch := mc.s.Watch(mc.match, mc.events)
+	defer func() {
+		unwatch()
+		mc.rewatch(keys(mc.filters), true)
+	}()
+
+	type read struct {
+		p   *mqttPacket
+		err error
+	}
+	packets := make(chan read)
+	done := make(chan bool)
+	defer close(done)
+
+	go func() {
+		for {
+			if mc.keepAlive != 0 {
+				mc.conn.SetReadDeadline(time.Now().Add(mc.keepAlive * 3 / 2))
+			}
+			p, err := readPacket(mc.r)
+			select {
+			case packets <- read{p, err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case rd := <-packets:
+			if rd.err != nil {
+				if rd.err != io.EOF {
+					log.Println("MQTT client", mc.id, "failed:", rd.err)
+				}
+				return
+			}
+			if err := mc.packet(rd.p); err != nil {
+				if err != io.EOF {
+					log.Println("MQTT client", mc.id, "failed:", err)
+				}
+				mc.w.Flush()
+				return
+			}
+		case ev := <-mc.events:
+			mc.deliver(ev.Chan.Name, ev.Mesg.Data, false)
+		case <-mc.s.done:
+			mc.will = nil // not gone, the server is
+			return
+		}
+
+		for len(mc.events) != 0 {
+			ev := <-mc.events
+			mc.deliver(ev.Chan.Name, ev.Mesg.Data, false)
+		}
+		if err := mc.w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// connect reads and answers the CONNECT packet. Sessions are not kept, a
+// client asking for one gets a new one.
+func (mc *mqttConn) connect() error {
+	mc.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	p, err := readPacket(mc.r)
+	if err != nil {
+		return err
+	}
+	if p.kind != mqttConnect {
+		return errors.New("expected CONNECT")
+	}
+
+	b := &mqttBody{b: p.body}
+	protocol, level, flags := b.str(), b.u8(), b.u8()
+	keepAlive := b.u16()
+	if b.err != nil {
+		return b.err
+	}
+	if protocol != "MQTT" || level != 4 {
+		mc.writePacket(mqttConnack<<4, []byte{0, 1}) // unacceptable version
+		mc.w.Flush()
+		return fmt.Errorf("unsupported protocol %s %d", protocol, level)
+	}
+	if flags&0x01 != 0 {
+		return errMQTTMalformed
+	}
+
+	mc.id = b.str()
+	if flags&0x04 != 0 {
+		// kept as a qos 0 publish, as it is published here
+		topic, message := b.str(), b.bytes()
+		mc.will = &mqttPacket{
+			kind:  mqttPublish,
+			flags: flags >> 5 & 0x01,
+			body:  append(mqttString(topic), message...),
+		}
+	}
+	if flags&0x80 != 0 {
+		b.str() // user name, not used
+	}
+	if flags&0x40 != 0 {
+		mc.password = string(b.bytes())
+	}
+	if b.err != nil {
+		return b.err
+	}
+	mc.keepAlive = time.Duration(keepAlive) * time.Second
+
+	if mc.id == "" {
+		mc.id = "martd-" + newReplID()
+	}
+	mc.sub.Cid = mc.id
+
+	mc.s.mqttLock.Lock()
+	if old, ok := mc.s.mqttClients[mc.id]; ok {
+		old.conn.Close()
+	}
+	mc.s.mqttClients[mc.id] = mc
+	mc.s.mqttLock.Unlock()
+
+	mc.conn.SetReadDeadline(time.Time{})
+	mc.writePacket(mqttConnack<<4, []byte{0, 0})
+	return mc.w.Flush()
+}
+
+// disconnect forgets the client, and publishes its will if it did not send
+// DISCONNECT.
+func (mc *mqttConn) disconnect() {
+	mc.s.mqttLock.Lock()
+	if mc.s.mqttClients[mc.id] == mc {
+		delete(mc.s.mqttClients, mc.id)
+	}
+	mc.s.mqttLock.Unlock()
+
+	if mc.will != nil {
+		if err := mc.publish(mc.will); err != nil {
+			log.Println("MQTT will of", mc.id, "not published:", err)
+		}
+	}
+}
+
+// packet handles one packet from the client, an error closes the connection.
+func (mc *mqttConn) packet(p *mqttPacket) error {
+	switch p.kind {
+	case mqttPublish:
+		return mc.publish(p)
+	case mqttPuback:
+		return nil // only qos 0 is sent
+	case mqttSubscribe:
+		return mc.subscribe(p)
+	case mqttUnsubscribe:
+		return mc.unsubscribe(p)
+	case mqttPingreq:
+		mc.writePacket(mqttPingresp<<4, nil)
+		return nil
+	case mqttDisconnect:
+		mc.will = nil
+		return io.EOF
+	}
+	return fmt.Errorf("unexpected packet type %d", p.kind)
+}
+
+// publish publishes to the channel named by the topic, with Channel.Pub. A
+// retained publish with no payload empties the channel, the newest message
+// of a channel is what MQTT calls its retained message.
+func (mc *mqttConn) publish(p *mqttPacket) error {
+	qos := p.flags >> 1 & 0x03
+	if qos > 1 {
+		return errors.New("qos 2 is not supported")
+	}
+
+	b := &mqttBody{b: p.body}
+	topic := b.str()
+	id := uint16(0)
+	if qos == 1 {
+		id = b.u16()
+	}
+	if b.err != nil {
+		return b.err
+	}
+	if topic == "" || strings.ContainsAny(topic, "+#") {
+		return fmt.Errorf("invalid topic %q", topic)
+	}
+	if err := mc.s.canPublish(topic); err != nil {
+		return err
+	}
+
+	ch, err := mc.s.GetOrCreateChannel(&ChannelDef{
+		Name: topic, Size: DefaultSize, Life: DefaultLife, Key: mc.password,
+	})
+	if err != nil {
+		return err
+	}
+	if ch.Key != "" && ch.Key != mc.password {
+		return fmt.Errorf("invalid key for %s", topic)
+	}
+
+	payload := b.rest()
+	if p.flags&0x01 != 0 && len(payload) == 0 {
+		ch.PurgeBefore(0)
+	} else {
+		ch.Pub(payload)
+	}
+
+	if qos == 1 {
+		mc.writePacket(mqttPuback<<4, []byte{byte(id >> 8), byte(id)})
+	}
+	return nil
+}
+
+// subscribe adds topic filters, granting qos 0, and sends the retained
+// message of each existing channel they match. Filters naming a channel
+// AuthURL denies fail, the channels wildcards match are checked as their
+// messages are delivered.
+func (mc *mqttConn) subscribe(p *mqttPacket) error {
+	if p.flags != 0x02 {
+		return errMQTTMalformed
+	}
+
+	b := &mqttBody{b: p.body}
+	id := b.u16()
+	filters := []string{}
+	codes := []byte{byte(id >> 8), byte(id)}
+	for len(b.b) != 0 && b.err == nil {
+		filter, qos := b.str(), b.u8()
+		if qos > 2 || !mqttValidFilter(filter) || !mc.allowed(filter) {
+			codes = append(codes, 0x80)
+			continue
+		}
+		filters = append(filters, filter)
+		codes = append(codes, 0)
+	}
+	if b.err != nil || len(codes) == 2 {
+		return errMQTTMalformed
+	}
+
+	mc.lock.Lock()
+	for _, filter := range filters {
+		mc.filters[filter] = true
+	}
+	mc.lock.Unlock()
+	mc.writePacket(mqttSuback<<4, codes)
+	mc.rewatch(filters, false)
+
+	retained := 0
+	for _, ch := range mc.s.ListChannels("") {
+		if retained == MQTTMaxRetained {
+			break
+		}
+		for _, filter := range filters {
+			if !mqttMatch(filter, ch.Name) {
+				continue
+			}
+			if m := ch.Newest(); m != nil {
+				mc.deliver(ch.Name, m.Data, true)
+				retained++
+			}
+			break
+		}
+	}
+	return nil
+}
+
+func (mc *mqttConn) unsubscribe(p *mqttPacket) error {
+	if p.flags != 0x02 {
+		return errMQTTMalformed
+	}
+
+	b := &mqttBody{b: p.body}
+	id := b.u16()
+	filters := []string{}
+	mc.lock.Lock()
+	for len(b.b) != 0 && b.err == nil {
+		filter := b.str()
+		delete(mc.filters, filter)
+		filters = append(filters, filter)
+	}
+	mc.lock.Unlock()
+	if b.err != nil {
+		return b.err
+	}
+	mc.rewatch(filters, true)
+
+	mc.writePacket(mqttUnsuback<<4, []byte{byte(id >> 8), byte(id)})
+	return nil
+}
+
+// rewatch checks the occupancy of the channels of filters just subscribed,
+// or if left is set, dropped.
+func (mc *mqttConn) rewatch(filters []string, left bool) {
+	if len(filters) == 0 {
+		return
+	}
+	mc.s.watchMatching(func(name string) bool {
+		for _, filter := range filters {
+			if mqttMatch(filter, name) {
+				return true
+			}
+		}
+		return false
+	}, left)
+}
+
+// match is the Watch filter, true if any filter matches the channel.
+func (mc *mqttConn) match(name string) bool {
+	mc.lock.RLock()
+	defer mc.lock.RUnlock()
+
+	for filter := range mc.filters {
+		if mqttMatch(filter, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed is true for wildcard filters, and for topics AuthURL allows
+// the client.
+func (mc *mqttConn) allowed(filter string) bool {
+	return strings.ContainsAny(filter, "+#") || mc.s.allowed(mc.sub, filter)
+}
+
+// deliver sends a message to the client, once, however many of its filters
+// match, at qos 0, if AuthURL allows it.
+func (mc *mqttConn) deliver(topic string, data []byte, retained bool) {
+	if !mc.s.allowed(mc.sub, topic) {
+		return
+	}
+
+	header := byte(mqttPublish << 4)
+	if retained {
+		header |= 0x01
+	}
+	mc.writePacket(header, mqttString(topic), data)
+}
+
+func (mc *mqttConn) writePacket(header byte, parts ...[]byte) {
+	n := 0
+	for _, part := range parts {
+		n += len(part)
+	}
+
+	buf := []byte{header}
+	for {
+		b := byte(n % 128)
+		if n /= 128; n > 0 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+		if n == 0 {
+			break
+		}
+	}
+
+	mc.w.Write(buf)
+	for _, part := range parts {
+		mc.w.Write(part)
+	}
+}
+
+func readPacket(r *bufio.Reader) (*mqttPacket, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	n, shift := 0, uint(0)
+	for i := 0; ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		if shift += 7; i == 3 {
+			return nil, errMQTTMalformed
+		}
+	}
+	if n > mqttMaxPacket {
+		return nil, fmt.Errorf("packet of %d bytes is too large", n)
+	}
+
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return &mqttPacket{header >> 4, header & 0x0f, body}, nil
+}
+
+// mqttBody reads the fields of a packet, after an error all reads return
+// zero values and err is set.
+type mqttBody struct {
+	b   []byte
+	err error
+}
+
+func (b *mqttBody) u8() byte {
+	if b.err != nil || len(b.b) < 1 {
+		b.err = errMQTTMalformed
+		return 0
+	}
+	v := b.b[0]
+	b.b = b.b[1:]
+	return v
+}
+
+func (b *mqttBody) u16() uint16 {
+	if b.err != nil || len(b.b) < 2 {
+		b.err = errMQTTMalformed
+		return 0
+	}
+	v := binary.BigEndian.Uint16(b.b)
+	b.b = b.b[2:]
+	return v
+}
+
+func (b *mqttBody) bytes() []byte {
+	n := int(b.u16())
+	if b.err != nil || len(b.b) < n {
+		b.err = errMQTTMalformed
+		return nil
+	}
+	v := b.b[:n]
+	b.b = b.b[n:]
+	return v
+}
+
+func (b *mqttBody) str() string {
+	return string(b.bytes())
+}
+
+func (b *mqttBody) rest() []byte {
+	v := b.b
+	b.b = nil
+	return v
+}
+
+func mqttString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+// mqttValidFilter checks that + and # take whole levels, and # is last.
+func mqttValidFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.ContainsAny(level, "+#") && len(level) != 1 {
+			return false
+		}
+		if level == "#" && i != len(levels)-1 {
+			return false
+		}
+	}
+	return true
+}
+
+// mqttMatch matches a topic against a filter, where + matches one level and
+// # all remaining ones. Wildcards at the start do not match topics starting
+// with $.
+func mqttMatch(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") &&
+		(strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	fs, ts := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, f := range fs {
+		if f == "#" {
+			return true
+		}
+		if i == len(ts) || f != "+" && f != ts[i] {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
@@ -0,0 +1,314 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMQTTMatch(t *testing.T) {
+	for _, c := range []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"news", "news", true},
+		{"news", "news/sport", false},
+		{"news/+", "news/sport", true},
+		{"news/+", "news", false},
+		{"news/+/goals", "news/sport/goals", true},
+		{"news/#", "news", true},
+		{"news/#", "news/sport/goals", true},
+		{"#", "news/sport", true},
+		{"+/sport", "news/sport", true},
+		{"#", "$SYS/uptime", false},
+		{"+/uptime", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+	} {
+		if mqttMatch(c.filter, c.topic) != c.match {
+			t.Errorf("%q %q: want %v", c.filter, c.topic, c.match)
+		}
+	}
+
+	for filter, valid := range map[string]bool{
+		"news": true, "news/+/goals": true, "#": true, "news/#": true,
+		"": false, "news#": false, "news/#/goals": false, "news+": false,
+	} {
+		if mqttValidFilter(filter) != valid {
+			t.Errorf("%q: want valid %v", filter, valid)
+		}
+	}
+}
+
+// mqttEncode encodes a packet, as mqttConn.writePacket does.
+func mqttEncode(header byte, parts ...[]byte) []byte {
+	body := bytes.Join(parts, nil)
+	buf := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		if n /= 128; n > 0 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(buf, body...)
+}
+
+func TestMQTTReadPacket(t *testing.T) {
+	body := bytes.Repeat([]byte{7}, 300) // two bytes of remaining length
+	p, err := readPacket(bufio.NewReader(bytes.NewReader(
+		mqttEncode(mqttPublish<<4|0x03, body),
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.kind != mqttPublish || p.flags != 0x03 || !bytes.Equal(p.body, body) {
+		t.Fatalf("read %d %x %d bytes", p.kind, p.flags, len(p.body))
+	}
+
+	_, err = readPacket(bufio.NewReader(bytes.NewReader(
+		[]byte{mqttPublish << 4, 0xff, 0xff, 0xff, 0xff, 0x01},
+	)))
+	if err != errMQTTMalformed {
+		t.Fatalf("five bytes of remaining length: got %v", err)
+	}
+	_, err = readPacket(bufio.NewReader(bytes.NewReader(
+		[]byte{mqttPublish << 4, 5, 1},
+	)))
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("short body: got %v", err)
+	}
+}
+
+type mqttClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newMQTTClient(t *testing.T, s *Server) *mqttClient {
+	client, conn := net.Pipe()
+	go s.newMQTTConn(conn, s.connSubscriber("mqtt", "pipe")).serve()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { client.Close() })
+	return &mqttClient{t, client, bufio.NewReader(client)}
+}
+
+func (c *mqttClient) send(header byte, parts ...[]byte) {
+	c.t.Helper()
+
+	if _, err := c.conn.Write(mqttEncode(header, parts...)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *mqttClient) read() *mqttPacket {
+	c.t.Helper()
+
+	p, err := readPacket(c.r)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return p
+}
+
+// connect sends CONNECT, with password if not empty, and checks CONNACK.
+func (c *mqttClient) connect(id, password string) {
+	c.t.Helper()
+
+	flags := byte(0x02) // clean session
+	parts := [][]byte{mqttString("MQTT"), {4, 0}, {0, 60}, mqttString(id)}
+	if password != "" {
+		flags |= 0x40
+		parts = append(parts, mqttString(password))
+	}
+	parts[1][1] = flags
+	c.send(mqttConnect<<4, parts...)
+
+	p := c.read()
+	if p.kind != mqttConnack || !bytes.Equal(p.body, []byte{0, 0}) {
+		c.t.Fatalf("CONNACK %d % x", p.kind, p.body)
+	}
+}
+
+func (c *mqttClient) subscribe(id byte, filters ...string) []byte {
+	c.t.Helper()
+
+	parts := [][]byte{{0, id}}
+	for _, filter := range filters {
+		parts = append(parts, mqttString(filter), []byte{1})
+	}
+	c.send(mqttSubscribe<<4|0x02, parts...)
+
+	p := c.read()
+	if p.kind != mqttSuback || len(p.body) < 2 || p.body[1] != id {
+		c.t.Fatalf("SUBACK %d % x", p.kind, p.body)
+	}
+	return p.body[2:]
+}
+
+// message reads a PUBLISH, and returns its topic, payload and retain flag.
+func (c *mqttClient) message() (string, string, bool) {
+	c.t.Helper()
+
+	p := c.read()
+	if p.kind != mqttPublish {
+		c.t.Fatalf("got packet %d, not PUBLISH", p.kind)
+	}
+	b := &mqttBody{b: p.body}
+	topic := b.str()
+	return topic, string(b.rest()), p.flags&0x01 != 0
+}
+
+func TestMQTTConnect(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	c := newMQTTClient(t, s)
+	c.send(mqttConnect<<4, mqttString("MQTT"), []byte{3, 0x02, 0, 60})
+	if p := c.read(); p.kind != mqttConnack || p.body[1] != 1 {
+		t.Fatalf("MQTT 3.0: CONNACK % x", p.body)
+	}
+
+	c = newMQTTClient(t, s)
+	c.connect("c1", "")
+	c.send(mqttPingreq << 4)
+	if p := c.read(); p.kind != mqttPingresp {
+		t.Fatalf("PINGREQ: got %d", p.kind)
+	}
+	c.send(mqttDisconnect << 4)
+	if _, err := readPacket(c.r); err != io.EOF {
+		t.Fatalf("after DISCONNECT: got %v", err)
+	}
+}
+
+func TestMQTTPublishSubscribe(t *testing.T) {
+	s := newTestServer(t, nil)
+	if _, err := s.Publish(&ChannelDef{
+		Name: "news/sport", Size: DefaultSize, Life: DefaultLife,
+	}, []byte("old"), false); err != nil {
+		t.Fatal(err)
+	}
+
+	sub := newMQTTClient(t, s)
+	sub.connect("sub", "")
+	codes := sub.subscribe(1, "news/#", "news/#/bad")
+	if !bytes.Equal(codes, []byte{0, 0x80}) {
+		t.Fatalf("SUBACK codes % x", codes)
+	}
+	// the newest message of a matching channel is the retained one
+	topic, data, retained := sub.message()
+	if topic != "news/sport" || data != "old" || !retained {
+		t.Fatalf("retained: got %s %q %v", topic, data, retained)
+	}
+
+	pub := newMQTTClient(t, s)
+	pub.connect("pub", "")
+	pub.send(
+		mqttPublish<<4|0x02, mqttString("news/sport"), []byte{0, 9},
+		[]byte("goal"),
+	)
+	p := pub.read()
+	if p.kind != mqttPuback || !bytes.Equal(p.body, []byte{0, 9}) {
+		t.Fatalf("QoS 1: got %d % x", p.kind, p.body)
+	}
+	topic, data, retained = sub.message()
+	if topic != "news/sport" || data != "goal" || retained {
+		t.Fatalf("got %s %q %v", topic, data, retained)
+	}
+	ch := s.LookupChannel("news/sport")
+	if msgs, _, _ := ch.History(0, 0, 10); len(msgs) != 2 {
+		t.Fatalf("channel has %d messages", len(msgs))
+	}
+
+	// a retained publish with no payload empties the channel
+	pub.send(mqttPublish<<4|0x01, mqttString("news/sport"))
+	pub.send(mqttPingreq << 4)
+	pub.read()
+	if msgs, _, _ := ch.History(0, 0, 10); len(msgs) != 0 {
+		t.Fatalf("%d messages after an empty retained publish", len(msgs))
+	}
+
+	sub.send(mqttUnsubscribe<<4|0x02, []byte{0, 2}, mqttString("news/#"))
+	if p := sub.read(); p.kind != mqttUnsuback {
+		t.Fatalf("UNSUBSCRIBE: got %d", p.kind)
+	}
+	pub.send(mqttPublish<<4, mqttString("news/sport"), []byte("again"))
+	sub.send(mqttPingreq << 4)
+	if p := sub.read(); p.kind != mqttPingresp {
+		t.Fatalf("got packet %d after UNSUBSCRIBE", p.kind)
+	}
+
+	// QoS 2 is not supported, the connection is closed
+	pub.send(
+		mqttPublish<<4|0x04, mqttString("news/sport"), []byte{0, 10},
+		[]byte("x"),
+	)
+	if _, err := readPacket(pub.r); err == nil {
+		t.Fatal("QoS 2 publish was accepted")
+	}
+}
+
+func TestMQTTKey(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	owner := newMQTTClient(t, s)
+	owner.connect("owner", "secret")
+	owner.send(
+		mqttPublish<<4|0x02, mqttString("private"), []byte{0, 1}, []byte("x"),
+	)
+	owner.read()
+	if ch := s.LookupChannel("private"); ch == nil || ch.Key != "secret" {
+		t.Fatal("channel not created with the CONNECT password as key")
+	}
+
+	other := newMQTTClient(t, s)
+	other.connect("other", "")
+	other.send(
+		mqttPublish<<4|0x02, mqttString("private"), []byte{0, 1}, []byte("y"),
+	)
+	if _, err := readPacket(other.r); err == nil {
+		t.Fatal("publish without the key was accepted")
+	}
+}
+
+func TestMQTTRetainedLimit(t *testing.T) {
+	s := newTestServer(t, nil)
+	channels := []*Channel{}
+	for i := 0; i <= MQTTMaxRetained; i++ {
+		def := &ChannelDef{
+			Name: fmt.Sprint("t/", i), Size: 10, Life: time.Hour,
+		}
+		channels = append(channels, testChannel(t, s, def, 1))
+	}
+
+	// unloaded channels keep their newest message, storage is not read
+	s.setStorage(&failingStorage{Storage: s.storage(), fail: true})
+	for _, ch := range channels {
+		if !ch.Unload(time.Now()) {
+			t.Fatal("channel not unloaded")
+		}
+	}
+
+	sub := newMQTTClient(t, s)
+	sub.connect("sub", "")
+	sub.subscribe(1, "t/#")
+	for i := 0; i < MQTTMaxRetained; i++ {
+		if _, data, retained := sub.message(); data != "1" || !retained {
+			t.Fatalf("retained: got %q %v", data, retained)
+		}
+	}
+	sub.send(mqttPingreq << 4)
+	if p := sub.read(); p.kind != mqttPingresp {
+		t.Fatalf("got packet %d after %d retained", p.kind, MQTTMaxRetained)
+	}
+	if channels[0].Info().Loaded {
+		t.Fatal("channel loaded for its retained message")
+	}
+}
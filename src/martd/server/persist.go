@@ -0,0 +1,726 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Storage persists channels and their messages, so they survive a restart.
+// Writes and Expire are called from the Persister goroutine, LoadMessages is
+// called from any goroutine, when a channel is first used, as are LoadRange,
+// LoadBefore and Count.
+type Storage interface {
+	// LoadChannels calls fn for every stored channel.
+	LoadChannels(fn func(def *ChannelDef)) error
+	// LoadMessages returns the newest limit stored messages of a channel,
+	// or all of them if limit is 0, oldest first.
+	LoadMessages(name string, limit int) ([]*Message, error)
+	// LoadRange returns up to limit stored messages of a channel with etags
+	// between after and before (both exclusive), oldest first.
+	LoadRange(name string, after, before int64, limit int) ([]*Message, error)
+	// LoadBefore is LoadRange, but returns the newest limit messages in the
+	// range, still oldest first.
+	LoadBefore(name string, after, before int64, limit int) ([]*Message, error)
+	// Count returns how many messages, and payload bytes, LoadMessages
+	// would return, without reading them.
+	Count(name string, limit int) (int, int, error)
+	// Begin starts a batch of writes, which take effect together on Commit.
+	Begin() (Batch, error)
+	// Expire drops all messages past their channel's life, and returns the
+	// names of the channels that had any.
+	Expire(now int64) ([]string, error)
+	Close() error
+}
+
+// Batch is a group of writes to Storage, committed together.
+type Batch interface {
+	// Define stores the attributes of a new channel.
+	Define(def *ChannelDef) error
+	// Delete drops a channel, its attributes and all its messages.
+	Delete(def *ChannelDef) error
+	// Append stores a newly published message.
+	Append(def *ChannelDef, m *Message) error
+	// Evict drops a message that fell off the channel's circular buffer.
+	Evict(def *ChannelDef, m *Message) error
+	// Trim drops the oldest messages of a spilling channel beyond its
+	// History and HistoryBytes.
+	Trim(def *ChannelDef) error
+	// Empty drops all messages of a channel.
+	Empty(def *ChannelDef) error
+	// Purge drops the messages of a channel older than the given etag.
+	Purge(def *ChannelDef, before int64) error
+	Commit() error
+	Rollback() error
+}
+
+// SchemaError is returned by storage written by a newer martd.
+type SchemaError struct {
+	Version, Known int
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf(
+		"database schema version %d is newer than this martd knows (%d)",
+		e.Version, e.Known,
+	)
+}
+
+// Storages maps Options.Storage names to constructors, which use Persist and
+// any options of their own.
+var Storages = map[string]func(o *Options) (Storage, error){}
+
+var (
+	PersistMinBackoff = 50 * time.Millisecond
+	PersistMaxBackoff = 10 * time.Second
+
+	ErrPersistDegraded = errors.New("storage is failing, will retry")
+)
+
+// PersistQueue is how many operations can wait for the Persister before
+// publishers block.
+const PersistQueue = 10000
+
+// Health is the state of persistence, it is unhealthy while there are
+// operations waiting to be retried.
+type Health struct {
+	lock sync.Mutex
+
+	Healthy bool      `json:"healthy"`
+	Error   string    `json:"error,omitempty"`
+	Since   time.Time `json:"since"`
+	Backlog int       `json:"backlog"`
+}
+
+func (h *Health) Fail(err error) {
+	log.Println("Storage error:", err)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.Healthy {
+		h.Healthy = false
+		h.Since = time.Now()
+	}
+	h.Error = err.Error()
+}
+
+func (h *Health) Recover() {
+	log.Println("Storage recovered.")
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.Healthy = true
+	h.Error = ""
+	h.Since = time.Now()
+}
+
+func (h *Health) SetBacklog(n int) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.Backlog = n
+}
+
+// Get returns a copy of the current state.
+func (h *Health) Get() *Health {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return &Health{
+		Healthy: h.Healthy, Error: h.Error, Since: h.Since, Backlog: h.Backlog,
+	}
+}
+
+func storageNames() []string {
+	names := []string{}
+	for name := range Storages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func unknownStorage(name string) error {
+	return fmt.Errorf(
+		"unknown storage %q, have: %s", name, strings.Join(storageNames(), ", "),
+	)
+}
+
+// OpenStorage opens the backend selected by o.Storage, for the commands that
+// work on storage without a server.
+func OpenStorage(o *Options) (Storage, error) {
+	open, ok := Storages[o.Storage]
+	if !ok {
+		return nil, unknownStorage(o.Storage)
+	}
+	opts := *o
+	opts.setDefaults()
+	return open(&opts)
+}
+
+// openStorage sets store to the backend selected by Storage.
+func (s *Server) openStorage() error {
+	store, err := OpenStorage(&s.opts)
+	if err != nil {
+		return err
+	}
+	s.setStorage(store)
+	return nil
+}
+
+// storage returns the opened storage, or nil.
+func (s *Server) storage() Storage {
+	s.storeLock.RLock()
+	defer s.storeLock.RUnlock()
+
+	return s.store
+}
+
+func (s *Server) setStorage(store Storage) {
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+
+	s.store = store
+}
+
+// fail marks storage as failing.
+func (s *Server) fail(err error) {
+	s.nPersistErrors.Add(1)
+	s.health.Fail(err)
+}
+
+type persistOp int
+
+const (
+	opAppend persistOp = iota
+	opEmpty
+	opPurge
+	opDefine
+	opDelete
+	opSync // writes nothing, done is called once everything before is in
+)
+
+type DMessage struct {
+	op      persistOp
+	ch      *Channel // for ops on messages, its pending count is decremented
+	def     *ChannelDef
+	m       *Message
+	evicted []*Message // for opAppend, what fell off the circular buffer
+	before  int64      // for opPurge, drop messages older than this etag
+
+	// done, if not nil, gets the result of the commit, or the first error
+	done chan error
+}
+
+// Done reports the result of persisting dm to whoever is waiting on it.
+func (dm *DMessage) Done(err error) {
+	if dm.done != nil {
+		dm.done <- err
+		dm.done = nil
+	}
+}
+
+// committed is called once dm is in storage, or will never be.
+func (dm *DMessage) committed() {
+	if dm.ch != nil {
+		atomic.AddInt32(&dm.ch.pending, -1)
+	}
+}
+
+// enqueue queues dm for the persister, and records it for followers, in the
+// same order. Once the persister has stopped, dm fails with ErrServerClosed.
+func (s *Server) enqueue(dm *DMessage) {
+	s.replLock.Lock()
+	defer s.replLock.Unlock()
+
+	s.record(dm)
+	select {
+	case <-s.persistStopped:
+	default:
+		select {
+		case s.persistChan <- dm:
+			return
+		case <-s.persistStopped:
+		}
+	}
+	dm.Done(ErrServerClosed)
+	dm.committed()
+}
+
+func (s *Server) persist(
+	c *Channel, m *Message, evicted []*Message, done chan error,
+) {
+	atomic.AddInt32(&c.pending, 1)
+	s.enqueue(&DMessage{
+		op: opAppend, ch: c, def: c.Def(), m: m, evicted: evicted,
+		done: done,
+	})
+}
+
+func (s *Server) emptyChannel(c *Channel) {
+	atomic.AddInt32(&c.pending, 1)
+	s.enqueue(&DMessage{op: opEmpty, ch: c, def: c.Def()})
+}
+
+func (s *Server) purgeMessages(c *Channel, before int64) {
+	atomic.AddInt32(&c.pending, 1)
+	s.enqueue(&DMessage{op: opPurge, ch: c, def: c.Def(), before: before})
+}
+
+func (s *Server) defineChannel(c *Channel) {
+	s.enqueue(&DMessage{op: opDefine, def: c.Def()})
+}
+
+func (s *Server) forgetChannel(c *Channel) {
+	s.enqueue(&DMessage{op: opDelete, def: c.Def()})
+}
+
+func (s *Server) expireMessages() {
+	select {
+	case s.persistChan <- nil:
+	case <-s.persistStopped:
+	}
+}
+
+func InsertPayload(b Batch, dm *DMessage) error {
+	switch dm.op {
+	case opEmpty:
+		return b.Empty(dm.def)
+	case opPurge:
+		return b.Purge(dm.def, dm.before)
+	case opDefine:
+		return b.Define(dm.def)
+	case opDelete:
+		return b.Delete(dm.def)
+	case opSync:
+		return nil
+	}
+
+	if err := b.Append(dm.def, dm.m); err != nil {
+		return err
+	}
+
+	if dm.def.Spills() {
+		return b.Trim(dm.def)
+	}
+	for _, old := range dm.evicted {
+		if err := b.Evict(dm.def, old); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// persister applies storage operations in order, committing whatever is
+// queued (up to PersistBatch operations) in one batch. When a batch fails,
+// it and all later operations are kept in a backlog, which is retried with
+// exponential backoff, while the server keeps serving from memory. The
+// backlog is bounded by PersistBacklog, beyond which the oldest operations
+// are dropped. On Shutdown it commits what is queued, if it can, and closes
+// storage.
+func (s *Server) persister() {
+	backlog := []*DMessage{}
+	backoff := PersistMinBackoff
+	defer s.stopPersisting(&backlog)
+
+	// retry is set while degraded, that is while storage is failing
+	var retry <-chan time.Time
+	if s.storage() == nil {
+		retry = time.After(backoff)
+	}
+
+	for {
+		select {
+		case dm := <-s.persistChan:
+			batch, expire := s.collect(dm)
+
+			if len(batch) != 0 {
+				err := ErrPersistDegraded
+				if retry == nil {
+					err = s.commit(batch)
+					if err != nil {
+						s.fail(err)
+						backoff = PersistMinBackoff
+						retry = time.After(backoff)
+					}
+				}
+
+				if err != nil {
+					for _, dm := range batch {
+						dm.Done(err)
+					}
+					backlog = append(backlog, batch...)
+					if over := len(backlog) - s.opts.PersistBacklog; over > 0 {
+						for i := 0; i < over; i++ {
+							backlog[i].committed()
+							backlog[i] = nil
+						}
+						backlog = backlog[over:]
+						s.nPersistDropped.Add(int64(over))
+					}
+					s.health.SetBacklog(len(backlog))
+				}
+			}
+
+			if expire && retry == nil {
+				if err := s.expireStored(); err != nil {
+					s.fail(err)
+					backoff = PersistMinBackoff
+					retry = time.After(backoff)
+				}
+			}
+			if expire && retry != nil {
+				// storage is down, so it can not tell us what expired
+				s.expireLater(nil)
+			}
+		case <-retry:
+			err := s.drain(&backlog)
+			s.health.SetBacklog(len(backlog))
+			if err == nil {
+				retry = nil
+				s.health.Recover()
+				continue
+			}
+
+			s.fail(err)
+			backoff *= 2
+			if backoff > PersistMaxBackoff {
+				backoff = PersistMaxBackoff
+			}
+			retry = time.After(backoff)
+		case <-s.persistStop:
+			return
+		}
+	}
+}
+
+// stopPersisting commits the backlog and what is queued, once, and closes
+// storage. persistStopped is closed under replLock, which enqueue sends
+// under, so nothing is queued after the queue is drained; enqueues blocked
+// on a full queue are taken meanwhile.
+func (s *Server) stopPersisting(backlog *[]*DMessage) {
+	stopped := make(chan bool)
+	go func() {
+		s.replLock.Lock()
+		close(s.persistStopped)
+		s.replLock.Unlock()
+		close(stopped)
+	}()
+
+	take := func(dm *DMessage) {
+		if dm != nil {
+			*backlog = append(*backlog, dm)
+		}
+	}
+	for {
+		select {
+		case dm := <-s.persistChan:
+			take(dm)
+			continue
+		case <-stopped:
+		}
+		break
+	}
+	for {
+		select {
+		case dm := <-s.persistChan:
+			take(dm)
+			continue
+		default:
+		}
+		break
+	}
+
+	if len(*backlog) != 0 {
+		if err := s.drain(backlog); err != nil {
+			log.Println(len(*backlog), "operations not persisted:", err)
+		}
+		for _, dm := range *backlog {
+			dm.Done(ErrServerClosed)
+			dm.committed()
+		}
+	}
+	if s.store != nil {
+		if err := s.store.Close(); err != nil {
+			log.Println("Closing storage failed:", err)
+		}
+	}
+}
+
+// collect gathers the operations queued after first into a batch. It stops
+// at an expire request, which is reported instead of being batched.
+func (s *Server) collect(first *DMessage) ([]*DMessage, bool) {
+	if first == nil {
+		return nil, true
+	}
+
+	batch := []*DMessage{first}
+	var timeout <-chan time.Time
+	if s.opts.PersistInterval > 0 {
+		timeout = time.After(s.opts.PersistInterval)
+	}
+
+	for len(batch) < s.opts.PersistBatch {
+		select {
+		case dm := <-s.persistChan:
+			if dm == nil {
+				return batch, true
+			}
+			batch = append(batch, dm)
+			continue
+		default:
+		}
+
+		if timeout == nil {
+			break
+		}
+
+		select {
+		case dm := <-s.persistChan:
+			if dm == nil {
+				return batch, true
+			}
+			batch = append(batch, dm)
+		case <-timeout:
+			return batch, false
+		}
+	}
+	return batch, false
+}
+
+// commit writes batch to storage in one go.
+func (s *Server) commit(batch []*DMessage) error {
+	start := time.Now()
+
+	b, err := s.store.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, dm := range batch {
+		if err := InsertPayload(b, dm); err != nil {
+			b.Rollback()
+			return err
+		}
+	}
+
+	if err := b.Commit(); err != nil {
+		return err
+	}
+
+	s.latency.Observe("commit", time.Since(start))
+	s.nPersistBatches.Add(1)
+	for _, dm := range batch {
+		dm.Done(nil)
+		dm.committed()
+	}
+	return nil
+}
+
+// expireStored drops expired messages from storage, the channels storage
+// says had any are expired in memory later.
+func (s *Server) expireStored() error {
+	start := time.Now()
+
+	names, err := s.store.Expire(start.UnixNano())
+	if err != nil {
+		return err
+	}
+	s.latency.Observe("expire", time.Since(start))
+
+	for _, name := range names {
+		log.Println(name, "has expired messages")
+	}
+	s.expireLater(names)
+	return nil
+}
+
+// expireLater has periodicExpireMessages expire the messages of the named
+// channels in memory, or of all channels if names is nil. The persister
+// never takes channel locks itself, as publishers hold them while they wait
+// for it.
+func (s *Server) expireLater(names []string) {
+	s.expireLock.Lock()
+	defer s.expireLock.Unlock()
+
+	if names == nil {
+		s.expireAll = true
+	}
+	for _, name := range names {
+		s.expiring[name] = true
+	}
+}
+
+// drain opens storage if needed, and commits backlog in order till a batch
+// fails.
+func (s *Server) drain(backlog *[]*DMessage) error {
+	if s.store == nil {
+		if err := s.openLate(backlog); err != nil {
+			return err
+		}
+	}
+
+	for len(*backlog) != 0 {
+		n := len(*backlog)
+		if n > s.opts.PersistBatch {
+			n = s.opts.PersistBatch
+		}
+		if err := s.commit((*backlog)[:n]); err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			(*backlog)[i] = nil
+		}
+		*backlog = (*backlog)[n:]
+	}
+	*backlog = []*DMessage{}
+	return nil
+}
+
+// openLate opens storage for the persister, when it could not be opened on
+// start, and creates the stored channels but those deleted meanwhile. A
+// channel created meanwhile that is also stored keeps its stored definition
+// in storage, so its key is not lost, and the attributes it was created with
+// in memory till restart.
+func (s *Server) openLate(backlog *[]*DMessage) error {
+	store, err := OpenStorage(&s.opts)
+	if err != nil {
+		return err
+	}
+
+	deleted := map[string]bool{}
+	for _, dm := range *backlog {
+		if dm.op == opDelete {
+			deleted[dm.def.Name] = true
+		}
+	}
+
+	redefined := map[string]bool{}
+	err = store.LoadChannels(func(def *ChannelDef) {
+		if deleted[def.Name] {
+			return
+		}
+		if ch := s.LoadChannel(def); ch.Created != def.Created {
+			redefined[def.Name] = true
+		}
+	})
+	if err != nil {
+		store.Close()
+		return err
+	}
+
+	kept := []*DMessage{}
+	for _, dm := range *backlog {
+		if dm.op == opDefine && redefined[dm.def.Name] {
+			continue
+		}
+		kept = append(kept, dm)
+	}
+	*backlog = kept
+	for name := range redefined {
+		log.Println(name, "was created while storage was unavailable,",
+			"its stored definition is kept")
+	}
+
+	s.setStorage(store)
+	log.Println("Storage opened late, stored channels were loaded.")
+	return nil
+}
+
+// expireInMemory expires the messages of the channels passed to
+// expireLater.
+func (s *Server) expireInMemory() {
+	s.expireLock.Lock()
+	all, names := s.expireAll, s.expiring
+	s.expireAll, s.expiring = false, map[string]bool{}
+	s.expireLock.Unlock()
+
+	now := time.Now().UnixNano()
+	if all {
+		for _, ch := range s.ListChannels("") {
+			ch.ExpireOldMessages(now)
+		}
+		return
+	}
+	for name := range names {
+		if ch := s.LookupChannel(name); ch != nil {
+			ch.ExpireOldMessages(now)
+		}
+	}
+}
+
+// startStorage opens storage and loads channels from it, retrying with
+// backoff. If storage stays unavailable, the server starts with no channels
+// and the persister keeps trying to open it. Storage written by a newer
+// martd is an error.
+func (s *Server) startStorage() error {
+	backoff := PersistMinBackoff
+	for i := 0; ; i++ {
+		err := s.openStorage()
+		if err == nil {
+			err = s.readChannels()
+			if err != nil {
+				s.store.Close()
+				s.setStorage(nil)
+				// drop whatever got loaded, it is loaded again on retry
+				s.chanLock.Lock()
+				s.channels = make(map[string]*Channel)
+				s.chanLock.Unlock()
+			}
+		}
+		if err == nil {
+			return nil
+		}
+
+		if _, ok := err.(*SchemaError); ok {
+			return err
+		}
+
+		s.fail(err)
+		if i == s.opts.PersistRetries {
+			log.Println("Storage unavailable, serving from memory:", err)
+			return nil
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// LoadAll calls fn with m == nil for every channel in s, and then for each of
+// its messages, oldest first.
+func LoadAll(s Storage, fn func(def *ChannelDef, m *Message)) error {
+	defs := []*ChannelDef{}
+	err := s.LoadChannels(func(def *ChannelDef) {
+		defs = append(defs, def)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, def := range defs {
+		msgs, err := s.LoadMessages(def.Name, 0)
+		if err != nil {
+			return err
+		}
+		fn(def, nil)
+		for _, m := range msgs {
+			fn(def, m)
+		}
+	}
+	return nil
+}
+
+// readChannels creates all stored channels, their messages are loaded when
+// they are first used.
+func (s *Server) readChannels() error {
+	return s.store.LoadChannels(func(def *ChannelDef) {
+		s.LoadChannel(def)
+	})
+}
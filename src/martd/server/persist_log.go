@@ -0,0 +1,831 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrLogCorrupt = errors.New("corrupt log record")
+
+func init() {
+	Storages["log"] = func(o *Options) (Storage, error) {
+		return OpenLogStorage(o.Persist, o.LogSegmentSize, o.LogCompactInterval)
+	}
+}
+
+// LogStorage writes every operation as a checksummed record to append only
+// segment files in a directory, NNNNNNNN.log. On start the segments are
+// replayed, in order, into an index of the live channels and of where the
+// record of each of their messages is, the messages themselves stay on disk
+// and are read back when loaded. Compaction periodically replaces all but
+// the newest segment with a snapshot of the live state.
+//
+// A record is a 4 byte big endian length, the 4 byte CRC-32 of the body, and
+// the body, a JSON encoded logRecord.
+type LogStorage struct {
+	dir             string
+	segmentSize     int64
+	compactInterval time.Duration
+
+	lock    sync.Mutex
+	chans   map[string]*logChannel
+	readers map[int]*os.File // segments opened for reading, by number
+	file    *os.File
+	seq     int   // number of the segment being written
+	size    int64 // bytes written to it
+	dirty   bool  // written to since the last compaction
+	failed  error // set once the log can not be written to safely
+
+	stop chan bool
+	done chan bool
+}
+
+type logRecord struct {
+	Op     string      `json:"op"`
+	Def    *ChannelDef `json:"def,omitempty"`
+	ID     int64       `json:"id,omitempty"`
+	Before int64       `json:"before,omitempty"`
+	Data   []byte      `json:"data,omitempty"`
+}
+
+// logChannel is a channel in the index.
+type logChannel struct {
+	def  *ChannelDef
+	msgs []logEntry // oldest first
+}
+
+// logEntry is where the append record of a message is.
+type logEntry struct {
+	id   int64
+	seg  int
+	off  int64
+	n    int   // length of the record, header included
+	size int64 // length of the message
+}
+
+// OpenLogStorage opens the log in dir, starting a new segment after
+// segmentSize bytes and compacting every compactInterval.
+func OpenLogStorage(
+	dir string, segmentSize int64, compactInterval time.Duration,
+) (*LogStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &LogStorage{
+		dir:             dir,
+		segmentSize:     segmentSize,
+		compactInterval: compactInterval,
+		chans:           map[string]*logChannel{},
+		readers:         map[int]*os.File{},
+		stop:            make(chan bool),
+		done:            make(chan bool),
+	}
+
+	seqs, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, seq := range seqs {
+		valid, err := readSegment(
+			s.path(seq), func(rec *logRecord, off int64, n int) {
+				s.apply(rec, seq, off, n)
+			},
+		)
+		if err == nil {
+			continue
+		}
+		if err != ErrLogCorrupt || i != len(seqs)-1 {
+			return nil, fmt.Errorf("%s: %s", s.path(seq), err)
+		}
+
+		// a torn write at the end of the last segment, from a crash
+		log.Println("Truncating", s.path(seq), "at", valid, "bytes")
+		if err := os.Truncate(s.path(seq), valid); err != nil {
+			return nil, err
+		}
+	}
+	s.expire(time.Now().UnixNano())
+
+	s.seq = 1
+	if len(seqs) != 0 {
+		s.seq = seqs[len(seqs)-1]
+	}
+	if s.file, s.size, err = s.openSegment(s.seq); err != nil {
+		return nil, err
+	}
+
+	go s.compactor()
+	return s, nil
+}
+
+func (s *LogStorage) path(seq int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%08d.log", seq))
+}
+
+// segments returns the numbers of the segment files, in order.
+func (s *LogStorage) segments() ([]int, error) {
+	names, err := filepath.Glob(filepath.Join(s.dir, "*.log"))
+	if err != nil {
+		return nil, err
+	}
+
+	seqs := []int{}
+	for _, name := range names {
+		base := strings.TrimSuffix(filepath.Base(name), ".log")
+		if seq, err := strconv.Atoi(base); err == nil {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Ints(seqs)
+	return seqs, nil
+}
+
+// openSegment opens segment seq for appending, and returns its size.
+func (s *LogStorage) openSegment(seq int) (*os.File, int64, error) {
+	f, err := os.OpenFile(
+		s.path(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, st.Size(), nil
+}
+
+// roll starts the next segment, and only then closes the one being written,
+// so there is always one to write to. The caller holds lock.
+func (s *LogStorage) roll() error {
+	f, size, err := s.openSegment(s.seq + 1)
+	if err != nil {
+		return err
+	}
+
+	if err := s.file.Close(); err != nil {
+		log.Println("Closing", s.path(s.seq), "failed:", err)
+	}
+	s.file = f
+	s.size = size
+	s.seq++
+	return nil
+}
+
+// readSegment calls fn for each record in the file, with its offset and
+// length. On ErrLogCorrupt, valid is the length of the file up to the bad
+// record.
+func readSegment(
+	path string, fn func(rec *logRecord, off int64, n int),
+) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	valid := int64(0)
+	header := make([]byte, 8)
+
+	for {
+		_, err := io.ReadFull(r, header)
+		if err == io.EOF {
+			return valid, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			return valid, ErrLogCorrupt
+		}
+		if err != nil {
+			return valid, err
+		}
+
+		body := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+		if _, err := io.ReadFull(r, body); err != nil {
+			return valid, ErrLogCorrupt
+		}
+		rec, err := decodeRecord(header, body)
+		if err != nil {
+			return valid, err
+		}
+		fn(rec, valid, len(header)+len(body))
+		valid += int64(len(header) + len(body))
+	}
+}
+
+// decodeRecord checks the body of a record against its header and decodes it.
+func decodeRecord(header, body []byte) (*logRecord, error) {
+	if binary.BigEndian.Uint32(header[0:4]) != uint32(len(body)) ||
+		crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, ErrLogCorrupt
+	}
+
+	rec := &logRecord{}
+	if err := json.Unmarshal(body, rec); err != nil {
+		return nil, ErrLogCorrupt
+	}
+	return rec, nil
+}
+
+// writeRecord writes rec to w and returns the length of the record.
+func writeRecord(w io.Writer, rec *logRecord) (int, error) {
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return 0, err
+	}
+
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(body))
+	if _, err := w.Write(header); err != nil {
+		return 0, err
+	}
+	if _, err = w.Write(body); err != nil {
+		return 0, err
+	}
+	return len(header) + len(body), nil
+}
+
+// readMessage reads the message of e from f, the segment it is in.
+func readMessage(f *os.File, e *logEntry) (*Message, error) {
+	buf := make([]byte, e.n)
+	if _, err := f.ReadAt(buf, e.off); err != nil {
+		return nil, err
+	}
+
+	rec, err := decodeRecord(buf[:8], buf[8:])
+	if err != nil {
+		return nil, err
+	}
+	if rec.Op != "append" || rec.ID != e.id {
+		return nil, ErrLogCorrupt
+	}
+	return &Message{Data: rec.Data, Created: rec.ID}, nil
+}
+
+// read reads the message of e, the caller holds lock.
+func (s *LogStorage) read(e *logEntry) (*Message, error) {
+	f, ok := s.readers[e.seg]
+	if !ok {
+		var err error
+		if f, err = os.Open(s.path(e.seg)); err != nil {
+			return nil, err
+		}
+		s.readers[e.seg] = f
+	}
+	return readMessage(f, e)
+}
+
+// closeReaders closes the segments up to seq opened for reading, the caller
+// holds lock.
+func (s *LogStorage) closeReaders(upto int) {
+	for seq, f := range s.readers {
+		if seq <= upto {
+			f.Close()
+			delete(s.readers, seq)
+		}
+	}
+}
+
+// apply replays a record, which is n bytes at off in segment seq, on the
+// index.
+func (s *LogStorage) apply(rec *logRecord, seq int, off int64, n int) {
+	switch rec.Op {
+	case "snapshot":
+		s.chans = map[string]*logChannel{}
+	case "define":
+		s.define(rec.Def)
+	case "delete":
+		delete(s.chans, rec.Def.Name)
+	case "append":
+		lc, ok := s.chans[rec.Def.Name]
+		if !ok {
+			lc = s.define(rec.Def)
+		}
+		lc.insert(logEntry{
+			id: rec.ID, seg: seq, off: off, n: n, size: int64(len(rec.Data)),
+		})
+	case "evict":
+		s.filter(rec.Def.Name, func(e *logEntry) bool { return e.id != rec.ID })
+	case "trim":
+		if lc, ok := s.chans[rec.Def.Name]; ok {
+			lc.trim(rec.Def)
+		}
+	case "empty":
+		s.filter(rec.Def.Name, func(*logEntry) bool { return false })
+	case "purge":
+		s.filter(rec.Def.Name, func(e *logEntry) bool {
+			return e.id >= rec.Before
+		})
+	default:
+		log.Println("Unknown log record:", rec.Op)
+	}
+}
+
+func (s *LogStorage) define(def *ChannelDef) *logChannel {
+	lc, ok := s.chans[def.Name]
+	if !ok {
+		lc = &logChannel{}
+		s.chans[def.Name] = lc
+	}
+	lc.def = def
+	return lc
+}
+
+// insert adds e in etag order, which is at the end but for messages that
+// come late, from cluster peers.
+func (lc *logChannel) insert(e logEntry) {
+	i := len(lc.msgs)
+	for i > 0 && lc.msgs[i-1].id > e.id {
+		i--
+	}
+	lc.msgs = append(lc.msgs, logEntry{})
+	copy(lc.msgs[i+1:], lc.msgs[i:])
+	lc.msgs[i] = e
+}
+
+// trim keeps the newest messages that fit in both limits of def.
+func (lc *logChannel) trim(def *ChannelDef) {
+	keep := 0
+	bytes := int64(0)
+	for i := len(lc.msgs) - 1; i >= 0; i-- {
+		bytes += lc.msgs[i].size
+		if def.History != 0 && keep >= int(def.History) ||
+			def.HistoryBytes != 0 && bytes > def.HistoryBytes {
+			break
+		}
+		keep++
+	}
+	if keep < len(lc.msgs) {
+		lc.msgs = append([]logEntry{}, lc.msgs[len(lc.msgs)-keep:]...)
+	}
+}
+
+// filter keeps the messages of a channel for which keep returns true, and
+// returns how many it dropped.
+func (s *LogStorage) filter(name string, keep func(*logEntry) bool) int {
+	lc, ok := s.chans[name]
+	if !ok {
+		return 0
+	}
+
+	msgs := lc.msgs[:0]
+	for i := range lc.msgs {
+		if keep(&lc.msgs[i]) {
+			msgs = append(msgs, lc.msgs[i])
+		}
+	}
+	dropped := len(lc.msgs) - len(msgs)
+	lc.msgs = msgs
+	return dropped
+}
+
+// expire drops messages past their channel's life from the index.
+func (s *LogStorage) expire(now int64) []string {
+	names := []string{}
+	for name, lc := range s.chans {
+		life := int64(lc.def.Life)
+		alive := func(e *logEntry) bool { return e.id+life >= now }
+		if s.filter(name, alive) != 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// names returns the channel names in order, the caller holds lock.
+func (s *LogStorage) names() []string {
+	names := make([]string, 0, len(s.chans))
+	for name := range s.chans {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *LogStorage) LoadChannels(fn func(def *ChannelDef)) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, name := range s.names() {
+		fn(s.chans[name].def)
+	}
+	return nil
+}
+
+func (s *LogStorage) LoadMessages(name string, limit int) ([]*Message, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	lc, ok := s.chans[name]
+	if !ok {
+		return nil, nil
+	}
+	entries := lc.msgs
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	return s.readAll(entries)
+}
+
+func (s *LogStorage) Count(name string, limit int) (int, int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	lc, ok := s.chans[name]
+	if !ok {
+		return 0, 0, nil
+	}
+	entries := lc.msgs
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	bytes := int64(0)
+	for _, e := range entries {
+		bytes += e.size
+	}
+	return len(entries), int(bytes), nil
+}
+
+func (s *LogStorage) LoadRange(
+	name string, after, before int64, limit int,
+) ([]*Message, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	lc, ok := s.chans[name]
+	if !ok {
+		return nil, nil
+	}
+	entries := []logEntry{}
+	for _, e := range lc.msgs {
+		if len(entries) == limit {
+			break
+		}
+		if e.id > after && e.id < before {
+			entries = append(entries, e)
+		}
+	}
+	return s.readAll(entries)
+}
+
+func (s *LogStorage) LoadBefore(
+	name string, after, before int64, limit int,
+) ([]*Message, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	lc, ok := s.chans[name]
+	if !ok {
+		return nil, nil
+	}
+	entries := []logEntry{}
+	for i := len(lc.msgs) - 1; i >= 0 && len(entries) < limit; i-- {
+		e := lc.msgs[i]
+		if e.id <= after {
+			break
+		}
+		if e.id < before {
+			entries = append(entries, e)
+		}
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return s.readAll(entries)
+}
+
+// readAll reads the messages of entries, the caller holds lock.
+func (s *LogStorage) readAll(entries []logEntry) ([]*Message, error) {
+	msgs := make([]*Message, 0, len(entries))
+	for i := range entries {
+		m, err := s.read(&entries[i])
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, nil
+}
+
+func (s *LogStorage) Begin() (Batch, error) {
+	return &logBatch{s: s}, nil
+}
+
+func (s *LogStorage) Expire(now int64) ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// nothing to write, replay drops expired messages on its own
+	return s.expire(now), nil
+}
+
+func (s *LogStorage) Close() error {
+	close(s.stop)
+	<-s.done
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closeReaders(s.seq)
+	if err := s.file.Sync(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+func (s *LogStorage) compactor() {
+	defer close(s.done)
+
+	for {
+		select {
+		case <-time.After(s.compactInterval):
+			if err := s.Compact(); err != nil {
+				log.Println("Log compaction failed:", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Compact replaces all segments but the one being written with a snapshot of
+// the live state, dropping evicted, emptied and expired messages. Writing
+// the snapshot does not hold the lock, the segments it reads from are no
+// longer written to. Only switching the index over to it does.
+func (s *LogStorage) Compact() error {
+	s.lock.Lock()
+	if s.failed != nil {
+		s.lock.Unlock()
+		return s.failed
+	}
+	if !s.dirty {
+		s.lock.Unlock()
+		return nil
+	}
+	if err := s.roll(); err != nil {
+		s.lock.Unlock()
+		return err
+	}
+	upto := s.seq - 1
+	snapshot := s.snapshot()
+	s.dirty = false
+	s.lock.Unlock()
+
+	tmp := filepath.Join(s.dir, "compact.tmp")
+	moved, err := s.writeSnapshot(tmp, snapshot)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// the snapshot starts with a snapshot record that resets the state, so
+	// segments before upto are harmless if we crash before removing them
+	if err := os.Rename(tmp, s.path(upto)); err != nil {
+		return err
+	}
+	s.closeReaders(upto)
+
+	// messages written since are in later segments, and messages dropped
+	// since are no longer in the index
+	for name, lc := range s.chans {
+		for i := range lc.msgs {
+			e := &lc.msgs[i]
+			if e.seg > upto {
+				continue
+			}
+			if m, ok := moved[logKey{name, e.id}]; ok {
+				e.seg, e.off, e.n = upto, m.off, m.n
+			}
+		}
+	}
+
+	seqs, err := s.segments()
+	if err != nil {
+		return err
+	}
+	for _, seq := range seqs {
+		if seq < upto {
+			if err := os.Remove(s.path(seq)); err != nil {
+				return err
+			}
+		}
+	}
+
+	log.Println("Compacted log into", s.path(upto))
+	return nil
+}
+
+// logKey is a message of a channel.
+type logKey struct {
+	name string
+	id   int64
+}
+
+// snapshot returns a copy of the index, the caller holds lock.
+func (s *LogStorage) snapshot() []*logChannel {
+	chans := []*logChannel{}
+	for _, name := range s.names() {
+		lc := s.chans[name]
+		chans = append(chans, &logChannel{
+			def: lc.def, msgs: append([]logEntry{}, lc.msgs...),
+		})
+	}
+	return chans
+}
+
+// writeSnapshot writes the records that recreate chans to path, reading the
+// messages from the segments they are in, and returns where in path it
+// wrote each message.
+func (s *LogStorage) writeSnapshot(
+	path string, chans []*logChannel,
+) (map[logKey]logEntry, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	readers := map[int]*os.File{}
+	defer func() {
+		for _, r := range readers {
+			r.Close()
+		}
+	}()
+
+	moved := map[logKey]logEntry{}
+	w := bufio.NewWriter(f)
+	off := int64(0)
+	write := func(rec *logRecord) (logEntry, error) {
+		n, err := writeRecord(w, rec)
+		e := logEntry{id: rec.ID, off: off, n: n}
+		off += int64(n)
+		return e, err
+	}
+
+	if _, err := write(&logRecord{Op: "snapshot"}); err != nil {
+		return nil, err
+	}
+	for _, lc := range chans {
+		if _, err := write(&logRecord{Op: "define", Def: lc.def}); err != nil {
+			return nil, err
+		}
+
+		for i := range lc.msgs {
+			r, ok := readers[lc.msgs[i].seg]
+			if !ok {
+				if r, err = os.Open(s.path(lc.msgs[i].seg)); err != nil {
+					return nil, err
+				}
+				readers[lc.msgs[i].seg] = r
+			}
+			m, err := readMessage(r, &lc.msgs[i])
+			if err != nil {
+				return nil, err
+			}
+
+			e, err := write(&logRecord{
+				Op: "append", Def: &ChannelDef{Name: lc.def.Name},
+				ID: m.Created, Data: m.Data,
+			})
+			if err != nil {
+				return nil, err
+			}
+			moved[logKey{lc.def.Name, e.id}] = e
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	return moved, nil
+}
+
+// logBatch encodes records in memory, Commit writes and syncs them at once.
+type logBatch struct {
+	s    *LogStorage
+	buf  bytes.Buffer
+	recs []*logRecord
+	lens []int
+}
+
+func (b *logBatch) add(rec *logRecord) error {
+	n, err := writeRecord(&b.buf, rec)
+	if err != nil {
+		return err
+	}
+	b.recs = append(b.recs, rec)
+	b.lens = append(b.lens, n)
+	return nil
+}
+
+func (b *logBatch) Define(def *ChannelDef) error {
+	return b.add(&logRecord{Op: "define", Def: def})
+}
+
+func (b *logBatch) Delete(def *ChannelDef) error {
+	return b.add(&logRecord{Op: "delete", Def: &ChannelDef{Name: def.Name}})
+}
+
+func (b *logBatch) Append(def *ChannelDef, m *Message) error {
+	return b.add(&logRecord{Op: "append", Def: def, ID: m.Created, Data: m.Data})
+}
+
+func (b *logBatch) Evict(def *ChannelDef, m *Message) error {
+	return b.add(&logRecord{
+		Op: "evict", Def: &ChannelDef{Name: def.Name}, ID: m.Created,
+	})
+}
+
+func (b *logBatch) Trim(def *ChannelDef) error {
+	return b.add(&logRecord{Op: "trim", Def: &ChannelDef{
+		Name: def.Name, History: def.History, HistoryBytes: def.HistoryBytes,
+	}})
+}
+
+func (b *logBatch) Empty(def *ChannelDef) error {
+	return b.add(&logRecord{Op: "empty", Def: &ChannelDef{Name: def.Name}})
+}
+
+func (b *logBatch) Purge(def *ChannelDef, before int64) error {
+	return b.add(&logRecord{
+		Op: "purge", Def: &ChannelDef{Name: def.Name}, Before: before,
+	})
+}
+
+func (b *logBatch) Commit() error {
+	s := b.s
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.failed != nil {
+		return s.failed
+	}
+	if s.size >= s.segmentSize {
+		if err := s.roll(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(b.buf.Bytes())
+	if err == nil {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		// the batch is retried, so drop whatever part of it got written
+		if n == 0 {
+			return err
+		}
+		if terr := s.file.Truncate(s.size); terr != nil {
+			// replay only forgives a torn record at the very end of the
+			// log, nothing can be written after this one
+			s.failed = fmt.Errorf(
+				"log storage failed, restart to recover: %s", terr,
+			)
+			log.Println(s.path(s.seq), "has a torn record:", terr)
+			return s.failed
+		}
+		return err
+	}
+
+	off := s.size
+	for i, rec := range b.recs {
+		s.apply(rec, s.seq, off, b.lens[i])
+		off += int64(b.lens[i])
+	}
+	s.size += int64(n)
+	s.dirty = true
+	return nil
+}
+
+func (b *logBatch) Rollback() error {
+	b.buf.Reset()
+	b.recs = nil
+	b.lens = nil
+	return nil
+}
@@ -0,0 +1,245 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func openTestLog(t *testing.T, dir string, segmentSize int64) *LogStorage {
+	t.Helper()
+
+	s, err := OpenLogStorage(dir, segmentSize, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// commitOps runs fn on a batch of s and commits it.
+func commitOps(t *testing.T, s *LogStorage, fn func(b Batch)) {
+	t.Helper()
+
+	b, err := s.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn(b)
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func appendMessages(t *testing.T, s *LogStorage, def *ChannelDef, ids ...int64) {
+	t.Helper()
+
+	for _, id := range ids {
+		commitOps(t, s, func(b Batch) {
+			b.Append(def, &Message{Data: []byte(fmt.Sprint("m", id)), Created: id})
+		})
+	}
+}
+
+// checkMessages fails unless the stored messages of def are ids, in order.
+func checkMessages(t *testing.T, s *LogStorage, def *ChannelDef, ids ...int64) {
+	t.Helper()
+
+	msgs, err := s.LoadMessages(def.Name, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != len(ids) {
+		t.Fatalf("got %d messages, want %d", len(msgs), len(ids))
+	}
+	for i, m := range msgs {
+		if m.Created != ids[i] || string(m.Data) != fmt.Sprint("m", ids[i]) {
+			t.Fatalf("message %d is %d %q, want %d", i, m.Created, m.Data, ids[i])
+		}
+	}
+}
+
+func testDef(name string) *ChannelDef {
+	// etags are small numbers in these tests, so life must reach back to 0
+	return &ChannelDef{
+		Name: name, Size: 10, Life: time.Duration(time.Now().UnixNano()) * 2,
+	}
+}
+
+func TestLogReplay(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestLog(t, dir, 1<<20)
+
+	a, b := testDef("a"), testDef("b")
+	commitOps(t, s, func(batch Batch) {
+		batch.Define(a)
+		batch.Define(b)
+	})
+	appendMessages(t, s, a, 1, 2, 3, 4)
+	appendMessages(t, s, b, 5, 6)
+	commitOps(t, s, func(batch Batch) {
+		batch.Evict(a, &Message{Created: 2})
+		batch.Purge(b, 6)
+	})
+	// late messages, from peers, go in etag order
+	appendMessages(t, s, b, 3)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openTestLog(t, dir, 1<<20)
+	defer s.Close()
+
+	names := []string{}
+	s.LoadChannels(func(def *ChannelDef) { names = append(names, def.Name) })
+	if fmt.Sprint(names) != "[a b]" {
+		t.Fatalf("got channels %v", names)
+	}
+	checkMessages(t, s, a, 1, 3, 4)
+	checkMessages(t, s, b, 3, 6)
+
+	msgs, err := s.LoadRange("a", 1, 4, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Created != 3 {
+		t.Fatalf("got range %v", msgs)
+	}
+}
+
+func TestLogTornTail(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestLog(t, dir, 1<<20)
+	def := testDef("a")
+	appendMessages(t, s, def, 1, 2)
+	s.Close()
+
+	path := s.path(1)
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := st.Size()
+
+	// a record cut short, as by a crash in the middle of a write
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 100, 1, 2, 3, 4, '{'})
+	f.Close()
+
+	s = openTestLog(t, dir, 1<<20)
+	checkMessages(t, s, def, 1, 2)
+	if st, _ := os.Stat(path); st.Size() != good {
+		t.Fatalf("segment is %d bytes, want %d", st.Size(), good)
+	}
+	appendMessages(t, s, def, 3)
+	s.Close()
+
+	// a whole record with a bad checksum
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-2] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openTestLog(t, dir, 1<<20)
+	defer s.Close()
+	checkMessages(t, s, def, 1, 2)
+}
+
+func TestLogCorruptMiddle(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestLog(t, dir, 1)
+	def := testDef("a")
+	appendMessages(t, s, def, 1, 2)
+	s.Close()
+
+	// only the end of the last segment may be torn, anything else is lost
+	// data and must not be dropped quietly
+	data, err := os.ReadFile(s.path(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-2] ^= 0xff
+	if err := os.WriteFile(s.path(1), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenLogStorage(dir, 1, time.Hour); err == nil {
+		t.Fatal("opened a log with a corrupt segment")
+	}
+}
+
+func TestLogSegmentRoll(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestLog(t, dir, 1)
+	def := testDef("a")
+	appendMessages(t, s, def, 1, 2, 3)
+
+	seqs, err := s.segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seqs) != 3 {
+		t.Fatalf("got segments %v, want 3", seqs)
+	}
+	checkMessages(t, s, def, 1, 2, 3)
+	s.Close()
+
+	s = openTestLog(t, dir, 1)
+	defer s.Close()
+	appendMessages(t, s, def, 4)
+	checkMessages(t, s, def, 1, 2, 3, 4)
+}
+
+func TestLogCompact(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestLog(t, dir, 1)
+
+	a, b := testDef("a"), testDef("b")
+	appendMessages(t, s, a, 1, 2, 3, 4)
+	appendMessages(t, s, b, 5, 6)
+	commitOps(t, s, func(batch Batch) {
+		batch.Evict(a, &Message{Created: 1})
+		batch.Delete(b)
+	})
+	appendMessages(t, s, a, 7)
+
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	seqs, err := s.segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seqs) != 2 {
+		t.Fatalf("got segments %v after compacting, want 2", seqs)
+	}
+
+	// messages are read back from the snapshot
+	checkMessages(t, s, a, 2, 3, 4, 7)
+	if msgs, _ := s.LoadMessages("b", 0); len(msgs) != 0 {
+		t.Fatalf("deleted channel has %d messages", len(msgs))
+	}
+
+	appendMessages(t, s, a, 8)
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	checkMessages(t, s, a, 2, 3, 4, 7, 8)
+	s.Close()
+
+	s = openTestLog(t, dir, 1)
+	defer s.Close()
+	checkMessages(t, s, a, 2, 3, 4, 7, 8)
+	names := []string{}
+	s.LoadChannels(func(def *ChannelDef) { names = append(names, def.Name) })
+	if fmt.Sprint(names) != "[a]" {
+		t.Fatalf("got channels %v", names)
+	}
+}
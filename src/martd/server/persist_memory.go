@@ -0,0 +1,276 @@
+package server
+
+import (
+	"sort"
+	"sync"
+)
+
+func init() {
+	Storages["memory"] = func(o *Options) (Storage, error) {
+		return NewMemoryStorage(), nil
+	}
+}
+
+// MemoryStorage keeps channels and messages in memory only, nothing survives
+// a restart. Useful for tests and for embedding, when there should be no disk
+// at all.
+type MemoryStorage struct {
+	lock  sync.Mutex
+	chans map[string]*memChannel
+}
+
+type memChannel struct {
+	def  *ChannelDef
+	msgs []*Message // oldest first
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{chans: map[string]*memChannel{}}
+}
+
+func (s *MemoryStorage) LoadChannels(fn func(def *ChannelDef)) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, name := range s.names() {
+		fn(s.chans[name].def)
+	}
+	return nil
+}
+
+func (s *MemoryStorage) LoadMessages(name string, limit int) ([]*Message, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	mc, ok := s.chans[name]
+	if !ok {
+		return nil, nil
+	}
+	msgs := mc.msgs
+	if limit > 0 && len(msgs) > limit {
+		msgs = msgs[len(msgs)-limit:]
+	}
+	return append([]*Message{}, msgs...), nil
+}
+
+func (s *MemoryStorage) Count(name string, limit int) (int, int, error) {
+	msgs, _ := s.LoadMessages(name, limit)
+	bytes := 0
+	for _, m := range msgs {
+		bytes += len(m.Data)
+	}
+	return len(msgs), bytes, nil
+}
+
+func (s *MemoryStorage) LoadRange(
+	name string, after, before int64, limit int,
+) ([]*Message, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	mc, ok := s.chans[name]
+	if !ok {
+		return nil, nil
+	}
+	msgs := []*Message{}
+	for _, m := range mc.msgs {
+		if len(msgs) == limit {
+			break
+		}
+		if m.Created > after && m.Created < before {
+			msgs = append(msgs, m)
+		}
+	}
+	return msgs, nil
+}
+
+func (s *MemoryStorage) LoadBefore(
+	name string, after, before int64, limit int,
+) ([]*Message, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	mc, ok := s.chans[name]
+	if !ok {
+		return nil, nil
+	}
+	msgs := []*Message{}
+	for i := len(mc.msgs) - 1; i >= 0 && len(msgs) < limit; i-- {
+		m := mc.msgs[i]
+		if m.Created <= after {
+			break
+		}
+		if m.Created < before {
+			msgs = append(msgs, m)
+		}
+	}
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+	return msgs, nil
+}
+
+// names returns the channel names in order, the caller holds lock.
+func (s *MemoryStorage) names() []string {
+	names := make([]string, 0, len(s.chans))
+	for name := range s.chans {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Begin returns a batch that applies writes right away, memory can not fail.
+func (s *MemoryStorage) Begin() (Batch, error) {
+	return memBatch{s}, nil
+}
+
+type memBatch struct {
+	*MemoryStorage
+}
+
+func (memBatch) Commit() error {
+	return nil
+}
+
+func (memBatch) Rollback() error {
+	return nil
+}
+
+func (s *MemoryStorage) Define(def *ChannelDef) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.define(def)
+	return nil
+}
+
+// define is Define, the caller holds lock.
+func (s *MemoryStorage) define(def *ChannelDef) *memChannel {
+	mc, ok := s.chans[def.Name]
+	if !ok {
+		mc = &memChannel{}
+		s.chans[def.Name] = mc
+	}
+	mc.def = def
+	return mc
+}
+
+func (s *MemoryStorage) Delete(def *ChannelDef) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.chans, def.Name)
+	return nil
+}
+
+func (s *MemoryStorage) Append(def *ChannelDef, m *Message) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	mc, ok := s.chans[def.Name]
+	if !ok {
+		mc = s.define(def)
+	}
+
+	// in etag order, messages of cluster peers can come late
+	i := len(mc.msgs)
+	for i > 0 && mc.msgs[i-1].Created > m.Created {
+		i--
+	}
+	mc.msgs = append(mc.msgs, nil)
+	copy(mc.msgs[i+1:], mc.msgs[i:])
+	mc.msgs[i] = m
+	return nil
+}
+
+// filter keeps the messages of a channel for which keep returns true, the
+// caller holds lock.
+func (s *MemoryStorage) filter(name string, keep func(*Message) bool) int {
+	mc, ok := s.chans[name]
+	if !ok {
+		return 0
+	}
+
+	msgs := mc.msgs[:0]
+	for _, m := range mc.msgs {
+		if keep(m) {
+			msgs = append(msgs, m)
+		}
+	}
+	dropped := len(mc.msgs) - len(msgs)
+	for i := len(msgs); i < len(mc.msgs); i++ {
+		mc.msgs[i] = nil
+	}
+	mc.msgs = msgs
+	return dropped
+}
+
+func (s *MemoryStorage) Evict(def *ChannelDef, m *Message) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.filter(def.Name, func(o *Message) bool { return o.Created != m.Created })
+	return nil
+}
+
+func (s *MemoryStorage) Trim(def *ChannelDef) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	mc, ok := s.chans[def.Name]
+	if !ok {
+		return nil
+	}
+
+	// count back from the newest, keeping what fits in both limits
+	keep := 0
+	bytes := int64(0)
+	for i := len(mc.msgs) - 1; i >= 0; i-- {
+		bytes += int64(len(mc.msgs[i].Data))
+		if def.History != 0 && keep >= int(def.History) ||
+			def.HistoryBytes != 0 && bytes > def.HistoryBytes {
+			break
+		}
+		keep++
+	}
+	if keep < len(mc.msgs) {
+		mc.msgs = append([]*Message{}, mc.msgs[len(mc.msgs)-keep:]...)
+	}
+	return nil
+}
+
+func (s *MemoryStorage) Empty(def *ChannelDef) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.filter(def.Name, func(*Message) bool { return false })
+	return nil
+}
+
+func (s *MemoryStorage) Purge(def *ChannelDef, before int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.filter(def.Name, func(m *Message) bool { return m.Created >= before })
+	return nil
+}
+
+func (s *MemoryStorage) Expire(now int64) ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	names := []string{}
+	for name, mc := range s.chans {
+		life := int64(mc.def.Life)
+		alive := func(m *Message) bool { return m.Created+life >= now }
+		if s.filter(name, alive) != 0 {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (s *MemoryStorage) Close() error {
+	return nil
+}
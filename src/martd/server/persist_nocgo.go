@@ -0,0 +1,10 @@
+//go:build !cgo
+// +build !cgo
+
+package server
+
+// Without cgo there is no sqlite, the log storage is the default.
+const (
+	defaultStorage = "log"
+	defaultPersist = "persist"
+)
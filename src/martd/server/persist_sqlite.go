@@ -0,0 +1,467 @@
+//go:build cgo
+// +build cgo
+
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	defaultStorage = "sqlite"
+	defaultPersist = "persist.db"
+)
+
+func init() {
+	Storages["sqlite"] = func(o *Options) (Storage, error) {
+		db, err := GetDB(o.Persist)
+		if err != nil {
+			return nil, err
+		}
+		return NewSQLiteStorage(db)
+	}
+}
+
+// SQLiteStorage keeps channel attributes in the channels table, and every
+// message as a row of the payloads table (which also has the attributes, as
+// older versions only had that).
+type SQLiteStorage struct {
+	db                          *sql.DB
+	insert, evict, empty, purge *sql.Stmt
+	define, forget              *sql.Stmt
+	trimCount, trimBytes        *sql.Stmt
+}
+
+// NewSQLiteStorage prepares the statements used by batches once, so they can
+// be reused by every transaction.
+func NewSQLiteStorage(db *sql.DB) (*SQLiteStorage, error) {
+	s := &SQLiteStorage{db: db}
+
+	for _, p := range []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		// a failed batch is rolled back, so its retry inserts again
+		{&s.insert, `insert into payloads(
+				id, channel, expiry, size, life, one2one, key, payload
+			) values (?, ?, ?, ?, ?, ?, ?, ?)`},
+		{&s.evict, "delete from payloads where channel = ? and id = ?"},
+		{&s.empty, "delete from payloads where channel = ?"},
+		{&s.purge, "delete from payloads where channel = ? and id < ?"},
+		{&s.define, `insert or replace into channels(
+				name, size, life, one2one, key, created, history, history_bytes
+			) values (?, ?, ?, ?, ?, ?, ?, ?)`},
+		{&s.forget, "delete from channels where name = ?"},
+		// older than the history'th newest
+		{&s.trimCount, `delete from payloads where channel = ? and id < (
+				select id from payloads where channel = ?
+				order by id desc limit 1 offset ?
+			)`},
+		// the newest one that no longer fits in history_bytes, and older
+		{&s.trimBytes, `delete from payloads where channel = ? and id <= (
+				select id from (
+					select id, sum(length(payload)) over (order by id desc) total
+					from payloads where channel = ?
+				) where total > ? order by id desc limit 1
+			)`},
+	} {
+		stmt, err := db.Prepare(p.query)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		*p.stmt = stmt
+	}
+
+	return s, nil
+}
+
+// migrations upgrade the schema of persist.db, migrations[i] takes it from
+// version i to i+1. Only ever append to this.
+var migrations = []string{
+	// 1: payloads, with the channel attributes on every row. Databases from
+	// before versioning already have it.
+	`create table if not exists payloads (
+		id      integer not null primary key,
+		channel text,
+		expiry  integer,
+		size    integer,
+		life    integer, -- nanoseconds
+		one2one integer,
+		key     text,
+		payload blob
+	)`,
+	// 2: channels outlive their messages, filled from payloads
+	`create table if not exists channels (
+		name    text not null primary key,
+		size    integer,
+		life    integer, -- nanoseconds
+		one2one integer,
+		key     text,
+		created integer
+	);
+	insert or ignore into channels(name, size, life, one2one, key, created)
+	select channel, size, life, one2one, key, min(id)
+	from payloads group by channel`,
+	// 3: channel messages are loaded on demand
+	`create index if not exists payloads_channel on payloads(channel, id)`,
+	// 4: channels that spill to disk, 0 for the rest
+	`alter table channels add column history integer not null default 0;
+	alter table channels add column history_bytes integer not null default 0`,
+	// 5: etags are only unique within a channel, messages of peers can have
+	// the etag of a local one
+	`create table payloads_new (
+		id      integer not null,
+		channel text not null,
+		expiry  integer,
+		size    integer,
+		life    integer, -- nanoseconds
+		one2one integer,
+		key     text,
+		payload blob,
+		primary key (channel, id)
+	);
+	insert into payloads_new
+	select id, channel, expiry, size, life, one2one, key, payload
+	from payloads where channel is not null;
+	drop table payloads;
+	alter table payloads_new rename to payloads`,
+}
+
+// GetDB opens and migrates the database at path. It is in WAL mode, and
+// waits on locks, as channels are loaded outside the persister.
+func GetDB(path string) (*sql.DB, error) {
+	db, err := sql.Open(
+		"sqlite3", "file:"+path+"?_busy_timeout=5000&_journal_mode=WAL",
+	)
+	if err != nil {
+		log.Println("Failed to open DB", err)
+		return db, err
+	}
+
+	if err := Migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// OpenDBReadOnly opens the SQLite file at path without writing to it, not
+// even to migrate, for commands that only look. The schema must be the one
+// this martd writes.
+func OpenDBReadOnly(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := SchemaVersion(db)
+	if err == nil && version > len(migrations) {
+		err = &SchemaError{version, len(migrations)}
+	}
+	if err == nil && version < len(migrations) {
+		err = fmt.Errorf(
+			"database schema version %d is older than this martd's (%d), "+
+				"run martd -migrate-only first", version, len(migrations),
+		)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Migrate brings the schema up to the latest version, each migration in its
+// own transaction.
+func Migrate(db *sql.DB) error {
+	_, err := db.Exec(
+		"create table if not exists schema_version (version integer not null)",
+	)
+	if err != nil {
+		return err
+	}
+
+	version, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return &SchemaError{version, len(migrations)}
+	}
+
+	for ; version < len(migrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(migrations[version])
+		if err == nil {
+			_, err = tx.Exec("delete from schema_version")
+		}
+		if err == nil {
+			_, err = tx.Exec(
+				"insert into schema_version(version) values (?)", version+1,
+			)
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %s", version+1, err)
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.Println("Migrated database to schema version", version+1)
+	}
+
+	return nil
+}
+
+// SchemaVersion returns the schema version of db, 0 if it is unversioned.
+func SchemaVersion(db *sql.DB) (int, error) {
+	var version sql.NullInt64 // null if there is no row yet
+	err := db.QueryRow("select max(version) from schema_version").Scan(
+		&version,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+func (s *SQLiteStorage) LoadChannels(fn func(def *ChannelDef)) error {
+	_, err := s.db.Exec(
+		"delete from payloads where expiry < ?", time.Now().UnixNano(),
+	)
+	if err != nil {
+		return err
+	}
+
+	rows, err := s.db.Query(
+		`select name, size, life, one2one, key, created, history, history_bytes
+		from channels`,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var life int64
+		def := &ChannelDef{}
+		err := rows.Scan(
+			&def.Name, &def.Size, &life, &def.One2One, &def.Key, &def.Created,
+			&def.History, &def.HistoryBytes,
+		)
+		if err != nil {
+			return err
+		}
+		def.Life = time.Duration(life)
+		fn(def)
+	}
+	return rows.Err()
+}
+
+func (s *SQLiteStorage) LoadMessages(name string, limit int) ([]*Message, error) {
+	if limit == 0 {
+		limit = -1 // no limit in sqlite
+	}
+	return s.loadMessages(
+		`select id, payload from (
+			select id, payload from payloads
+			where channel = ? and expiry >= ? order by id desc limit ?
+		) order by id`,
+		name, time.Now().UnixNano(), limit,
+	)
+}
+
+func (s *SQLiteStorage) Count(name string, limit int) (int, int, error) {
+	if limit == 0 {
+		limit = -1
+	}
+	n, bytes := 0, sql.NullInt64{}
+	err := s.db.QueryRow(
+		`select count(*), sum(length(payload)) from (
+			select payload from payloads
+			where channel = ? and expiry >= ? order by id desc limit ?
+		)`,
+		name, time.Now().UnixNano(), limit,
+	).Scan(&n, &bytes)
+	return n, int(bytes.Int64), err
+}
+
+func (s *SQLiteStorage) LoadRange(
+	name string, after, before int64, limit int,
+) ([]*Message, error) {
+	return s.loadMessages(
+		`select id, payload from payloads
+		where channel = ? and expiry >= ? and id > ? and id < ?
+		order by id limit ?`,
+		name, time.Now().UnixNano(), after, before, limit,
+	)
+}
+
+func (s *SQLiteStorage) LoadBefore(
+	name string, after, before int64, limit int,
+) ([]*Message, error) {
+	return s.loadMessages(
+		`select id, payload from (
+			select id, payload from payloads
+			where channel = ? and expiry >= ? and id > ? and id < ?
+			order by id desc limit ?
+		) order by id`,
+		name, time.Now().UnixNano(), after, before, limit,
+	)
+}
+
+func (s *SQLiteStorage) loadMessages(
+	query string, args ...interface{},
+) ([]*Message, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	msgs := []*Message{}
+	for rows.Next() {
+		m := &Message{}
+		if err := rows.Scan(&m.Created, &m.Data); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, rows.Err()
+}
+
+func (s *SQLiteStorage) Begin() (Batch, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteBatch{s, tx}, nil
+}
+
+type sqliteBatch struct {
+	s  *SQLiteStorage
+	tx *sql.Tx
+}
+
+func (b *sqliteBatch) Append(def *ChannelDef, m *Message) error {
+	_, err := b.tx.Stmt(b.s.insert).Exec(
+		m.Created, def.Name, m.Created+int64(def.Life), def.Size,
+		int64(def.Life), def.One2One, def.Key, m.Data,
+	)
+	return err
+}
+
+func (b *sqliteBatch) Evict(def *ChannelDef, m *Message) error {
+	_, err := b.tx.Stmt(b.s.evict).Exec(def.Name, m.Created)
+	return err
+}
+
+func (b *sqliteBatch) Trim(def *ChannelDef) error {
+	if def.History != 0 {
+		_, err := b.tx.Stmt(b.s.trimCount).Exec(
+			def.Name, def.Name, def.History-1,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	if def.HistoryBytes != 0 {
+		_, err := b.tx.Stmt(b.s.trimBytes).Exec(
+			def.Name, def.Name, def.HistoryBytes,
+		)
+		return err
+	}
+	return nil
+}
+
+func (b *sqliteBatch) Empty(def *ChannelDef) error {
+	_, err := b.tx.Stmt(b.s.empty).Exec(def.Name)
+	return err
+}
+
+func (b *sqliteBatch) Purge(def *ChannelDef, before int64) error {
+	_, err := b.tx.Stmt(b.s.purge).Exec(def.Name, before)
+	return err
+}
+
+func (b *sqliteBatch) Define(def *ChannelDef) error {
+	_, err := b.tx.Stmt(b.s.define).Exec(
+		def.Name, def.Size, int64(def.Life), def.One2One, def.Key, def.Created,
+		def.History, def.HistoryBytes,
+	)
+	return err
+}
+
+func (b *sqliteBatch) Delete(def *ChannelDef) error {
+	if _, err := b.tx.Stmt(b.s.empty).Exec(def.Name); err != nil {
+		return err
+	}
+	_, err := b.tx.Stmt(b.s.forget).Exec(def.Name)
+	return err
+}
+
+func (b *sqliteBatch) Commit() error {
+	return b.tx.Commit()
+}
+
+func (b *sqliteBatch) Rollback() error {
+	return b.tx.Rollback()
+}
+
+func (s *SQLiteStorage) Expire(now int64) ([]string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(
+		"select distinct(channel) from payloads where expiry < ?", now,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+
+	if len(names) == 0 {
+		return names, nil
+	}
+
+	_, err = tx.Exec("delete from payloads where expiry < ?", now)
+	if err != nil {
+		return nil, err
+	}
+	return names, tx.Commit()
+}
+
+func (s *SQLiteStorage) Close() error {
+	for _, stmt := range []*sql.Stmt{
+		s.insert, s.evict, s.empty, s.purge, s.define, s.forget,
+		s.trimCount, s.trimBytes,
+	} {
+		stmt.Close()
+	}
+	return s.db.Close()
+}
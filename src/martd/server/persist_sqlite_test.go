@@ -0,0 +1,105 @@
+//go:build cgo
+// +build cgo
+
+package server
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openTestDB returns a new SQLiteStorage in a temporary directory.
+func openTestDB(t *testing.T) *SQLiteStorage {
+	t.Helper()
+
+	db, err := GetDB(filepath.Join(t.TempDir(), "persist.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewSQLiteStorage(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestSQLiteStorage(t *testing.T) {
+	testStorage(t, openTestDB(t))
+}
+
+func TestSQLiteDefinitions(t *testing.T) {
+	testDefinitions(t, "sqlite", filepath.Join(t.TempDir(), "persist.db"))
+}
+
+func TestMigrate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "persist.db")
+
+	// a database from before versioning
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(
+		`create table payloads (
+			id      integer not null primary key,
+			channel text,
+			expiry  integer,
+			size    integer,
+			life    integer,
+			one2one integer,
+			key     text,
+			payload blob
+		);
+		insert into payloads values (1, 'old', ?, 10, 1, 0, 'k', 'p')`,
+		time.Now().Add(time.Hour).UnixNano(),
+	)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = GetDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, err := SchemaVersion(db); version != len(migrations) {
+		t.Fatalf("migrated to %d: %v", version, err)
+	}
+	store, err := NewSQLiteStorage(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := dump(t, store); got != "old/10: p" {
+		t.Fatalf("migrated %q", got)
+	}
+	keys := ""
+	store.LoadChannels(func(def *ChannelDef) { keys += def.Key })
+	if keys != "k" {
+		t.Fatalf("key %q", keys)
+	}
+
+	// migrating again changes nothing
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(
+		"update schema_version set version = ?", len(migrations)+1,
+	)
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a newer martd's database is refused, even read only
+	if _, err := GetDB(path); err == nil {
+		t.Fatal("opened a database from the future")
+	} else if _, ok := err.(*SchemaError); !ok {
+		t.Fatal(err)
+	}
+	if _, err := OpenDBReadOnly(path); err == nil {
+		t.Fatal("opened a database from the future read only")
+	}
+}
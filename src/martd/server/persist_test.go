@@ -0,0 +1,239 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testStorage makes the writes of channels to store, checking what it has
+// after each.
+func testStorage(t *testing.T, store Storage) {
+	t.Helper()
+
+	now := time.Now().UnixNano()
+	a := &ChannelDef{Name: "a", Size: 10, Life: time.Hour, Created: now}
+	b := &ChannelDef{
+		Name: "b", Size: 10, Life: time.Minute, Created: now, Key: "k",
+	}
+	msgs := map[string]*Message{}
+	for i, name := range []string{"a1", "a2", "a3", "b1", "b2"} {
+		msgs[name] = &Message{Data: []byte(name), Created: now + int64(i)}
+	}
+	// b1 is past b's life by expiry, b2 not
+	expiry := now + int64(90*time.Second)
+	msgs["b2"].Created = now + int64(time.Minute)
+
+	for _, step := range []struct {
+		what  string
+		write func(batch Batch) error
+		want  string
+	}{
+		{"append", func(batch Batch) error {
+			batch.Define(a)
+			batch.Define(b)
+			for _, name := range []string{"a1", "a2", "a3", "b1", "b2"} {
+				def := a
+				if name[0] == 'b' {
+					def = b
+				}
+				if err := batch.Append(def, msgs[name]); err != nil {
+					return err
+				}
+			}
+			return nil
+		}, "a/10: a1 a2 a3b/10: b1 b2"},
+		{"evict", func(batch Batch) error {
+			return batch.Evict(a, msgs["a1"])
+		}, "a/10: a2 a3b/10: b1 b2"},
+		{"purge", func(batch Batch) error {
+			return batch.Purge(a, msgs["a3"].Created)
+		}, "a/10: a3b/10: b1 b2"},
+		{"expire", nil, "a/10: a3b/10: b2"},
+		// b is kept, with its key, when it has no messages
+		{"empty", func(batch Batch) error {
+			return batch.Empty(b)
+		}, "a/10: a3b/10:"},
+		{"delete", func(batch Batch) error {
+			return batch.Delete(a)
+		}, "b/10:"},
+	} {
+		if step.write == nil {
+			names, err := store.Expire(expiry)
+			if err != nil || strings.Join(names, ",") != "b" {
+				t.Fatalf("expired %v: %v", names, err)
+			}
+		} else {
+			batch, err := store.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := step.write(batch); err != nil {
+				t.Fatalf("%s: %s", step.what, err)
+			}
+			if err := batch.Commit(); err != nil {
+				t.Fatalf("%s: %s", step.what, err)
+			}
+		}
+		if got := dump(t, store); got != step.want {
+			t.Fatalf("after %s: got %q, want %q", step.what, got, step.want)
+		}
+	}
+
+	keys := ""
+	store.LoadChannels(func(def *ChannelDef) {
+		keys += fmt.Sprintf("%s:%s", def.Name, def.Key)
+	})
+	if keys != "b:k" {
+		t.Fatalf("channels %q", keys)
+	}
+}
+
+func TestStorage(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) { testStorage(t, store) })
+	}
+}
+
+func TestPubSyncShutdown(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		s := newTestServer(t, nil)
+		ch, _ := s.GetOrCreateChannel(
+			&ChannelDef{Name: "c", Size: 10, Life: time.Hour},
+		)
+
+		// publishers that keep going while the server shuts down, each
+		// PubSync must return, if only with ErrServerClosed
+		wg := sync.WaitGroup{}
+		for j := 0; j < 8; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					if _, err := ch.PubSync([]byte("x")); err != nil {
+						return
+					}
+				}
+			}()
+		}
+		time.Sleep(time.Millisecond)
+		s.Shutdown(context.Background())
+
+		done := make(chan bool)
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("PubSync did not return after Shutdown")
+		}
+	}
+}
+
+func TestUnknownStorage(t *testing.T) {
+	opts := Defaults
+	opts.Storage = "tape"
+	if _, err := New(&opts); err == nil {
+		t.Fatal("server with an unknown storage")
+	}
+}
+
+// brokenStorage fails to begin batches while broken is set.
+type brokenStorage struct {
+	Storage
+	broken int32 // accessed atomically
+}
+
+func (s *brokenStorage) Begin() (Batch, error) {
+	if atomic.LoadInt32(&s.broken) != 0 {
+		return nil, errors.New("disk full")
+	}
+	return s.Storage.Begin()
+}
+
+func TestPersistDegraded(t *testing.T) {
+	s := newTestServer(t, nil)
+	store := &brokenStorage{Storage: s.storage(), broken: 1}
+	s.setStorage(store)
+
+	ch, _ := s.GetOrCreateChannel(
+		&ChannelDef{Name: "c", Size: 10, Life: time.Hour},
+	)
+	if _, err := ch.PubSync([]byte("1")); err == nil {
+		t.Fatal("PubSync persisted to broken storage")
+	}
+	ch.Pub([]byte("2"))
+
+	// served from memory meanwhile
+	if got := historyData(t, ch); got != "12" {
+		t.Fatalf("history %q", got)
+	}
+	health := s.health.Get()
+	if health.Healthy || health.Error != "disk full" || health.Backlog == 0 {
+		t.Fatalf("health %+v", health)
+	}
+	w := httptest.NewRecorder()
+	s.HealthHandler(w, httptest.NewRequest("GET", "/health", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("/health: %d", w.Code)
+	}
+	if s.nPersistErrors.Value() == 0 {
+		t.Fatal("no errors counted")
+	}
+
+	// the backlog is written once storage is back
+	atomic.StoreInt32(&store.broken, 0)
+	eventually(t, "recovery", func() bool {
+		health := s.health.Get()
+		return health.Healthy && health.Backlog == 0
+	})
+	stored, err := store.LoadMessages("c", 0)
+	if err != nil || payloads(stored) != "12" {
+		t.Fatalf("stored %q: %v", payloads(stored), err)
+	}
+}
+
+// testDefinitions checks that a channel without messages keeps its
+// attributes over a restart with storage at path.
+func testDefinitions(t *testing.T, storage, path string) {
+	t.Helper()
+
+	configure := func(o *Options) { o.Storage, o.Persist = storage, path }
+	s := newTestServer(t, configure)
+	def := &ChannelDef{
+		Name: "c", Size: 5, Life: time.Minute, One2One: true, Key: "k",
+	}
+	if _, err := s.Publish(def, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	s.Shutdown(context.Background())
+
+	s = newTestServer(t, configure)
+	ch := s.LookupChannel("c")
+	if ch == nil {
+		t.Fatal("channel forgotten")
+	}
+	if got := ch.Def(); got.Size != 5 || got.Life != time.Minute ||
+		!got.One2One || got.Key != "k" || got.Created == 0 {
+		t.Fatalf("restored %+v", got)
+	}
+	_, err := s.Publish(
+		&ChannelDef{Name: "c", Size: 10, Life: time.Hour}, []byte("x"), false,
+	)
+	if err != ErrInvalidKey {
+		t.Fatal("published without the key:", err)
+	}
+}
+
+func TestLogDefinitions(t *testing.T) {
+	testDefinitions(t, "log", t.TempDir())
+}
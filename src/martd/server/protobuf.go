@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// The protocol buffer wire format, enough of it for the messages of
+// martd.proto. Like proto3, fields with zero values are not written.
+
+var errPBTruncated = errors.New("protobuf: truncated message")
+
+const (
+	pbVarint  = 0
+	pbFixed64 = 1
+	pbBytes   = 2
+	pbFixed32 = 5
+)
+
+type pbWriter struct {
+	b []byte
+}
+
+func (p *pbWriter) varint(v uint64) {
+	p.b = binary.AppendUvarint(p.b, v)
+}
+
+func (p *pbWriter) tag(field, wire int) {
+	p.varint(uint64(field)<<3 | uint64(wire))
+}
+
+func (p *pbWriter) Uint(field int, v uint64) {
+	if v != 0 {
+		p.tag(field, pbVarint)
+		p.varint(v)
+	}
+}
+
+func (p *pbWriter) Int(field int, v int64) {
+	p.Uint(field, uint64(v))
+}
+
+func (p *pbWriter) Bool(field int, v bool) {
+	if v {
+		p.Uint(field, 1)
+	}
+}
+
+func (p *pbWriter) Bytes(field int, v []byte) {
+	if len(v) != 0 {
+		p.Message(field, v)
+	}
+}
+
+func (p *pbWriter) String(field int, v string) {
+	p.Bytes(field, []byte(v))
+}
+
+// Message writes an embedded message, even if empty, as each one is an
+// element of a repeated field.
+func (p *pbWriter) Message(field int, v []byte) {
+	p.tag(field, pbBytes)
+	p.varint(uint64(len(v)))
+	p.b = append(p.b, v...)
+}
+
+// Ints writes a packed repeated field.
+func (p *pbWriter) Ints(field int, vs []int64) {
+	packed := &pbWriter{}
+	for _, v := range vs {
+		packed.varint(uint64(v))
+	}
+	p.Bytes(field, packed.b)
+}
+
+// pbFields calls f with each field of message b: v is the value of varint and
+// fixed fields, data that of length delimited ones.
+func pbFields(b []byte, f func(field, wire int, v uint64, data []byte) error) error {
+	for len(b) != 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errPBTruncated
+		}
+		b = b[n:]
+		field, wire := int(key>>3), int(key&7)
+
+		v, data := uint64(0), []byte(nil)
+		switch wire {
+		case pbVarint:
+			if v, n = binary.Uvarint(b); n <= 0 {
+				return errPBTruncated
+			}
+			b = b[n:]
+		case pbFixed64:
+			if len(b) < 8 {
+				return errPBTruncated
+			}
+			v, b = binary.LittleEndian.Uint64(b), b[8:]
+		case pbFixed32:
+			if len(b) < 4 {
+				return errPBTruncated
+			}
+			v, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case pbBytes:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || size > uint64(len(b)-n) {
+				return errPBTruncated
+			}
+			data, b = b[n:n+int(size)], b[n+int(size):]
+		default:
+			return errors.New("protobuf: unsupported wire type")
+		}
+
+		if err := f(field, wire, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestPBRoundTrip(t *testing.T) {
+	inner := &pbWriter{}
+	inner.String(1, "news")
+
+	w := &pbWriter{}
+	w.Uint(1, 300)
+	w.Int(2, -1)
+	w.Bool(3, true)
+	w.Bool(4, false)
+	w.Bytes(5, []byte{0, 1, 2})
+	w.String(6, "")
+	w.Message(7, inner.b)
+	w.Message(7, nil)
+	w.Ints(8, []int64{1, 150, 1 << 40})
+
+	got := map[int][]interface{}{}
+	err := pbFields(w.b, func(field, wire int, v uint64, data []byte) error {
+		if wire == pbBytes {
+			got[field] = append(got[field], string(data))
+		} else {
+			got[field] = append(got[field], v)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got[1][0] != uint64(300) || int64(got[2][0].(uint64)) != -1 ||
+		got[3][0] != uint64(1) {
+		t.Fatalf("varints decoded as %v %v %v", got[1], got[2], got[3])
+	}
+	if got[4] != nil || got[6] != nil {
+		t.Fatal("zero values were written")
+	}
+	if got[5][0] != "\x00\x01\x02" {
+		t.Fatalf("bytes decoded as %q", got[5])
+	}
+	if len(got[7]) != 2 || got[7][0] != string(inner.b) || got[7][1] != "" {
+		t.Fatalf("messages decoded as %q", got[7])
+	}
+
+	packed := []int64{}
+	for data := []byte(got[8][0].(string)); len(data) != 0; {
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			t.Fatalf("bad packed varint % x", data)
+		}
+		packed = append(packed, int64(v))
+		data = data[n:]
+	}
+	if len(packed) != 3 || packed[0] != 1 || packed[1] != 150 ||
+		packed[2] != 1<<40 {
+		t.Fatalf("packed ints decoded as %v", packed)
+	}
+}
+
+func TestPBTruncated(t *testing.T) {
+	for _, b := range [][]byte{
+		{0x08},            // no value
+		{0x08, 0x80},      // unfinished varint
+		{0x12, 0x05, 'a'}, // bytes longer than the message
+		{0x09, 1, 2, 3},   // short fixed64
+		{0x0d, 1, 2},      // short fixed32
+		{0x80},            // unfinished key
+	} {
+		err := pbFields(b, func(int, int, uint64, []byte) error { return nil })
+		if err != errPBTruncated {
+			t.Errorf("% x: got %v", b, err)
+		}
+	}
+}
+
+// TestDecodePublish decodes a PublishRequest of martd.proto as protoc
+// generated code writes it, with a field martd does not know at the end.
+func TestDecodePublish(t *testing.T) {
+	req := []byte{
+		0x0a, 4, 'n', 'e', 'w', 's', // channel
+		0x12, 2, 'h', 'i', // data
+		0x18, 5, // size
+		0x20, 0x80, 0xb0, 0x9d, 0xc2, 0xdf, 0x01, // life, a minute
+		0x28, 1, // one2one
+		0x32, 1, 'k', // key
+		0x38, 1, // sync
+		0x40, 20, // history
+		0x48, 0xe8, 0x07, // history_bytes, 1000
+		0x7d, 1, 2, 3, 4, // field 15, fixed32
+	}
+
+	def, data, sync, err := decodePublish(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ChannelDef{
+		Name: "news", Size: 5, Life: time.Minute, One2One: true, Key: "k",
+		History: 20, HistoryBytes: 1000,
+	}
+	if *def != want || !bytes.Equal(data, []byte("hi")) || !sync {
+		t.Fatalf("decoded %+v %q %v", def, data, sync)
+	}
+
+	// absent fields are the defaults of /pub
+	def, _, _, err = decodePublish([]byte{0x0a, 1, 'c'})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if def.Size != DefaultSize || def.Life != DefaultLife {
+		t.Fatalf("decoded %+v", def)
+	}
+
+	if _, _, _, err := decodePublish([]byte{0x12, 1, 'x'}); err == nil {
+		t.Fatal("decoded a request without channel")
+	}
+}
@@ -0,0 +1,470 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+func newReplID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalln("Could not generate node id:", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// replRecord is one line of the replication stream, an operation, or a
+// channel or message of a snapshot, in the export format.
+type replRecord struct {
+	Seq  int64  `json:"seq,omitempty"`
+	Op   string `json:"op,omitempty"`
+	Node string `json:"node,omitempty"` // for snapshot
+
+	Def    *ChannelDef `json:"def,omitempty"`
+	Etag   int64       `json:"etag,string,omitempty"`
+	Before int64       `json:"before,string,omitempty"`
+	Data   []byte      `json:"data,omitempty"`
+
+	exportRecord
+}
+
+// record adds dm to the replication log, the caller holds replLock.
+// Evictions are not recorded, followers have the same channel sizes and
+// evict the same messages.
+func (s *Server) record(dm *DMessage) {
+	if s.opts.ClusterKey == "" {
+		return
+	}
+
+	rec := &replRecord{Def: dm.def}
+	switch dm.op {
+	case opAppend:
+		rec.Op, rec.Etag, rec.Data = "append", dm.m.Created, dm.m.Data
+	case opEmpty:
+		rec.Op = "empty"
+	case opPurge:
+		rec.Op, rec.Before = "purge", dm.before
+	case opDefine:
+		rec.Op = "define"
+	case opDelete:
+		rec.Op = "delete"
+	default:
+		return
+	}
+
+	s.replSeq++
+	rec.Seq = s.replSeq
+	s.replLog = append(s.replLog, rec)
+	if over := len(s.replLog) - s.opts.ReplBacklog; over > 0 {
+		for i := 0; i < over; i++ {
+			s.replLog[i] = nil
+		}
+		s.replLog = s.replLog[over:]
+		s.replFirst += int64(over)
+	}
+
+	close(s.replWake)
+	s.replWake = make(chan bool)
+}
+
+// replSince returns the records after since, and a channel closed when there
+// are more. ok is false if they are no longer in the log, or node is not
+// this run of this node.
+func (s *Server) replSince(
+	node string, since int64,
+) ([]*replRecord, chan bool, bool) {
+	s.replLock.Lock()
+	defer s.replLock.Unlock()
+
+	if node != s.replID || since < s.replFirst-1 || since > s.replSeq {
+		return nil, nil, false
+	}
+	recs := s.replLog[since-s.replFirst+1:]
+	return append([]*replRecord{}, recs...), s.replWake, true
+}
+
+// replSnapshot writes a snapshot record and an export of storage to enc's
+// writer, and returns the sequence number the snapshot is at. It waits for
+// the persister to commit everything recorded before. Operations recorded
+// while the export is read may be in it, replaying them is harmless.
+func (s *Server) replSnapshot(
+	enc *json.Encoder, w http.ResponseWriter,
+) (int64, error) {
+	done := make(chan error, 1)
+	s.replLock.Lock()
+	seq := s.replSeq
+	s.replLock.Unlock()
+	s.enqueue(&DMessage{op: opSync, done: done})
+
+	if err := <-done; err != nil {
+		return 0, err
+	}
+
+	err := enc.Encode(&replRecord{Op: "snapshot", Seq: seq, Node: s.replID})
+	if err != nil {
+		return 0, err
+	}
+	store := s.storage()
+	if store == nil {
+		return 0, ErrPersistDegraded
+	}
+	if _, _, err := Export(store, w); err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+// ReplicateHandler streams the replication log to a follower, as NDJSON,
+// starting with a snapshot if the follower can not continue from since.
+// When there is nothing to send a ping is sent every PeerHeartbeat.
+func (s *Server) ReplicateHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, s.opts.ClusterKey) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	cner, ok2 := w.(http.CloseNotifier)
+	if !ok || !ok2 {
+		s.reject(w, "server issue, handler can not stream")
+		return
+	}
+
+	node := r.FormValue("node")
+	since := int64(0)
+	if v := r.FormValue("since"); v != "" {
+		if _, err := fmt.Sscan(v, &since); err != nil {
+			s.reject(w, "invalid since: "+err.Error())
+			return
+		}
+	}
+
+	s.nFollowers.Add(1)
+	defer s.nFollowers.Add(-1)
+	log.Println("Follower", r.RemoteAddr, "connected at", node, since)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+
+	recs, wake, ok := s.replSince(node, since)
+	if !ok {
+		seq, err := s.replSnapshot(enc, w)
+		if err != nil {
+			log.Println("Snapshot for", r.RemoteAddr, "failed:", err)
+			return
+		}
+		if recs, wake, ok = s.replSince(s.replID, seq); !ok {
+			return // fell behind while sending the snapshot, start over
+		}
+	}
+
+	for {
+		for _, rec := range recs {
+			if err := enc.Encode(rec); err != nil {
+				return
+			}
+			since = rec.Seq
+		}
+		flusher.Flush()
+
+		select {
+		case <-wake:
+		case <-time.After(s.opts.PeerHeartbeat):
+			if err := enc.Encode(&replRecord{Op: "ping"}); err != nil {
+				return
+			}
+		case <-cner.CloseNotify():
+			return
+		case <-s.done:
+			return
+		}
+
+		if recs, wake, ok = s.replSince(s.replID, since); !ok {
+			return
+		}
+	}
+}
+
+// follower replicates the leader at Follow into this node.
+type follower struct {
+	s      *Server
+	stop   chan bool
+	cancel context.CancelFunc
+
+	lock      sync.Mutex
+	node      string
+	seq       int64
+	next      string // node of a snapshot being loaded
+	connected bool
+	lastError string
+}
+
+// ReplicationStatus is the replication state, as shown in stats.
+type ReplicationStatus struct {
+	Role      string `json:"role"` // leader or follower
+	Node      string `json:"node"`
+	Seq       int64  `json:"seq"`
+	Followers int64  `json:"followers,omitempty"`
+
+	Leader     string `json:"leader,omitempty"`
+	LeaderNode string `json:"leader_node,omitempty"`
+	LeaderSeq  int64  `json:"leader_seq,omitempty"`
+	Connected  bool   `json:"connected,omitempty"`
+	LastError  string `json:"last_error,omitempty"`
+}
+
+func (s *Server) GetReplicationStatus() *ReplicationStatus {
+	s.replLock.Lock()
+	status := &ReplicationStatus{
+		Role: "leader", Node: s.replID, Seq: s.replSeq,
+		Followers: s.nFollowers.Value(),
+	}
+	f := s.following
+	s.replLock.Unlock()
+
+	if f != nil {
+		f.lock.Lock()
+		status.Role = "follower"
+		status.Leader = s.opts.Follow
+		status.LeaderNode, status.LeaderSeq = f.node, f.seq
+		status.Connected, status.LastError = f.connected, f.lastError
+		f.lock.Unlock()
+	}
+	return status
+}
+
+// Leader returns the URL of the leader if this node is a follower.
+func (s *Server) Leader() string {
+	s.replLock.Lock()
+	defer s.replLock.Unlock()
+
+	if s.following == nil {
+		return ""
+	}
+	return s.opts.Follow
+}
+
+// startFollowing starts replicating Follow, if set.
+func (s *Server) startFollowing() error {
+	if s.opts.Follow == "" {
+		return nil
+	}
+	if s.opts.ClusterKey == "" {
+		return errors.New("following needs a cluster key")
+	}
+	s.opts.Follow = strings.TrimSuffix(s.opts.Follow, "/")
+
+	f := &follower{s: s, stop: make(chan bool)}
+	s.replLock.Lock()
+	s.following = f
+	s.replLock.Unlock()
+
+	log.Println("Following", s.opts.Follow)
+	s.goRun(f.run)
+	return nil
+}
+
+// Promote stops following, this node takes publishes from now on.
+func (s *Server) Promote() (*ReplicationStatus, error) {
+	f := s.unfollow()
+	if f == nil {
+		return nil, errors.New("not a follower")
+	}
+
+	status := s.GetReplicationStatus()
+	log.Println("Promoted to leader, was at", f.node, f.seq)
+	return status, nil
+}
+
+// unfollow stops the follower, if any, and returns it.
+func (s *Server) unfollow() *follower {
+	s.replLock.Lock()
+	f := s.following
+	s.following = nil
+	s.replLock.Unlock()
+
+	if f == nil {
+		return nil
+	}
+
+	close(f.stop)
+	f.lock.Lock()
+	if f.cancel != nil {
+		f.cancel()
+	}
+	f.lock.Unlock()
+	return f
+}
+
+func (f *follower) run() {
+	backoff := peerMinBackoff
+	for {
+		err := f.stream()
+
+		select {
+		case <-f.stop:
+			return
+		default:
+		}
+
+		f.lock.Lock()
+		if f.connected || f.lastError == "" {
+			log.Println("Replication from", f.s.opts.Follow, "stopped:", err)
+		}
+		f.connected, f.lastError = false, err.Error()
+		f.lock.Unlock()
+
+		select {
+		case <-time.After(backoff):
+		case <-f.stop:
+			return
+		}
+		if backoff *= 2; backoff > PeerMaxBackoff {
+			backoff = PeerMaxBackoff
+		}
+	}
+}
+
+// stream reads the replication stream till it fails, or the leader sends
+// nothing, not even a ping, for three heartbeats.
+func (f *follower) stream() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f.lock.Lock()
+	f.cancel = cancel
+	query := url.Values{
+		"node": {f.node}, "since": {fmt.Sprintf("%d", f.seq)},
+	}
+	f.lock.Unlock()
+
+	req, err := http.NewRequest(
+		"GET", f.s.opts.Follow+"/cluster/replicate?"+query.Encode(), nil,
+	)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+f.s.opts.ClusterKey)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("leader responded %s", resp.Status)
+	}
+
+	heartbeat := f.s.opts.PeerHeartbeat
+	watchdog := time.AfterFunc(3*heartbeat, cancel)
+	defer watchdog.Stop()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		rec := &replRecord{}
+		if err := dec.Decode(rec); err != nil {
+			return err
+		}
+		watchdog.Reset(3 * heartbeat)
+
+		if err := f.apply(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// apply replays a record on this node, through the same channel methods a
+// publish or admin request uses, so subscribers and storage see it, but
+// without forwarding it to peers.
+func (f *follower) apply(rec *replRecord) error {
+	s := f.s
+	switch {
+	case rec.Op == "ping":
+		f.caughtUp(0)
+		return nil
+	case rec.Op == "snapshot":
+		log.Println("Loading snapshot of", s.opts.Follow, "at", rec.Node, rec.Seq)
+		for _, ch := range s.ListChannels("") {
+			s.deleteChannel(ch.Name)
+		}
+		// the snapshot is only complete once what follows it arrives, till
+		// then a reconnect needs a new one
+		f.lock.Lock()
+		f.node, f.next, f.seq = "", rec.Node, rec.Seq
+		f.lock.Unlock()
+		return nil
+	case rec.Channel != nil:
+		def := *rec.Channel
+		s.getOrCreate(&def)
+		return nil
+	case rec.Message != nil:
+		ch := s.LookupChannel(rec.Message.Channel)
+		if ch == nil {
+			return fmt.Errorf("snapshot message before its channel")
+		}
+		ch.PubRemote(rec.Message.Data, rec.Message.Etag)
+		return nil
+	case rec.Def == nil:
+		return fmt.Errorf("invalid replication record %d", rec.Seq)
+	}
+
+	switch rec.Op {
+	case "define", "append":
+		def := *rec.Def
+		ch, _ := s.getOrCreate(&def)
+		if rec.Op == "append" {
+			ch.PubRemote(rec.Data, rec.Etag)
+		}
+	case "empty", "purge":
+		if ch := s.LookupChannel(rec.Def.Name); ch != nil {
+			ch.purgeBefore(rec.Before) // 0 for empty
+		}
+	case "delete":
+		s.deleteChannel(rec.Def.Name)
+	default:
+		log.Println("Unknown replication record:", rec.Op)
+	}
+
+	f.caughtUp(rec.Seq)
+	s.nReplicated.Add(1)
+	return nil
+}
+
+// caughtUp records that everything up to seq (if not 0) has been applied.
+func (f *follower) caughtUp(seq int64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.next != "" {
+		f.node, f.next = f.next, ""
+	}
+	if seq != 0 {
+		f.seq = seq
+	}
+	if !f.connected {
+		log.Println("Replicating", f.s.opts.Follow, "from", f.node, f.seq)
+	}
+	f.connected, f.lastError = true, ""
+}
+
+// AdminPromoteHandler turns a follower into a leader.
+func (s *Server) AdminPromoteHandler(w http.ResponseWriter, r *http.Request) {
+	status, err := s.Promote()
+	if err != nil {
+		s.reject(w, err.Error())
+		return
+	}
+	s.respondJSON(w, status)
+}
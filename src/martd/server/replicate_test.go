@@ -0,0 +1,52 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReplication(t *testing.T) {
+	leader := newTestServer(t, func(o *Options) { o.ClusterKey = "k" })
+	srv := httptest.NewServer(leader)
+	t.Cleanup(srv.Close)
+
+	// what is there before the follower starts comes in a snapshot
+	def := &ChannelDef{Name: "c", Size: 3, Life: time.Hour}
+	ch := testChannel(t, leader, def, 2)
+	follower := newTestServer(t, func(o *Options) {
+		o.ClusterKey, o.Follow = "k", srv.URL
+	})
+	replica := func() string {
+		if ch := follower.LookupChannel("c"); ch != nil {
+			return historyData(t, ch)
+		}
+		return "none"
+	}
+	eventually(t, "the snapshot", func() bool { return replica() == "12" })
+
+	// later operations are streamed, evicting the same messages
+	ch.Pub([]byte("3"))
+	etag := ch.Pub([]byte("4"))
+	eventually(t, "the publishes", func() bool { return replica() == "234" })
+	if newest := follower.LookupChannel("c").Newest(); newest.Created != etag {
+		t.Fatalf("replicated etag %d, want %d", newest.Created, etag)
+	}
+	ch.PurgeBefore(0)
+	eventually(t, "the purge", func() bool { return replica() == "" })
+	leader.DeleteChannel("c")
+	eventually(t, "the delete", func() bool { return replica() == "none" })
+
+	if _, err := follower.Publish(def, []byte("x"), false); err == nil {
+		t.Fatal("published on a follower")
+	}
+	if _, err := follower.Promote(); err != nil {
+		t.Fatal(err)
+	}
+	if status := follower.GetReplicationStatus(); status.Role != "leader" {
+		t.Fatalf("promoted to %s", status.Role)
+	}
+	if _, err := follower.Publish(def, []byte("x"), false); err != nil {
+		t.Fatal("promoted follower does not take publishes:", err)
+	}
+}
@@ -0,0 +1,631 @@
+package server
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// RedisQueue is how many messages wait for a slow Redis subscriber,
+	// later ones are dropped.
+	RedisQueue   = 1000
+	redisMaxBulk = 64 << 20
+	redisMaxArgs = 1024
+	// lower limits till AUTH, when a password is set
+	redisAuthMaxBulk = 4096
+	redisAuthMaxArgs = 8
+	// redisMaxPattern is the longest PSUBSCRIBE pattern
+	redisMaxPattern = 1024
+)
+
+// serveRedis accepts Redis protocol (RESP) connections on RedisAddr, if set.
+func (s *Server) serveRedis() error {
+	if s.opts.RedisAddr == "" {
+		return nil
+	}
+
+	l, err := s.listen(s.opts.RedisAddr)
+	if err != nil {
+		return fmt.Errorf("redis listener: %s", err)
+	}
+	log.Printf("Started Redis listener on %s.", l.Addr())
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if s.stopping() {
+				return
+			}
+			if err != nil {
+				log.Println("Redis accept failed:", err)
+				continue
+			}
+			go s.newRedisConn(conn).serve()
+		}
+	}()
+	return nil
+}
+
+// redisConn is one Redis client. Commands are read by a goroutine of their
+// own, everything is written by serve, so replies and pushed messages do not
+// interleave.
+type redisConn struct {
+	s      *Server
+	conn   net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+	authed bool
+	key    string // the key for publishing to channels with one, see KEY
+	sub    *Subscriber
+
+	events chan *ChannelEvent
+
+	lock     sync.RWMutex // subscriptions are matched from publishers
+	names    map[string]bool
+	patterns map[string]bool
+}
+
+func (s *Server) newRedisConn(conn net.Conn) *redisConn {
+	return &redisConn{
+		s:        s,
+		conn:     conn,
+		r:        bufio.NewReader(conn),
+		w:        bufio.NewWriter(conn),
+		authed:   s.opts.RedisPassword == "",
+		sub:      s.connSubscriber("redis", conn.RemoteAddr().String()),
+		events:   make(chan *ChannelEvent, RedisQueue),
+		names:    map[string]bool{},
+		patterns: map[string]bool{},
+	}
+}
+
+func (rc *redisConn) serve() {
+	rc.s.nRedisConns.Add(1)
+	defer rc.s.nRedisConns.Add(-1)
+	defer rc.conn.Close()
+
+	unwatch := rc.s.Watch(rc.match, rc.events)
+	defer func() {
+		unwatch()
+		rc.rewatch(false, keys(rc.names), true)
+		rc.rewatch(true, keys(rc.patterns), true)
+	}()
+
+	type read struct {
+		args []string
+		err  error
+	}
+	cmds := make(chan read)
+	done := make(chan bool)
+	defer close(done)
+
+	// till AUTH, each command is read with the lower limits once the one
+	// before has run, and authed tells the reader if it was AUTH
+	authed := make(chan bool)
+	go func(ok bool) {
+		for {
+			maxArgs, maxBulk := redisMaxArgs, redisMaxBulk
+			if !ok {
+				maxArgs, maxBulk = redisAuthMaxArgs, redisAuthMaxBulk
+			}
+			args, err := readCommand(rc.r, maxArgs, maxBulk)
+			select {
+			case cmds <- read{args, err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+			if !ok {
+				select {
+				case ok = <-authed:
+				case <-done:
+					return
+				}
+			}
+		}
+	}(rc.authed)
+
+	for {
+		select {
+		case cmd := <-cmds:
+			if cmd.err != nil {
+				if cmd.err != io.EOF {
+					rc.writeError("ERR Protocol error: " + cmd.err.Error())
+					rc.w.Flush()
+				}
+				return
+			}
+			wasAuthed := rc.authed
+			if len(cmd.args) != 0 && !rc.command(cmd.args) {
+				rc.w.Flush()
+				return
+			}
+			if !wasAuthed {
+				authed <- rc.authed
+			}
+		case ev := <-rc.events:
+			rc.message(ev)
+		case <-rc.s.done:
+			return
+		}
+
+		// more pushed messages are likely, write them in one go
+		for len(rc.events) != 0 {
+			rc.message(<-rc.events)
+		}
+		if err := rc.w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// command runs one command, it returns false if the connection should be
+// closed.
+func (rc *redisConn) command(args []string) bool {
+	cmd := strings.ToUpper(args[0])
+	args = args[1:]
+
+	if cmd == "QUIT" {
+		rc.writeSimple("OK")
+		return false
+	}
+	if cmd == "AUTH" {
+		rc.auth(args)
+		return true
+	}
+	if !rc.authed {
+		rc.writeError("NOAUTH Authentication required.")
+		return true
+	}
+
+	if rc.subscribed() != 0 {
+		switch cmd {
+		case "SUBSCRIBE", "PSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE", "PING":
+		default:
+			rc.writeError(fmt.Sprintf(
+				"ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE "+
+					"/ PING / QUIT are allowed in this context",
+				strings.ToLower(cmd),
+			))
+			return true
+		}
+	}
+
+	switch cmd {
+	case "PING":
+		rc.ping(args)
+	case "PUBLISH":
+		if len(args) != 2 {
+			rc.writeError("ERR wrong number of arguments for 'publish' command")
+			return true
+		}
+		rc.publish(args[0], []byte(args[1]))
+	case "KEY":
+		if len(args) != 1 {
+			rc.writeError("ERR wrong number of arguments for 'key' command")
+			return true
+		}
+		rc.key = args[0]
+		rc.writeSimple("OK")
+	case "SUBSCRIBE", "PSUBSCRIBE":
+		if len(args) == 0 {
+			rc.writeError(fmt.Sprintf(
+				"ERR wrong number of arguments for '%s' command",
+				strings.ToLower(cmd),
+			))
+			return true
+		}
+		rc.subscribe(cmd == "PSUBSCRIBE", args)
+	case "UNSUBSCRIBE", "PUNSUBSCRIBE":
+		rc.unsubscribe(cmd == "PUNSUBSCRIBE", args)
+	default:
+		rc.writeError(fmt.Sprintf(
+			"ERR unknown command '%s'", strings.ToLower(cmd),
+		))
+	}
+	return true
+}
+
+func (rc *redisConn) auth(args []string) {
+	if len(args) != 1 {
+		rc.writeError("ERR wrong number of arguments for 'auth' command")
+		return
+	}
+	password := rc.s.opts.RedisPassword
+	if password == "" {
+		rc.writeError("ERR Client sent AUTH, but no password is set")
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(args[0]), []byte(password)) != 1 {
+		rc.writeError("WRONGPASS invalid password")
+		return
+	}
+	rc.authed = true
+	rc.writeSimple("OK")
+}
+
+func (rc *redisConn) ping(args []string) {
+	if rc.subscribed() != 0 {
+		msg := ""
+		if len(args) != 0 {
+			msg = args[0]
+		}
+		rc.writeArray(2)
+		rc.writeBulk("pong")
+		rc.writeBulk(msg)
+		return
+	}
+	if len(args) != 0 {
+		rc.writeBulk(args[0])
+		return
+	}
+	rc.writeSimple("PONG")
+}
+
+// publish is /pub with the default channel attributes, and the key set with
+// KEY. It replies with the number of subscribers, long polling and watching,
+// that got the message.
+func (rc *redisConn) publish(name string, data []byte) {
+	if err := rc.s.canPublish(name); err != nil {
+		rc.writeError("ERR " + err.Error())
+		return
+	}
+
+	ch, err := rc.s.GetOrCreateChannel(&ChannelDef{
+		Name: name, Size: DefaultSize, Life: DefaultLife, Key: rc.key,
+	})
+	if err != nil {
+		rc.writeError("ERR " + err.Error())
+		return
+	}
+	if ch.Key != "" && ch.Key != rc.key {
+		rc.writeError("ERR invalid key for " + name + ", set it with KEY")
+		return
+	}
+
+	n := ch.Info().Subscribers + rc.s.Watching(name)
+	ch.Pub(data)
+	rc.writeInt(int64(n))
+}
+
+// canPublish returns why this node can not take a publish to the named
+// channel from a protocol other than HTTP, which can not be proxied.
+func (s *Server) canPublish(name string) error {
+	if leader := s.Leader(); leader != "" {
+		return errors.New("read only follower of " + leader)
+	}
+	if s.ring != nil && s.ring.Owner(name) != s.opts.ShardSelf {
+		return errors.New("channel is on " + s.ring.Owner(name))
+	}
+	return nil
+}
+
+// subscribe adds subscriptions, to channels AuthURL allows all of. The
+// channels patterns match are checked as their messages arrive.
+func (rc *redisConn) subscribe(pattern bool, names []string) {
+	kind := "subscribe"
+	if pattern {
+		kind = "psubscribe"
+		for _, name := range names {
+			if len(name) > redisMaxPattern {
+				rc.writeError("ERR pattern too long")
+				return
+			}
+		}
+	} else {
+		denied, err := rc.s.Authorize(rc.sub, names)
+		if err != nil {
+			log.Println("Auth backend failed:", err)
+			rc.writeError("ERR could not authorize")
+			return
+		}
+		if len(denied) != 0 {
+			rc.writeError("ERR not allowed: " + strings.Join(denied, ", "))
+			return
+		}
+	}
+
+	for _, name := range names {
+		rc.lock.Lock()
+		if pattern {
+			rc.patterns[name] = true
+		} else {
+			rc.names[name] = true
+		}
+		rc.lock.Unlock()
+
+		rc.writeArray(3)
+		rc.writeBulk(kind)
+		rc.writeBulk(name)
+		rc.writeInt(int64(rc.subscribed()))
+	}
+	rc.rewatch(pattern, names, false)
+}
+
+// unsubscribe drops the given subscriptions, or all if none are given.
+func (rc *redisConn) unsubscribe(pattern bool, names []string) {
+	kind, subs := "unsubscribe", rc.names
+	if pattern {
+		kind, subs = "punsubscribe", rc.patterns
+	}
+
+	if len(names) == 0 {
+		rc.lock.RLock()
+		for name := range subs {
+			names = append(names, name)
+		}
+		rc.lock.RUnlock()
+	}
+
+	if len(names) == 0 {
+		rc.writeArray(3)
+		rc.writeBulk(kind)
+		rc.writeNil()
+		rc.writeInt(int64(rc.subscribed()))
+		return
+	}
+
+	for _, name := range names {
+		rc.lock.Lock()
+		delete(subs, name)
+		rc.lock.Unlock()
+
+		rc.writeArray(3)
+		rc.writeBulk(kind)
+		rc.writeBulk(name)
+		rc.writeInt(int64(rc.subscribed()))
+	}
+	rc.rewatch(pattern, names, true)
+}
+
+// rewatch checks the occupancy of the channels of subscriptions just made,
+// or if left is set, dropped.
+func (rc *redisConn) rewatch(pattern bool, names []string, left bool) {
+	if !pattern {
+		rc.s.watchNames(names, left)
+		return
+	}
+	if len(names) == 0 {
+		return
+	}
+	rc.s.watchMatching(func(name string) bool {
+		for _, p := range names {
+			if globMatch(p, name) {
+				return true
+			}
+		}
+		return false
+	}, left)
+}
+
+// keys returns the names of subs, which only the connection's goroutine
+// changes.
+func keys(subs map[string]bool) []string {
+	names := make([]string, 0, len(subs))
+	for name := range subs {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (rc *redisConn) subscribed() int {
+	rc.lock.RLock()
+	defer rc.lock.RUnlock()
+
+	return len(rc.names) + len(rc.patterns)
+}
+
+// match is the Watch filter, true if any subscription matches name.
+func (rc *redisConn) match(name string) bool {
+	rc.lock.RLock()
+	defer rc.lock.RUnlock()
+
+	if rc.names[name] {
+		return true
+	}
+	for pattern := range rc.patterns {
+		if globMatch(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// message writes ev once for a subscription to its channel, and once for
+// each pattern matching it, like Redis does.
+func (rc *redisConn) message(ev *ChannelEvent) {
+	name := ev.Chan.Name
+	if !rc.s.allowed(rc.sub, name) {
+		return
+	}
+
+	rc.lock.RLock()
+	defer rc.lock.RUnlock()
+
+	if rc.names[name] {
+		rc.writeArray(3)
+		rc.writeBulk("message")
+		rc.writeBulk(name)
+		rc.writeBulk(string(ev.Mesg.Data))
+	}
+	for pattern := range rc.patterns {
+		if globMatch(pattern, name) {
+			rc.writeArray(4)
+			rc.writeBulk("pmessage")
+			rc.writeBulk(pattern)
+			rc.writeBulk(name)
+			rc.writeBulk(string(ev.Mesg.Data))
+		}
+	}
+}
+
+func (rc *redisConn) writeSimple(s string) {
+	rc.w.WriteString("+" + s + "\r\n")
+}
+
+func (rc *redisConn) writeError(s string) {
+	rc.w.WriteString("-" + s + "\r\n")
+}
+
+func (rc *redisConn) writeInt(n int64) {
+	rc.w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (rc *redisConn) writeBulk(s string) {
+	rc.w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func (rc *redisConn) writeNil() {
+	rc.w.WriteString("$-1\r\n")
+}
+
+func (rc *redisConn) writeArray(n int) {
+	rc.w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+// readCommand reads a command, an array of bulk strings, or an inline
+// command (space separated words on a line) as sent by telnet.
+func readCommand(r *bufio.Reader, maxArgs, maxBulk int) ([]string, error) {
+	line, err := readLine(r, maxBulk)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > maxArgs {
+		return nil, errors.New("invalid multibulk length")
+	}
+
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readLine(r, maxBulk)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("expected '$', got '%.1s'", line)
+		}
+
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxBulk {
+			return nil, errors.New("invalid bulk length")
+		}
+
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+// readLine reads a line of up to max bytes, without the line break.
+func readLine(r *bufio.Reader, max int) (string, error) {
+	line := []byte{}
+	for {
+		part, err := r.ReadSlice('\n')
+		line = append(line, part...)
+		if len(line) > max+2 {
+			return "", errors.New("line too long")
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && len(line) != 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+}
+
+// globMatch matches name against a Redis style glob pattern: * matches any
+// run of bytes, ? any one byte, [abc] or [a-z] (or [^...]) one of a set, and
+// \ escapes the next byte. On a mismatch it only goes back to the last *,
+// which then matches one more byte, so it takes at most
+// len(pattern) * len(name) steps.
+func globMatch(pattern, name string) bool {
+	p, n := 0, 0
+	star, next := -1, 0 // pattern after the last *, and where name resumes
+	for n < len(name) {
+		if p < len(pattern) && pattern[p] == '*' {
+			p++
+			star, next = p, n
+			continue
+		}
+		if p < len(pattern) {
+			if size, ok := globOne(pattern[p:], name[n]); ok {
+				p += size
+				n++
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		next++
+		p, n = star, next
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// globOne matches c against the first element of pattern, which is not a *,
+// and returns the length of the element.
+func globOne(pattern string, c byte) (int, bool) {
+	switch pattern[0] {
+	case '?':
+		return 1, true
+	case '[':
+		end := strings.IndexByte(pattern[1:], ']')
+		if end < 0 {
+			return 0, false
+		}
+		set := pattern[1 : end+1]
+		negate := len(set) != 0 && set[0] == '^'
+		if negate {
+			set = set[1:]
+		}
+		return end + 2, inSet(set, c) != negate
+	case '\\':
+		if len(pattern) > 1 {
+			return 2, pattern[1] == c
+		}
+	}
+	return 1, pattern[0] == c
+}
+
+// inSet is true if c is in a glob set like "abc" or "a-z0-9".
+func inSet(set string, c byte) bool {
+	for i := 0; i < len(set); i++ {
+		if i+2 < len(set) && set[i+1] == '-' {
+			if set[i] <= c && c <= set[i+2] {
+				return true
+			}
+			i += 2
+			continue
+		}
+		if set[i] == c {
+			return true
+		}
+	}
+	return false
+}
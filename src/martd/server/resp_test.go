@@ -0,0 +1,275 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadCommand(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		want []string
+		err  string
+	}{
+		{"*2\r\n$4\r\nPING\r\n$2\r\nhi\r\n", []string{"PING", "hi"}, ""},
+		{"*1\r\n$0\r\n\r\n", []string{""}, ""},
+		{"*1\r\n$4\r\na\r\nb\r\n", []string{"a\r\nb"}, ""},
+		{"PUBLISH  news hello\r\n", []string{"PUBLISH", "news", "hello"}, ""},
+		{"ping\n", []string{"ping"}, ""},
+		{"\r\n", []string{}, ""},
+		{"*x\r\n", nil, "invalid multibulk length"},
+		{"*1\r\n+OK\r\n", nil, "expected '$', got '+'"},
+		{"*1\r\n$-1\r\n", nil, "invalid bulk length"},
+		{"*2\r\n$4\r\nPING\r\n", nil, "EOF"},
+		{"*1\r\n$4\r\nPI", nil, "unexpected EOF"},
+		{"PING", nil, "unexpected EOF"},
+		{"*1\r\n$21\r\n", nil, "invalid bulk length"},
+		{"PING " + strings.Repeat("x", 20) + "\r\n", nil, "line too long"},
+	} {
+		args, err := readCommand(
+			bufio.NewReader(strings.NewReader(c.in)), redisMaxArgs, 20,
+		)
+		if c.err != "" {
+			if err == nil || err.Error() != c.err {
+				t.Errorf("%q: got %q, %v, want error %q", c.in, args, err, c.err)
+			}
+			continue
+		}
+		if err != nil || fmt.Sprintf("%q", args) != fmt.Sprintf("%q", c.want) {
+			t.Errorf("%q: got %q, %v, want %q", c.in, args, err, c.want)
+		}
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	for _, c := range []struct {
+		pattern, name string
+		match         bool
+	}{
+		{"news.*", "news.sport", true},
+		{"news.*", "news", false},
+		{"*", "", true},
+		{"n?ws", "news", true},
+		{"n?ws", "nws", false},
+		{"n[ae]ws", "news", true},
+		{"n[^ae]ws", "news", false},
+		{"n[a-z]ws", "nXws", false},
+		{`news\*`, "news*", true},
+		{`news\*`, "newsx", false},
+		{"*.sport", "a.b.sport", true},
+		{"[abc", "a", false},
+		{"*a*b", "xaxxb", true},
+		{"a*b*", "ab", true},
+		{"a*?", "a", false},
+		{strings.Repeat("*a", 20) + "b", strings.Repeat("a", 100), false},
+	} {
+		if globMatch(c.pattern, c.name) != c.match {
+			t.Errorf("%q %q: want %v", c.pattern, c.name, c.match)
+		}
+	}
+}
+
+// redisClient is the client end of a connection to s.
+type redisClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newRedisClient(t *testing.T, s *Server) *redisClient {
+	client, conn := net.Pipe()
+	go s.newRedisConn(conn).serve()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { client.Close() })
+	return &redisClient{t, client, bufio.NewReader(client)}
+}
+
+// do sends a command and returns the reply, see reply.
+func (c *redisClient) do(args ...string) string {
+	c.t.Helper()
+
+	cmd := "*" + strconv.Itoa(len(args)) + "\r\n"
+	for _, arg := range args {
+		cmd += "$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n"
+	}
+	if _, err := io.WriteString(c.conn, cmd); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.reply()
+}
+
+// reply reads a reply, written back as "+OK", "-ERR ...", ":1", "$data",
+// "$nil" or "[a b]" for arrays.
+func (c *redisClient) reply() string {
+	c.t.Helper()
+
+	line, err := readLine(c.r, redisMaxBulk)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	switch line[0] {
+	case '+', '-', ':':
+		return line
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return "$nil"
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			c.t.Fatal(err)
+		}
+		return "$" + string(buf[:n])
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		items := []string{}
+		for i := 0; i < n; i++ {
+			items = append(items, c.reply())
+		}
+		return "[" + strings.Join(items, " ") + "]"
+	}
+	c.t.Fatalf("bad reply %q", line)
+	return ""
+}
+
+func TestRedisAuth(t *testing.T) {
+	s := newTestServer(t, func(o *Options) { o.RedisPassword = "pw" })
+	c := newRedisClient(t, s)
+
+	for _, step := range [][2]string{
+		{"PING", "-NOAUTH Authentication required."},
+		{"PUBLISH news x", "-NOAUTH Authentication required."},
+		{"AUTH nope", "-WRONGPASS invalid password"},
+		{"AUTH", "-ERR wrong number of arguments for 'auth' command"},
+		{"AUTH pw", "+OK"},
+		{"PING", "+PONG"},
+		{"ping hello", "$hello"},
+		{"FLUSHALL", "-ERR unknown command 'flushall'"},
+	} {
+		if got := c.do(strings.Fields(step[0])...); got != step[1] {
+			t.Errorf("%s: got %q, want %q", step[0], got, step[1])
+		}
+	}
+	if got := c.do("QUIT"); got != "+OK" {
+		t.Errorf("QUIT: got %q", got)
+	}
+}
+
+func TestRedisAuthLimits(t *testing.T) {
+	s := newTestServer(t, func(o *Options) { o.RedisPassword = "pw" })
+
+	// a big command before AUTH closes the connection, without being read
+	c := newRedisClient(t, s)
+	big := strings.Repeat("x", redisAuthMaxBulk+1)
+	go io.WriteString(c.conn, "*1\r\n$"+strconv.Itoa(len(big))+"\r\n"+big)
+	if got := c.reply(); got != "-ERR Protocol error: invalid bulk length" {
+		t.Errorf("big command before AUTH: got %q", got)
+	}
+
+	// and is fine after it
+	c = newRedisClient(t, s)
+	if got := c.do("AUTH", "pw"); got != "+OK" {
+		t.Fatalf("AUTH: got %q", got)
+	}
+	if got := c.do("PUBLISH", "news", big); got != ":0" {
+		t.Errorf("big PUBLISH after AUTH: got %q", got)
+	}
+	if got := c.do("PSUBSCRIBE", big); got != "-ERR pattern too long" {
+		t.Errorf("long pattern: got %q", got)
+	}
+}
+
+func TestRedisPublish(t *testing.T) {
+	s := newTestServer(t, nil)
+	c := newRedisClient(t, s)
+
+	if got := c.do("PUBLISH", "news", "hello\r\nworld"); got != ":0" {
+		t.Fatalf("PUBLISH: got %q", got)
+	}
+	ch := s.LookupChannel("news")
+	if ch == nil {
+		t.Fatal("PUBLISH did not create the channel")
+	}
+	msgs, _, _ := ch.History(0, 0, 10)
+	if len(msgs) != 1 || string(msgs[0].Data) != "hello\r\nworld" {
+		t.Fatalf("channel has %v", msgs)
+	}
+	if got := c.do("PUBLISH", "news"); !strings.HasPrefix(got, "-ERR wrong") {
+		t.Fatalf("PUBLISH without message: got %q", got)
+	}
+
+	// channels with a key need it, set with KEY
+	_, err := s.Publish(&ChannelDef{
+		Name: "secret", Size: DefaultSize, Life: DefaultLife, Key: "k",
+	}, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := c.do("PUBLISH", "secret", "x")
+	if !strings.HasPrefix(got, "-ERR invalid key") {
+		t.Fatalf("PUBLISH without key: got %q", got)
+	}
+	if got := c.do("KEY", "k"); got != "+OK" {
+		t.Fatalf("KEY: got %q", got)
+	}
+	if got := c.do("PUBLISH", "secret", "x"); got != ":0" {
+		t.Fatalf("PUBLISH with key: got %q", got)
+	}
+
+	// and channels created with a key set get it
+	c.do("PUBLISH", "mine", "x")
+	if ch := s.LookupChannel("mine"); ch == nil || ch.Key != "k" {
+		t.Fatal("channel created without the key of the connection")
+	}
+}
+
+func TestRedisSubscribe(t *testing.T) {
+	s := newTestServer(t, nil)
+	sub := newRedisClient(t, s)
+	pub := newRedisClient(t, s)
+
+	got := sub.do("SUBSCRIBE", "news", "sport")
+	if got != "[$subscribe $news :1]" {
+		t.Fatalf("SUBSCRIBE: got %q", got)
+	}
+	if got := sub.reply(); got != "[$subscribe $sport :2]" {
+		t.Fatalf("SUBSCRIBE: got %q", got)
+	}
+	if got := sub.do("PSUBSCRIBE", "n*"); got != "[$psubscribe $n* :3]" {
+		t.Fatalf("PSUBSCRIBE: got %q", got)
+	}
+	got = sub.do("PUBLISH", "news", "x")
+	if !strings.HasPrefix(got, "-ERR Can't execute 'publish'") {
+		t.Fatalf("PUBLISH while subscribed: got %q", got)
+	}
+	if got := sub.do("PING"); got != "[$pong $]" {
+		t.Fatalf("PING while subscribed: got %q", got)
+	}
+
+	if got := pub.do("PUBLISH", "news", "hello"); got != ":1" {
+		t.Fatalf("PUBLISH: got %q", got)
+	}
+	if got := sub.reply(); got != "[$message $news $hello]" {
+		t.Fatalf("got %q", got)
+	}
+	if got := sub.reply(); got != "[$pmessage $n* $news $hello]" {
+		t.Fatalf("got %q", got)
+	}
+
+	if got := sub.do("UNSUBSCRIBE", "news"); got != "[$unsubscribe $news :2]" {
+		t.Fatalf("UNSUBSCRIBE: got %q", got)
+	}
+	if got := sub.do("PUNSUBSCRIBE"); got != "[$punsubscribe $n* :1]" {
+		t.Fatalf("PUNSUBSCRIBE: got %q", got)
+	}
+	pub.do("PUBLISH", "sport", "goal")
+	if got := sub.reply(); got != "[$message $sport $goal]" {
+		t.Fatalf("got %q", got)
+	}
+}
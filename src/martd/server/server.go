@@ -0,0 +1,454 @@
+// Package server is martd as a library: a Server holds all the channels,
+// storage, cluster and listener state of one martd, so a Go program can
+// embed push in its own HTTP server, or run several isolated instances in
+// its tests.
+//
+//	srv, err := server.New(&server.Options{Storage: "memory"})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	if err := srv.Start(); err != nil {
+//		log.Fatal(err)
+//	}
+//	defer srv.Shutdown(context.Background())
+//	http.Handle("/push/", http.StripPrefix("/push", srv))
+package server
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"time"
+)
+
+//go:generate esc -o static.go -pkg server index.html client.js
+//esc: http://godoc.org/github.com/mjibson/esc
+
+// Options configure a Server, each is a flag of the martd command. Zero
+// values get the defaults in Defaults, but for PersistRetries and
+// WebhookRetries, where 0 means no retries, and Storage, which defaults to
+// memory.
+type Options struct {
+	// Origin is sent as Access-Control-Allow-Origin, if set.
+	Origin string
+	// Debug serves index.html and client.js from the working directory.
+	Debug bool
+
+	// Storage is one of Storages, Persist is its file or directory.
+	Storage         string
+	Persist         string
+	PersistRetries  int
+	PersistBacklog  int
+	PersistBatch    int
+	PersistInterval time.Duration
+
+	LogSegmentSize     int64
+	LogCompactInterval time.Duration
+
+	// UnloadAfter is how long a channel must be unused before its messages
+	// are dropped from memory, they are loaded again from storage on use.
+	UnloadAfter time.Duration
+
+	// AdminKey turns on the /admin/ endpoints.
+	AdminKey string
+	// MetricsChannels are the channel name prefixes for which per channel
+	// metrics and Stats are exported, none by default to bound cardinality.
+	MetricsChannels []string
+
+	// Peers are the base URLs of the other nodes of the cluster, messages
+	// published on this node are forwarded to each of them.
+	Peers         []string
+	ClusterKey    string
+	PeerHeartbeat time.Duration
+
+	// Follow is the base URL of the leader this node replicates. A
+	// follower rejects publishes till it is promoted.
+	Follow      string
+	ReplBacklog int
+
+	// Shards are the base URLs of all nodes that channels are partitioned
+	// between, this one (ShardSelf) included.
+	Shards        []string
+	ShardSelf     string
+	ShardVNodes   int
+	ShardRedirect bool
+
+	// Addresses of the other listeners, each off if empty.
+	RedisAddr     string
+	RedisPassword string
+	MQTTAddr      string
+	MQTTWSAddr    string
+	GRPCAddr      string
+
+	// Webhooks are the URLs every channel lifecycle event is POSTed to.
+	Webhooks       []string
+	WebhookSecret  string
+	WebhookPublish bool
+	WebhookIdle    time.Duration
+	WebhookRetries int
+
+	// AuthURL is the backend asked whether a client may subscribe, all
+	// subscriptions are allowed if it is empty.
+	AuthURL     string
+	AuthHeaders []string
+	AuthTTL     time.Duration
+	AuthTimeout time.Duration
+}
+
+// Defaults are the options of the martd command. Storage is sqlite, or log
+// in builds without cgo.
+var Defaults = Options{
+	Storage:            defaultStorage,
+	Persist:            defaultPersist,
+	PersistRetries:     5,
+	PersistBacklog:     100000,
+	PersistBatch:       1000,
+	LogSegmentSize:     64 << 20,
+	LogCompactInterval: 10 * time.Minute,
+	PeerHeartbeat:      5 * time.Second,
+	ReplBacklog:        100000,
+	ShardVNodes:        128,
+	WebhookIdle:        10 * time.Second,
+	WebhookRetries:     5,
+	AuthTTL:            time.Minute,
+	AuthTimeout:        5 * time.Second,
+}
+
+var ErrServerClosed = errors.New("martd: server closed")
+
+// Server is one martd. Its HTTP API is served by ServeHTTP, the other
+// listeners and background work run between Start and Shutdown.
+type Server struct {
+	opts  Options
+	mux   *http.ServeMux
+	start time.Time
+
+	// done is closed by Shutdown, everything waiting returns
+	done     chan bool
+	stopLock sync.Mutex
+	inflight sync.RWMutex // held for reading by requests, see guard
+	closed   bool
+	wg       sync.WaitGroup
+	// draining is closed by Drain, long polls and streams return
+	draining  chan bool
+	drainOnce sync.Once
+
+	channels  map[string]*Channel
+	chanLock  sync.RWMutex
+	watchers  map[*watcher]bool
+	watchLock sync.RWMutex
+
+	// store is nil till storage is opened, which the persister does if it
+	// could not be on start, others read it with storage()
+	store          Storage
+	storeLock      sync.RWMutex
+	persistChan    chan *DMessage
+	persistStop    chan bool
+	persistStopped chan bool
+	health         *Health
+	latency        *Histogram
+
+	// channels with expired messages, by the persister, guarded by
+	// expireLock
+	expiring   map[string]bool
+	expireAll  bool
+	expireLock sync.Mutex
+
+	// the replication log, records of the operations on this node with
+	// sequence numbers replFirst to replSeq, guarded by replLock
+	replLock  sync.Mutex
+	replLog   []*replRecord
+	replFirst int64
+	replSeq   int64
+	replWake  chan bool
+	// replID names this run of this node, a follower that was following
+	// another one (or an earlier run) needs a snapshot
+	replID    string
+	following *follower
+
+	peers   []*Peer
+	ring    *Ring
+	proxies map[string]*httputil.ReverseProxy
+
+	hooks      []*webhook
+	webhookSeq int64
+
+	authClient *http.Client
+	authCache  map[authKey]*authDecision
+	authLock   sync.Mutex
+	connSeq    int64
+
+	// mqttClients are the connected clients by client id, a client
+	// connecting with the id of another one takes over from it
+	mqttClients map[string]*mqttConn
+	mqttLock    sync.Mutex
+
+	listeners []net.Listener
+	servers   []*http.Server
+
+	// vars has the counters below, by their expvar names.
+	vars *expvar.Map
+
+	nSub, nList, nSubAll, nPubAll, nHistory                      *expvar.Int
+	nPublished, nBytesIn, nDelivered, nExpired, nDropped         *expvar.Int
+	nWatchDropped, nLoads, nUnloads, nPageIns                    *expvar.Int
+	nPersistErrors, nPersistDropped, nPersistBatches             *expvar.Int
+	nForwarded, nReceived, nFollowers, nReplicated, nWebhookSent *expvar.Int
+	nRedisConns, nMQTTConns, nGRPCCalls, nGRPCStreams            *expvar.Int
+	nMessages, nMessageBytes                                     *expvar.Int
+}
+
+// New returns a Server for opts, which it keeps a copy of. Nothing is opened
+// or started till Start.
+func New(opts *Options) (*Server, error) {
+	o := *opts
+	o.setDefaults()
+	if _, ok := Storages[o.Storage]; !ok {
+		return nil, unknownStorage(o.Storage)
+	}
+
+	s := &Server{
+		opts:           o,
+		start:          time.Now(),
+		done:           make(chan bool),
+		draining:       make(chan bool),
+		channels:       map[string]*Channel{},
+		watchers:       map[*watcher]bool{},
+		persistChan:    make(chan *DMessage, PersistQueue),
+		persistStop:    make(chan bool),
+		persistStopped: make(chan bool),
+		health:         &Health{Healthy: true, Since: time.Now()},
+		latency: NewHistogram(
+			.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1,
+		),
+		replFirst:   1,
+		replWake:    make(chan bool),
+		replID:      newReplID(),
+		proxies:     map[string]*httputil.ReverseProxy{},
+		authCache:   map[authKey]*authDecision{},
+		expiring:    map[string]bool{},
+		mqttClients: map[string]*mqttConn{},
+		vars:        new(expvar.Map).Init(),
+	}
+	for name, v := range map[string]**expvar.Int{
+		"nSub": &s.nSub, "nList": &s.nList, "nSubAll": &s.nSubAll,
+		"nPubAll": &s.nPubAll, "nHistory": &s.nHistory,
+		"nPublished": &s.nPublished, "nBytesIn": &s.nBytesIn,
+		"nDelivered": &s.nDelivered, "nExpired": &s.nExpired,
+		"nDropped": &s.nDropped, "nWatchDropped": &s.nWatchDropped,
+		"nChannelLoads": &s.nLoads, "nChannelUnloads": &s.nUnloads,
+		"nPageIns": &s.nPageIns, "nPersistErrors": &s.nPersistErrors,
+		"nPersistDropped": &s.nPersistDropped,
+		"nPersistBatches": &s.nPersistBatches, "nForwarded": &s.nForwarded,
+		"nReceived": &s.nReceived, "nFollowers": &s.nFollowers,
+		"nReplicated": &s.nReplicated, "nWebhookSent": &s.nWebhookSent,
+		"nRedisConns": &s.nRedisConns, "nMQTTConns": &s.nMQTTConns,
+		"nGRPCCalls": &s.nGRPCCalls, "nGRPCStreams": &s.nGRPCStreams,
+		"nMessages": &s.nMessages, "nMessageBytes": &s.nMessageBytes,
+	} {
+		*v = new(expvar.Int)
+		s.vars.Set(name, *v)
+	}
+
+	s.routes()
+	return s, nil
+}
+
+func (o *Options) setDefaults() {
+	if o.Storage == "" {
+		o.Storage = "memory"
+	}
+	if o.PersistBacklog == 0 {
+		o.PersistBacklog = Defaults.PersistBacklog
+	}
+	if o.PersistBatch == 0 {
+		o.PersistBatch = Defaults.PersistBatch
+	}
+	if o.LogSegmentSize == 0 {
+		o.LogSegmentSize = Defaults.LogSegmentSize
+	}
+	if o.LogCompactInterval == 0 {
+		o.LogCompactInterval = Defaults.LogCompactInterval
+	}
+	if o.PeerHeartbeat == 0 {
+		o.PeerHeartbeat = Defaults.PeerHeartbeat
+	}
+	if o.ReplBacklog == 0 {
+		o.ReplBacklog = Defaults.ReplBacklog
+	}
+	if o.ShardVNodes == 0 {
+		o.ShardVNodes = Defaults.ShardVNodes
+	}
+	if o.WebhookIdle == 0 {
+		o.WebhookIdle = Defaults.WebhookIdle
+	}
+	if o.AuthTTL == 0 {
+		o.AuthTTL = Defaults.AuthTTL
+	}
+	if o.AuthTimeout == 0 {
+		o.AuthTimeout = Defaults.AuthTimeout
+	}
+}
+
+// Start opens storage, loading the channels in it, and starts the cluster,
+// the listeners and the background work. If storage is unavailable it
+// retries PersistRetries times, then serves from memory while the persister
+// keeps trying, as the martd command does.
+func (s *Server) Start() error {
+	if err := s.startStorage(); err != nil {
+		return err
+	}
+	s.goRun(s.persister)
+	s.goRun(s.periodicExpireMessages)
+	if s.opts.UnloadAfter > 0 {
+		s.goRun(s.periodicUnload)
+	}
+
+	for _, start := range []func() error{
+		s.startWebhooks, s.startAuth, s.startCluster, s.startFollowing,
+		s.startSharding, s.serveRedis, s.serveMQTT, s.serveGRPC,
+	} {
+		if err := start(); err != nil {
+			s.Shutdown(context.Background())
+			return err
+		}
+	}
+	return nil
+}
+
+// goRun runs f in a goroutine Shutdown waits for.
+func (s *Server) goRun(f func()) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		f()
+	}()
+}
+
+// listen listens on addr for a listener Shutdown closes.
+func (s *Server) listen(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s.listeners = append(s.listeners, l)
+	return l, nil
+}
+
+// serve serves h on addr with an http.Server Shutdown shuts down.
+func (s *Server) serve(server *http.Server) error {
+	l, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+	s.servers = append(s.servers, server)
+	go func() {
+		if err := server.Serve(l); err != http.ErrServerClosed {
+			log.Println("Listener on", server.Addr, "failed:", err)
+		}
+	}()
+	return nil
+}
+
+// stopping is true once Shutdown was called.
+func (s *Server) stopping() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// sleep waits for d, it returns false if the server is shut down first.
+func (s *Server) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// Drain wakes up long polls and streams, so an http.Server serving s can
+// shut down, register it with RegisterOnShutdown.
+func (s *Server) Drain() {
+	s.drainOnce.Do(func() { close(s.draining) })
+}
+
+// Shutdown stops the listeners, wakes up long polls and streams, waits for
+// requests in progress, commits what is queued for storage and closes it.
+// The caller should stop serving ServeHTTP first, later requests get a 503.
+// If ctx is done first, its error is returned and storage is left open.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.stopLock.Lock()
+	if s.stopping() {
+		s.stopLock.Unlock()
+		return ErrServerClosed
+	}
+	close(s.done)
+	s.stopLock.Unlock()
+	s.Drain()
+
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	for _, server := range s.servers {
+		server.Close()
+	}
+	s.unfollow()
+
+	stopped := make(chan bool)
+	go func() {
+		s.inflight.Lock()
+		s.closed = true
+		s.inflight.Unlock()
+		close(s.persistStop) // no more publishes, commit what is queued
+		s.wg.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// guard wraps h so it does not run once the server is shut down, and
+// Shutdown waits for it.
+func (s *Server) guard(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.inflight.RLock()
+		defer s.inflight.RUnlock()
+
+		if s.closed {
+			s.rejectWith(w, "server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// ServeHTTP serves the HTTP API, it can be mounted under a prefix with
+// http.StripPrefix.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.guard(s.mux.ServeHTTP)(w, r)
+}
+
+// Options returns the options the server runs with, defaults filled in.
+func (s *Server) Options() Options {
+	return s.opts
+}
+
+// Vars returns the counters of the server, as the martd command publishes
+// them with expvar.
+func (s *Server) Vars() *expvar.Map {
+	return s.vars
+}
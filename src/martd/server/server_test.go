@@ -0,0 +1,28 @@
+package server
+
+import (
+	"context"
+	"testing"
+)
+
+// newTestServer starts a server with memory storage, configure changes the
+// other options.
+func newTestServer(t *testing.T, configure func(o *Options)) *Server {
+	t.Helper()
+
+	opts := Defaults
+	opts.Storage = "memory"
+	if configure != nil {
+		configure(&opts)
+	}
+
+	s, err := New(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	return s
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// shardHeader marks a request proxied by another shard, which must not be
+// proxied again.
+const shardHeader = "X-Martd-Shard"
+
+// maxShardForm is the largest form body read to find a request's channels,
+// the same as net/http's ParseForm limit.
+const maxShardForm = 10 << 20
+
+// Ring is a consistent hash ring, a channel belongs to the node of the first
+// point at or after the hash of its name. Each node has many points, so
+// adding or removing one only moves its share of channels.
+type Ring struct {
+	points []uint32
+	nodes  map[uint32]string
+}
+
+func NewRing(nodes []string, vnodes int) *Ring {
+	r := &Ring{nodes: map[uint32]string{}}
+	for _, node := range nodes {
+		for i := 0; i < vnodes; i++ {
+			point := crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s#%d", node, i)))
+			if _, taken := r.nodes[point]; taken {
+				continue
+			}
+			r.nodes[point] = node
+			r.points = append(r.points, point)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// Owner returns the node channel name belongs to.
+func (r *Ring) Owner(name string) string {
+	h := crc32.ChecksumIEEE([]byte(name))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.nodes[r.points[i]]
+}
+
+// startSharding builds the ring from Shards, if set.
+func (s *Server) startSharding() error {
+	if len(s.opts.Shards) == 0 {
+		return nil
+	}
+
+	nodes := []string{}
+	self := strings.TrimSuffix(s.opts.ShardSelf, "/")
+	found := false
+	for _, node := range s.opts.Shards {
+		node = strings.TrimSuffix(node, "/")
+		nodes = append(nodes, node)
+		found = found || node == self
+
+		target, err := url.Parse(node)
+		if err != nil || target.Host == "" {
+			return fmt.Errorf("invalid shard URL: %s", node)
+		}
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		proxy.FlushInterval = 100 * time.Millisecond
+		s.proxies[node] = proxy
+	}
+	if !found {
+		return errors.New("shard self must be one of the shards")
+	}
+
+	s.opts.Shards, s.opts.ShardSelf = nodes, self
+	s.ring = NewRing(nodes, s.opts.ShardVNodes)
+	log.Println("Sharding channels between", len(nodes), "nodes")
+	return nil
+}
+
+// Sharded wraps h so that requests for channels owned by another node are
+// proxied or redirected to it. channels returns the channels a request is
+// for, from its query string, and if fromBody is set its form body too; it
+// is not for /pub, whose body is the message. A request for channels on more
+// than one node is rejected, with where each one is.
+func (s *Server) Sharded(
+	h http.HandlerFunc, channels func(url.Values) []string, fromBody bool,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.ring == nil {
+			h(w, r)
+			return
+		}
+
+		form := r.URL.Query()
+		if fromBody {
+			var err error
+			if form, err = shardForm(r); err != nil {
+				s.reject(w, "invalid form: "+err.Error())
+				return
+			}
+		}
+
+		owners := map[string]string{}
+		owner := ""
+		for _, name := range channels(form) {
+			owners[name] = s.ring.Owner(name)
+			if owner == "" {
+				owner = owners[name]
+			} else if owner != owners[name] {
+				owner = "-"
+			}
+		}
+
+		switch owner {
+		case "", s.opts.ShardSelf:
+			h(w, r)
+		case "-":
+			s.rejectShards(w, owners)
+		default:
+			if r.Header.Get(shardHeader) != "" {
+				s.reject(w, "shards disagree on the owner, check -shards")
+				return
+			}
+			if s.opts.ShardRedirect {
+				http.Redirect(
+					w, r, owner+r.URL.RequestURI(), http.StatusTemporaryRedirect,
+				)
+				return
+			}
+			r.Header.Set(shardHeader, s.opts.ShardSelf)
+			s.proxies[owner].ServeHTTP(w, r)
+		}
+	}
+}
+
+// shardForm returns the parameters the handler of r gets from FormValue, the
+// query and a urlencoded body, which is read and put back for h or the
+// proxy.
+func shardForm(r *http.Request) (url.Values, error) {
+	query := r.URL.Query()
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if r.Body == nil || ct != "application/x-www-form-urlencoded" ||
+		r.Method != "POST" && r.Method != "PUT" && r.Method != "PATCH" {
+		return query, nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxShardForm+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxShardForm {
+		return nil, errors.New("body too large")
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	// body values first, as in r.Form
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range query {
+		form[k] = append(form[k], vs...)
+	}
+	return form, nil
+}
+
+// rejectShards responds to a request spanning shards, with the node of each
+// channel, so the client can split it.
+func (s *Server) rejectShards(w http.ResponseWriter, owners map[string]string) {
+	if s.opts.Origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", s.opts.Origin)
+	}
+	j, err := json.Marshal(&SubResponse{
+		Error:  "channels are on different nodes, subscribe to each separately",
+		Shards: owners,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Error(w, string(j), http.StatusConflict)
+}
+
+func channelParam(q url.Values) []string {
+	if name := q.Get("channel"); name != "" {
+		return []string{name}
+	}
+	return nil
+}
+
+// subChannels returns the channels of a /sub request, every parameter but
+// cid.
+func subChannels(q url.Values) []string {
+	names := []string{}
+	for k := range q {
+		if k != "cid" {
+			names = append(names, k)
+		}
+	}
+	return names
+}
+
+// ShardsHandler shows the shard nodes, and the owner of channel if given.
+func (s *Server) ShardsHandler(w http.ResponseWriter, r *http.Request) {
+	resp := map[string]interface{}{
+		"self": s.opts.ShardSelf, "nodes": s.opts.Shards,
+	}
+	if s.ring != nil && r.FormValue("channel") != "" {
+		resp["owner"] = s.ring.Owner(r.FormValue("channel"))
+	}
+	s.respondJSON(w, resp)
+}
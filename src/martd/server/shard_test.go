@@ -0,0 +1,124 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testClient does not wait for a long poll forever.
+var testClient = &http.Client{Timeout: 5 * time.Second}
+
+// newTestShards starts two sharded servers, and returns them with the URL
+// of each.
+func newTestShards(t *testing.T) ([]*Server, []string) {
+	ts := []*httptest.Server{
+		httptest.NewUnstartedServer(nil), httptest.NewUnstartedServer(nil),
+	}
+	urls := []string{}
+	for _, srv := range ts {
+		urls = append(urls, "http://"+srv.Listener.Addr().String())
+	}
+
+	servers := []*Server{}
+	for i := range ts {
+		s := newTestServer(t, func(o *Options) {
+			o.Shards, o.ShardSelf = urls, urls[i]
+		})
+		ts[i].Config.Handler = s
+		ts[i].Start()
+		t.Cleanup(ts[i].Close)
+		servers = append(servers, s)
+	}
+	return servers, urls
+}
+
+// ownedBy returns a channel name that belongs to node.
+func ownedBy(t *testing.T, s *Server, node string) string {
+	for i := 0; i < 1000; i++ {
+		if name := fmt.Sprint("c", i); s.ring.Owner(name) == node {
+			return name
+		}
+	}
+	t.Fatal("no channel for", node)
+	return ""
+}
+
+// historyOf asks node for the payloads of the history of channel, with a
+// form body.
+func historyOf(t *testing.T, node, channel string) string {
+	t.Helper()
+
+	resp, err := testClient.PostForm(
+		node+"/history", url.Values{"channel": {channel}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	hr := &HistoryResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(hr); err != nil {
+		t.Fatal(err)
+	}
+	out := ""
+	for _, m := range hr.Messages {
+		out += m.Payload
+	}
+	return out
+}
+
+func TestShardFormBody(t *testing.T) {
+	servers, urls := newTestShards(t)
+	onA := ownedBy(t, servers[0], urls[0])
+	onB := ownedBy(t, servers[0], urls[1])
+
+	def := &ChannelDef{Name: onB, Size: 10, Life: time.Hour}
+	testChannel(t, servers[1], def, 2)
+
+	// asked on A, answered by B, which has the channel
+	if got := historyOf(t, urls[0], onB); got != "12" {
+		t.Fatalf("history of %s through %s: %q", onB, urls[0], got)
+	}
+
+	// a /pub body is the message, not routed on
+	resp, err := testClient.Post(
+		urls[0]+"/pub?channel="+onA, "application/x-www-form-urlencoded",
+		strings.NewReader("channel="+onB),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("pub: %s %s", resp.Status, body)
+	}
+	if got := historyOf(t, urls[0], onA); got != "channel="+onB {
+		t.Fatalf("history of %s: %q", onA, got)
+	}
+}
+
+func TestShardSubConflict(t *testing.T) {
+	servers, urls := newTestShards(t)
+	onA := ownedBy(t, servers[0], urls[0])
+	onB := ownedBy(t, servers[0], urls[1])
+
+	resp, err := testClient.PostForm(
+		urls[0]+"/sub", url.Values{onA: {"0"}, onB: {"0"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	sr := &SubResponse{}
+	json.NewDecoder(resp.Body).Decode(sr)
+	if resp.StatusCode != http.StatusConflict || sr.Shards[onB] != urls[1] {
+		t.Fatalf("got %s, %+v", resp.Status, sr)
+	}
+}
@@ -0,0 +1,302 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// WebhookQueue is how many events are held for a webhook that is slow or
+	// down, later ones are dropped.
+	WebhookQueue       = 10000
+	webhookTimeout     = 10 * time.Second
+	webhookMinBackoff  = time.Second
+	webhookMaxBackoff  = time.Minute
+	webhookSignature   = "X-Martd-Signature"
+	webhookEventHeader = "X-Martd-Event"
+)
+
+// WebhookEvent is the body of a webhook request. Event is one of created,
+// emptied, deleted, occupied (first subscriber), vacated (last subscriber
+// gone) and published.
+type WebhookEvent struct {
+	ID      string    `json:"id"`
+	Event   string    `json:"event"`
+	Channel string    `json:"channel"`
+	Time    time.Time `json:"time"`
+	Etag    string    `json:"etag,omitempty"`
+	Payload *string   `json:"payload,omitempty"`
+}
+
+// webhook is one of the Webhooks. Events are sent to it in order by one
+// goroutine, so a slow endpoint only holds up its own events.
+type webhook struct {
+	s     *Server
+	URL   string
+	host  string // of URL, which is not logged or shown
+	queue chan *WebhookEvent
+
+	lock      sync.Mutex
+	lastError string
+	sent      int64
+	failed    int64
+	dropped   int64
+}
+
+// WebhookStatus is the state of a webhook, as shown in stats and metrics.
+// The webhook is identified by its index in Webhooks and its host, as its
+// URL may have a token in it.
+type WebhookStatus struct {
+	Webhook   int    `json:"webhook"`
+	Host      string `json:"host"`
+	LastError string `json:"last_error,omitempty"`
+	Queued    int    `json:"queued"`
+	Sent      int64  `json:"sent"`
+	Failed    int64  `json:"failed"`
+	Dropped   int64  `json:"dropped"`
+}
+
+// startWebhooks starts a sender for each of the Webhooks.
+func (s *Server) startWebhooks() error {
+	if len(s.opts.Webhooks) == 0 {
+		return nil
+	}
+
+	for _, hook := range s.opts.Webhooks {
+		u, err := url.Parse(hook)
+		if err != nil || u.Host == "" {
+			return errors.New("invalid webhook URL")
+		}
+		h := &webhook{
+			s: s, URL: hook, host: u.Host,
+			queue: make(chan *WebhookEvent, WebhookQueue),
+		}
+		s.hooks = append(s.hooks, h)
+		s.goRun(h.sender)
+	}
+	log.Println("Sending channel events to", len(s.hooks), "webhooks")
+	return nil
+}
+
+// notify queues an event for all webhooks, without blocking: if a webhook's
+// queue is full the event is dropped for it. m is the message published,
+// for published events.
+func (s *Server) notify(c *Channel, event string, m *Message) {
+	if len(s.hooks) == 0 {
+		return
+	}
+
+	seq := atomic.AddInt64(&s.webhookSeq, 1)
+	ev := &WebhookEvent{
+		ID:      s.replID + "-" + strconv.FormatInt(seq, 10),
+		Event:   event,
+		Channel: c.Name,
+		Time:    time.Now(),
+	}
+	if m != nil {
+		payload := string(m.Data)
+		ev.Etag, ev.Payload = strconv.FormatInt(m.Created, 10), &payload
+	}
+
+	for _, h := range s.hooks {
+		select {
+		case h.queue <- ev:
+		default:
+			h.lock.Lock()
+			h.dropped++
+			h.lock.Unlock()
+		}
+	}
+}
+
+// WebhookStatuses returns the state of all webhooks, in Webhooks order.
+func (s *Server) WebhookStatuses() []*WebhookStatus {
+	statuses := make([]*WebhookStatus, 0, len(s.hooks))
+	for i, h := range s.hooks {
+		h.lock.Lock()
+		statuses = append(statuses, &WebhookStatus{
+			Webhook: i, Host: h.host, LastError: h.lastError,
+			Queued: len(h.queue),
+			Sent:   h.sent, Failed: h.failed, Dropped: h.dropped,
+		})
+		h.lock.Unlock()
+	}
+	return statuses
+}
+
+// sender delivers queued events one at a time, retrying each with backoff
+// up to WebhookRetries times, after which it is counted as failed. Events
+// still queued on Shutdown are dropped.
+func (h *webhook) sender() {
+	client := &http.Client{Timeout: webhookTimeout}
+
+	for {
+		var ev *WebhookEvent
+		select {
+		case ev = <-h.queue:
+		case <-h.s.done:
+			return
+		}
+
+		body, err := json.Marshal(ev)
+		if err != nil {
+			log.Println("Webhook event not encoded:", err)
+			continue
+		}
+
+		backoff := webhookMinBackoff
+		for try := 0; ; try++ {
+			err = h.send(client, ev, body)
+			if err == nil || try == h.s.opts.WebhookRetries {
+				break
+			}
+			if !h.s.sleep(backoff) {
+				return
+			}
+			if backoff *= 2; backoff > webhookMaxBackoff {
+				backoff = webhookMaxBackoff
+			}
+		}
+
+		h.lock.Lock()
+		if err == nil {
+			h.sent++
+			h.lastError = ""
+		} else {
+			log.Println("Webhook", h.host, "failed, dropping", ev.ID, ":", err)
+			h.failed++
+			h.lastError = err.Error()
+		}
+		h.lock.Unlock()
+		if err == nil {
+			h.s.nWebhookSent.Add(1)
+		}
+	}
+}
+
+func (h *webhook) send(client *http.Client, ev *WebhookEvent, body []byte) error {
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, ev.Event)
+	if secret := h.s.opts.WebhookSecret; secret != "" {
+		req.Header.Set(webhookSignature, "sha256="+Sign(secret, body))
+	}
+
+	resp, err := client.Do(req)
+	if err, ok := err.(*url.Error); ok {
+		return err.Err // without the URL
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// Sign returns the hex HMAC-SHA256 of body with key, as sent with webhooks.
+func Sign(key string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// watchNames checks the occupancy of the named channels, for a watcher that
+// subscribed to them, or if left is set, left them.
+func (s *Server) watchNames(names []string, left bool) {
+	if len(s.hooks) == 0 {
+		return
+	}
+	for _, name := range names {
+		if ch := s.LookupChannel(name); ch != nil {
+			ch.checkOccupancy(left)
+		}
+	}
+}
+
+// watchMatching is watchNames for the channels match selects, for pattern
+// subscriptions.
+func (s *Server) watchMatching(match func(name string) bool, left bool) {
+	if len(s.hooks) == 0 {
+		return
+	}
+	for _, ch := range s.ListChannels("") {
+		if match(ch.Name) {
+			ch.checkOccupancy(left)
+		}
+	}
+}
+
+// subscribed marks the channel as having a subscriber, the caller holds
+// c.lock.
+func (c *Channel) subscribed(now time.Time) {
+	c.lastSubscribed = now
+	if !c.occupied {
+		c.occupied = true
+		c.s.notify(c, "occupied", nil)
+	}
+}
+
+func (c *Channel) checkOccupancy(left bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	if left {
+		c.lastSubscribed = now
+	}
+	c.occupancy(now)
+}
+
+// occupancy sends occupied when the channel gets a subscriber or watcher,
+// and vacated once it has had none for WebhookIdle, checking again then.
+// The caller holds c.lock.
+func (c *Channel) occupancy(now time.Time) {
+	if len(c.s.hooks) == 0 {
+		return
+	}
+	if len(c.Clients) != 0 || c.s.Watching(c.Name) != 0 {
+		c.subscribed(now)
+		return
+	}
+	if !c.occupied {
+		return
+	}
+
+	idle := now.Sub(c.lastSubscribed)
+	if idle >= c.s.opts.WebhookIdle {
+		c.occupied = false
+		c.s.notify(c, "vacated", nil)
+		return
+	}
+	if !c.vacating {
+		c.vacating = true
+		time.AfterFunc(c.s.opts.WebhookIdle-idle, func() {
+			c.lock.Lock()
+			defer c.lock.Unlock()
+
+			c.vacating = false
+			c.occupancy(time.Now())
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hookBackend records the events it gets, checking their signature with
+// secret.
+func hookBackend(
+	t *testing.T, secret string,
+) (*httptest.Server, func() []string) {
+	lock, events := sync.Mutex{}, []string{}
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			if r.Header.Get(webhookSignature) != "sha256="+Sign(secret, body) {
+				t.Errorf("bad signature %q", r.Header.Get(webhookSignature))
+			}
+			ev := &WebhookEvent{}
+			if err := json.Unmarshal(body, ev); err != nil {
+				t.Error(err)
+			}
+			lock.Lock()
+			events = append(events, ev.Event+" "+ev.Channel)
+			lock.Unlock()
+		},
+	))
+	t.Cleanup(backend.Close)
+	return backend, func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string{}, events...)
+	}
+}
+
+// waitEvents waits for the backend to have got want.
+func waitEvents(t *testing.T, events func() []string, want ...string) {
+	t.Helper()
+	eventually(t, strings.Join(want, ", "), func() bool {
+		return strings.Join(events(), ", ") == strings.Join(want, ", ")
+	})
+}
+
+func TestWebhookOccupancy(t *testing.T) {
+	backend, events := hookBackend(t, "s3cret")
+	s := newTestServer(t, func(o *Options) {
+		o.Webhooks = []string{backend.URL + "/hook?token=t0ken"}
+		o.WebhookSecret = "s3cret"
+		o.WebhookIdle = 50 * time.Millisecond
+	})
+
+	ch, _ := s.GetOrCreateChannel(
+		&ChannelDef{Name: "c", Size: 10, Life: time.Hour},
+	)
+	evch := make(chan *ChannelEvent, 1)
+	ch.Sub(evch)
+	waitEvents(t, events, "created c", "occupied c")
+
+	// vacated once the subscriber has been gone for WebhookIdle
+	ch.UnSub(evch)
+	waitEvents(t, events, "created c", "occupied c", "vacated c")
+
+	// watchers count too
+	unwatch := s.Watch(func(name string) bool { return name == "c" }, evch)
+	s.watchNames([]string{"c"}, false)
+	waitEvents(
+		t, events, "created c", "occupied c", "vacated c", "occupied c",
+	)
+	unwatch()
+	s.watchNames([]string{"c"}, true)
+	waitEvents(
+		t, events, "created c", "occupied c", "vacated c", "occupied c",
+		"vacated c",
+	)
+
+	// as do pattern subscriptions, to channels created after them
+	c := newRedisClient(t, s)
+	c.do("PSUBSCRIBE", "d*")
+	s.GetOrCreateChannel(&ChannelDef{Name: "d", Size: 10, Life: time.Hour})
+	waitEvents(
+		t, events, "created c", "occupied c", "vacated c", "occupied c",
+		"vacated c", "created d", "occupied d",
+	)
+	c.do("PUNSUBSCRIBE")
+	waitEvents(
+		t, events, "created c", "occupied c", "vacated c", "occupied c",
+		"vacated c", "created d", "occupied d", "vacated d",
+	)
+}
+
+func TestWebhookStatusHidesURL(t *testing.T) {
+	s := newTestServer(t, func(o *Options) {
+		o.Webhooks = []string{"http://127.0.0.1:1/hook?token=t0ken"}
+		o.WebhookRetries = 0
+	})
+	s.GetOrCreateChannel(&ChannelDef{Name: "c", Size: 10, Life: time.Hour})
+
+	eventually(t, "the failure", func() bool {
+		return s.WebhookStatuses()[0].Failed == 1
+	})
+	status := s.WebhookStatuses()[0]
+	if status.Webhook != 0 || status.Host != "127.0.0.1:1" {
+		t.Fatalf("status %+v", status)
+	}
+
+	w := httptest.NewRecorder()
+	s.MetricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	j, _ := json.Marshal(status)
+	for _, out := range []string{w.Body.String(), string(j)} {
+		if strings.Contains(out, "t0ken") || strings.Contains(out, "/hook") {
+			t.Fatalf("webhook URL shown: %s", out)
+		}
+	}
+	series := `martd_webhook_failed_total{webhook="0",host="127.0.0.1:1"} 1`
+	if !strings.Contains(w.Body.String(), series) {
+		t.Fatalf("no webhook series in %s", w.Body.String())
+	}
+}
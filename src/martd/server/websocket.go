@@ -0,0 +1,208 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsContinuation = 0
+	wsText         = 1
+	wsBinary       = 2
+	wsClose        = 8
+	wsPing         = 9
+	wsPong         = 10
+)
+
+var ErrNotWebSocket = errors.New("not a websocket upgrade")
+
+// wsConn is the server side of a WebSocket connection that carries a byte
+// stream in its data frames, as MQTT over WebSocket does: Read returns the
+// payloads of data frames back to back, Write sends a binary frame. Pings
+// are answered while reading.
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	// of the data frame being read
+	remaining uint64
+	mask      [4]byte
+	offset    int
+
+	wlock sync.Mutex
+}
+
+// wsUpgrade completes a WebSocket handshake, choosing protocol if the client
+// offers it, and takes over the connection.
+func wsUpgrade(
+	w http.ResponseWriter, r *http.Request, protocol string,
+) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		!strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		http.Error(w, ErrNotWebSocket.Error(), http.StatusBadRequest)
+		return nil, ErrNotWebSocket
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "can not take over connection", http.StatusInternalServerError)
+		return nil, ErrNotWebSocket
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) +
+		"\r\n"
+	for _, offered := range strings.Split(r.Header.Get("Sec-WebSocket-Protocol"), ",") {
+		if strings.TrimSpace(offered) == protocol {
+			resp += "Sec-WebSocket-Protocol: " + protocol + "\r\n"
+			break
+		}
+	}
+	if _, err := conn.Write([]byte(resp + "\r\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &wsConn{conn: conn, r: rw.Reader}, nil
+}
+
+func (ws *wsConn) Read(p []byte) (int, error) {
+	for ws.remaining == 0 {
+		if err := ws.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	if uint64(len(p)) > ws.remaining {
+		p = p[:ws.remaining]
+	}
+	n, err := ws.r.Read(p)
+	for i := 0; i < n; i++ {
+		p[i] ^= ws.mask[(ws.offset+i)%4]
+	}
+	ws.offset += n
+	ws.remaining -= uint64(n)
+	return n, err
+}
+
+// nextFrame reads frame headers till a data frame with a payload, handling
+// control frames on the way.
+func (ws *wsConn) nextFrame() error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(ws.r, header); err != nil {
+		return err
+	}
+	opcode := header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(ws.r, ext); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(ws.r, ext); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+
+	if !masked {
+		return errors.New("websocket: unmasked client frame")
+	}
+	if _, err := io.ReadFull(ws.r, ws.mask[:]); err != nil {
+		return err
+	}
+
+	switch opcode {
+	case wsContinuation, wsText, wsBinary:
+		ws.remaining, ws.offset = length, 0
+		return nil
+	}
+
+	if length > 125 {
+		return errors.New("websocket: control frame too long")
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(ws.r, payload); err != nil {
+		return err
+	}
+	for i := range payload {
+		payload[i] ^= ws.mask[i%4]
+	}
+
+	switch opcode {
+	case wsPing:
+		return ws.writeFrame(wsPong, payload)
+	case wsPong:
+		return nil
+	case wsClose:
+		ws.writeFrame(wsClose, payload)
+		return io.EOF
+	}
+	return errors.New("websocket: unknown opcode")
+}
+
+func (ws *wsConn) Write(p []byte) (int, error) {
+	if err := ws.writeFrame(wsBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) error {
+	ws.wlock.Lock()
+	defer ws.wlock.Unlock()
+
+	header := []byte{0x80 | opcode, 0}
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xffff:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header[1] = 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+
+	if _, err := ws.conn.Write(header); err != nil {
+		return err
+	}
+	_, err := ws.conn.Write(payload)
+	return err
+}
+
+func (ws *wsConn) SetReadDeadline(t time.Time) error {
+	return ws.conn.SetReadDeadline(t)
+}
+
+func (ws *wsConn) Close() error {
+	ws.writeFrame(wsClose, nil)
+	return ws.conn.Close()
+}
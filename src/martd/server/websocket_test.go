@@ -0,0 +1,213 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsFrame encodes a client frame, masked with mask unless it is nil.
+func wsFrame(fin bool, opcode byte, mask []byte, payload []byte) []byte {
+	b0 := opcode
+	if fin {
+		b0 |= 0x80
+	}
+	frame := []byte{b0, 0}
+	switch n := len(payload); {
+	case n < 126:
+		frame[1] = byte(n)
+	case n <= 0xffff:
+		frame[1] = 126
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame[1] = 127
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	if mask == nil {
+		return append(frame, payload...)
+	}
+
+	frame[1] |= 0x80
+	frame = append(frame, mask...)
+	for i, c := range payload {
+		frame = append(frame, c^mask[i%4])
+	}
+	return frame
+}
+
+// readWSFrame reads a server frame, which is never masked.
+func readWSFrame(t *testing.T, r *bufio.Reader) (byte, []byte) {
+	t.Helper()
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		t.Fatal(err)
+	}
+	if header[0]&0x80 == 0 || header[1]&0x80 != 0 {
+		t.Fatalf("frame header % x: not final, or masked", header)
+	}
+	n := uint64(header[1] & 0x7f)
+	switch n {
+	case 126:
+		ext := make([]byte, 2)
+		io.ReadFull(r, ext)
+		n = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		io.ReadFull(r, ext)
+		n = binary.BigEndian.Uint64(ext)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return header[0] & 0x0f, payload
+}
+
+func newWSPipe(t *testing.T) (*wsConn, net.Conn, *bufio.Reader) {
+	client, conn := net.Pipe()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { client.Close(); conn.Close() })
+	return &wsConn{conn: conn, r: bufio.NewReader(conn)}, client,
+		bufio.NewReader(client)
+}
+
+func TestWSRead(t *testing.T) {
+	ws, client, r := newWSPipe(t)
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+
+	// a message in two fragments, with a ping between them, and one that
+	// needs a 16 bit length
+	long := bytes.Repeat([]byte("0123456789"), 20)
+	go func() {
+		client.Write(wsFrame(false, wsBinary, mask, []byte("hello ")))
+		client.Write(wsFrame(true, wsPing, mask, []byte("are you there")))
+		client.Write(wsFrame(true, wsContinuation, mask, []byte("world")))
+		client.Write(wsFrame(true, wsBinary, []byte{1, 2, 3, 4}, long))
+		client.Write(wsFrame(true, wsClose, mask, []byte{0x03, 0xe8}))
+	}()
+
+	got := make(chan []byte)
+	go func() {
+		data, err := io.ReadAll(ws) // till the close frame
+		if err != nil {
+			t.Error(err)
+		}
+		got <- data
+	}()
+
+	opcode, payload := readWSFrame(t, r)
+	if opcode != wsPong || string(payload) != "are you there" {
+		t.Fatalf("ping answered with %d %q", opcode, payload)
+	}
+	opcode, payload = readWSFrame(t, r)
+	if opcode != wsClose || !bytes.Equal(payload, []byte{0x03, 0xe8}) {
+		t.Fatalf("close answered with %d % x", opcode, payload)
+	}
+
+	want := append([]byte("hello world"), long...)
+	if data := <-got; !bytes.Equal(data, want) {
+		t.Fatalf("read %q", data)
+	}
+}
+
+func TestWSUnmasked(t *testing.T) {
+	ws, client, _ := newWSPipe(t)
+	go client.Write(wsFrame(true, wsBinary, nil, []byte("x")))
+
+	if _, err := ws.Read(make([]byte, 10)); err == nil {
+		t.Fatal("read an unmasked client frame")
+	}
+}
+
+func TestWSControlTooLong(t *testing.T) {
+	ws, client, _ := newWSPipe(t)
+	go client.Write(wsFrame(true, wsPing, []byte{1, 2, 3, 4}, make([]byte, 126)))
+
+	if _, err := ws.Read(make([]byte, 10)); err == nil {
+		t.Fatal("read a ping of 126 bytes")
+	}
+}
+
+func TestWSWrite(t *testing.T) {
+	for _, n := range []int{0, 125, 126, 0xffff, 0x10000} {
+		ws, _, r := newWSPipe(t)
+		data := bytes.Repeat([]byte{'x'}, n)
+		go ws.Write(data)
+
+		opcode, payload := readWSFrame(t, r)
+		if opcode != wsBinary || !bytes.Equal(payload, data) {
+			t.Fatalf("%d bytes: got %d with %d bytes", n, opcode, len(payload))
+		}
+	}
+}
+
+func TestWSUpgrade(t *testing.T) {
+	s := newTestServer(t, nil)
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			ws, err := wsUpgrade(w, r, "mqtt")
+			if err != nil {
+				return
+			}
+			s.newMQTTConn(ws, s.connSubscriber("mqtt", r.RemoteAddr)).serve()
+		},
+	))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("plain GET: got %s", resp.Status)
+	}
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// the handshake of RFC 6455
+	io.WriteString(conn, "GET /mqtt HTTP/1.1\r\nHost: martd\r\n"+
+		"Upgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Version: 13\r\n"+
+		"Sec-WebSocket-Protocol: mqttv3.1, mqtt\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err = http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" ||
+		resp.Header.Get("Sec-WebSocket-Protocol") != "mqtt" {
+		t.Fatalf("handshake answered with %s %v", resp.Status, resp.Header)
+	}
+
+	// MQTT over it, split across frames
+	mask := []byte{9, 8, 7, 6}
+	connect := mqttEncode(
+		mqttConnect<<4, mqttString("MQTT"), []byte{4, 0x02, 0, 60},
+		mqttString("ws"),
+	)
+	conn.Write(wsFrame(true, wsBinary, mask, connect[:5]))
+	conn.Write(wsFrame(true, wsBinary, mask, connect[5:]))
+
+	opcode, payload := readWSFrame(t, r)
+	if opcode != wsBinary ||
+		!bytes.Equal(payload, []byte{mqttConnack << 4, 2, 0, 0}) {
+		t.Fatalf("CONNACK: got %d % x", opcode, payload)
+	}
+}
@@ -0,0 +1,38 @@
+// martpub publishes a message to a martd channel.
+//
+//	martpub [flags] channel message
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"martd/client"
+)
+
+func main() {
+	endpoint := flag.String("endpoint", "http://localhost:54321", "martd URL")
+	opts := &client.Options{}
+	flag.UintVar(&opts.Size, "size", 10, "Messages kept by the channel.")
+	flag.DurationVar(&opts.Life, "life", time.Hour, "How long messages are kept.")
+	flag.BoolVar(&opts.One2One, "one2one", false, "Create a one2one channel.")
+	flag.StringVar(&opts.Key, "key", "", "Key of the channel.")
+	flag.BoolVar(&opts.Sync, "sync", false, "Wait till the message is stored.")
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		log.Fatalln("usage: martpub [flags] channel message")
+	}
+
+	c := client.New(*endpoint)
+	etag, err := c.Publish(
+		context.Background(), flag.Arg(0), []byte(flag.Arg(1)), opts,
+	)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println(etag)
+}
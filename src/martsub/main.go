@@ -0,0 +1,33 @@
+// martsub prints the messages of martd channels as they are published.
+//
+//	martsub [flags] channel...
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+
+	"martd/client"
+)
+
+func main() {
+	endpoint := flag.String("endpoint", "http://localhost:54321", "martd URL")
+	etag := flag.String("etag", "0", "Etag to start after, 0 for all messages.")
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		log.Fatalln("usage: martsub [flags] channel...")
+	}
+
+	s := client.New(*endpoint).Subscribe()
+	for _, name := range flag.Args() {
+		s.Since(name, *etag)
+	}
+
+	err := s.Run(context.Background(), func(m *client.Message) {
+		fmt.Printf("%s: %s\n", m.Channel, m.Data)
+	})
+	log.Fatalln(err)
+}